@@ -1,11 +1,16 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 
 	"fluxxxer/internal/app"
+	"fluxxxer/internal/config"
+	"fluxxxer/internal/httpx"
+	"fluxxxer/internal/logging"
 	"github.com/joho/godotenv"
 )
 
@@ -17,28 +22,70 @@ var (
 )
 
 func main() {
+	mock := flag.Bool("mock", false, "run against built-in fake Flux and upscaler servers")
+	logLevel := flag.String("log-level", "", "minimum log level: debug, info, warn or error (overrides FLUXXXER_LOG)")
+	logFormat := flag.String("log-format", "", "log format: text or json (overrides FLUXXXER_LOG_FORMAT)")
+	flag.Parse()
+
+	// Identify ourselves honestly to every service
+	httpx.UserAgent = "fluxxxer/" + Version
+
 	// Try to load environment from different possible locations
-	loadEnvironment()
+	envFile := loadEnvironment()
+
+	// Mock servers override whatever endpoints the environment configures
+	var mockFluxURL, mockUpscalerURL string
+	if *mock {
+		mockFluxURL, mockUpscalerURL = startMockServers()
+	}
+
+	cfg := config.NewConfig()
+	if *logLevel != "" {
+		cfg.LogLevel = *logLevel
+	}
+	if *logFormat != "" {
+		cfg.LogFormat = *logFormat
+	}
+
+	logFile, err := logging.Setup(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(2)
+	}
+	defer logFile.Close()
+	logging.AddSecrets(cfg.Secrets()...)
+
+	slog.Info("Starting fluxxxer", "version", Version, "commit", Commit, "date", Date)
+	if envFile != "" {
+		slog.Info("Loaded environment", "path", envFile)
+	} else {
+		slog.Warn("No .env file found, using environment variables")
+	}
+	if *mock {
+		slog.Info("Mock mode", "flux", mockFluxURL, "upscaler", mockUpscalerURL)
+	}
 
-	// Validate required environment variables
-	if os.Getenv("FLUX_API_URL") == "" {
-		fmt.Fprintln(os.Stderr, "Error: FLUX_API_URL environment variable is not set")
-		fmt.Fprintln(os.Stderr, "Please set it in your .env file or environment")
+	// Validate required settings
+	if cfg.GetAPIEndpoint() == "" {
+		slog.Error("FLUX_API_URL is not set; set it in your .env file or environment")
+		logFile.Close()
 		os.Exit(1)
 	}
 
-	// Create and run the application
-	application := app.New()
-	if code := application.Run(os.Args); code > 0 {
+	// Create and run the application, passing on arguments we did not parse
+	application := app.New(cfg)
+	if code := application.Run(append([]string{os.Args[0]}, flag.Args()...)); code > 0 {
+		logFile.Close()
 		os.Exit(code)
 	}
 }
 
 // loadEnvironment tries to load environment variables from multiple locations
-func loadEnvironment() {
+// and returns the file it loaded, or "" if none was found
+func loadEnvironment() string {
 	// Try current directory first
 	if err := godotenv.Load(); err == nil {
-		return
+		return ".env"
 	}
 
 	// Try user's home directory
@@ -46,7 +93,7 @@ func loadEnvironment() {
 	if err == nil {
 		homePath := filepath.Join(home, ".fluxxxer", ".env")
 		if err := godotenv.Load(homePath); err == nil {
-			return
+			return homePath
 		}
 	}
 
@@ -59,7 +106,7 @@ func loadEnvironment() {
 	if xdgConfig != "" {
 		xdgPath := filepath.Join(xdgConfig, "fluxxxer", ".env")
 		if err := godotenv.Load(xdgPath); err == nil {
-			return
+			return xdgPath
 		}
 	}
 
@@ -69,10 +116,10 @@ func loadEnvironment() {
 		execDir := filepath.Dir(execPath)
 		execEnvPath := filepath.Join(execDir, ".env")
 		if err := godotenv.Load(execEnvPath); err == nil {
-			return
+			return execEnvPath
 		}
 	}
 
-	// Log that no .env file was found but continue anyway
-	fmt.Fprintf(os.Stderr, "Warning: No .env file found. Using environment variables.\n")
+	// No .env file was found, but continue anyway
+	return ""
 }
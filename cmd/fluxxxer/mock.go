@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+
+	"fluxxxer/internal/flux/fluxtest"
+	"fluxxxer/internal/upscaler/upscalertest"
+)
+
+// startMockServers runs the fake Flux and upscaler endpoints in-process and
+// points the configuration at them, so the app works without network access.
+// It returns the URLs of both endpoints.
+func startMockServers() (fluxURL, upscalerURL string) {
+	fluxServer := fluxtest.NewPredictionServer()
+	// A few polls make the progress reporting visible
+	fluxServer.PollsUntilDone = 4
+
+	upscaleServer := upscalertest.NewServer()
+
+	os.Setenv("FLUX_API_URL", fluxServer.URL)
+	os.Setenv("FLUX_BACKEND", "flux")
+	os.Setenv("FLUX_API_MODE", "auto")
+	os.Setenv("UPSCALER_API_URL", upscaleServer.Endpoint())
+	os.Setenv("UPSCALER_API_KEY", "mock")
+
+	return fluxServer.URL, upscaleServer.Endpoint()
+}
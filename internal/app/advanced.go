@@ -0,0 +1,189 @@
+package app
+
+import (
+	"strings"
+
+	"fluxxxer/internal/config"
+	"fluxxxer/internal/flux"
+
+	"github.com/diamondburned/gotk4/pkg/gtk/v4"
+)
+
+// advancedOptions holds the widgets of the collapsible "Advanced" section.
+// Each sampling parameter has a check button; unchecked parameters are left
+// to the endpoint's defaults and not sent.
+type advancedOptions struct {
+	model         *gtk.DropDown
+	stepsCheck    *gtk.CheckButton
+	steps         *gtk.SpinButton
+	guidanceCheck *gtk.CheckButton
+	guidance      *gtk.SpinButton
+	goFast        *gtk.DropDown
+	megapixels    *gtk.DropDown
+	negative      *gtk.Entry
+
+	// Saved LoRAs and their per-generation toggles, in the same order
+	loraBox        *gtk.Box
+	loras          []config.LoRA
+	loraChecks     []*gtk.CheckButton
+	emptyLoRALabel *gtk.Label
+}
+
+// goFastChoices are the entries of the go fast dropdown
+var goFastChoices = []string{"Default", "On", "Off"}
+
+// createAdvancedSection builds the expander with the model and sampling
+// parameters
+func (a *App) createAdvancedSection() *gtk.Expander {
+	adv := &advancedOptions{}
+	a.advanced = adv
+
+	expander := gtk.NewExpander("Advanced")
+
+	box := gtk.NewBox(gtk.OrientationVertical, 8)
+	box.SetMarginTop(8)
+
+	row := gtk.NewBox(gtk.OrientationHorizontal, 8)
+
+	// Model dropdown; "Default" leaves the choice to the endpoint
+	modelLabel := gtk.NewLabel("Model:")
+	modelNames := []string{"Default"}
+	for _, m := range flux.Models {
+		modelNames = append(modelNames, m.DisplayName)
+	}
+	adv.model = gtk.NewDropDownFromStrings(modelNames)
+	for i, m := range flux.Models {
+		if m.Name == a.config.GetDefaultModel() {
+			adv.model.SetSelected(uint(i + 1))
+			break
+		}
+	}
+
+	// Inference steps
+	adv.stepsCheck = gtk.NewCheckButtonWithLabel("Steps:")
+	adv.stepsCheck.SetMarginStart(16)
+	adv.steps = gtk.NewSpinButtonWithRange(1, 50, 1)
+	adv.stepsCheck.ConnectToggled(func() {
+		adv.steps.SetSensitive(adv.stepsCheck.Active())
+	})
+
+	// Guidance scale
+	adv.guidanceCheck = gtk.NewCheckButtonWithLabel("Guidance:")
+	adv.guidanceCheck.SetMarginStart(16)
+	adv.guidance = gtk.NewSpinButtonWithRange(0, 10, 0.1)
+	adv.guidance.SetDigits(1)
+	adv.guidanceCheck.ConnectToggled(func() {
+		adv.guidance.SetSensitive(adv.guidanceCheck.Active())
+	})
+
+	// Go fast
+	goFastLabel := gtk.NewLabel("Go fast:")
+	goFastLabel.SetMarginStart(16)
+	adv.goFast = gtk.NewDropDownFromStrings(goFastChoices)
+
+	// Megapixels
+	megapixelsLabel := gtk.NewLabel("Megapixels:")
+	megapixelsLabel.SetMarginStart(16)
+	adv.megapixels = gtk.NewDropDownFromStrings(append([]string{"Default"}, flux.MegapixelOptions...))
+
+	row.Append(modelLabel)
+	row.Append(adv.model)
+	row.Append(adv.stepsCheck)
+	row.Append(adv.steps)
+	row.Append(adv.guidanceCheck)
+	row.Append(adv.guidance)
+	row.Append(goFastLabel)
+	row.Append(adv.goFast)
+	row.Append(megapixelsLabel)
+	row.Append(adv.megapixels)
+
+	// Negative prompt
+	adv.negative = gtk.NewEntry()
+	adv.negative.SetPlaceholderText("Negative prompt (optional)")
+	adv.negative.SetHExpand(true)
+
+	box.Append(row)
+	box.Append(adv.negative)
+	box.Append(a.createLoRAToggles())
+	expander.SetChild(box)
+
+	// Reset ranges and defaults whenever the model changes
+	adv.model.NotifyProperty("selected", adv.applyModelDefaults)
+	adv.applyModelDefaults()
+
+	return expander
+}
+
+// selectedModel returns the model name picked in the dropdown, empty for the
+// endpoint default
+func (adv *advancedOptions) selectedModel() string {
+	idx := adv.model.Selected()
+	if idx == 0 || idx > uint(len(flux.Models)) {
+		return ""
+	}
+	return flux.Models[idx-1].Name
+}
+
+// applyModelDefaults sets the parameter ranges and defaults of the selected
+// model and disables what it does not support
+func (adv *advancedOptions) applyModelDefaults() {
+	m, err := flux.ModelDefaults(adv.selectedModel())
+	if err != nil {
+		return
+	}
+
+	adv.steps.SetRange(float64(m.MinSteps), float64(m.MaxSteps))
+	adv.steps.SetValue(float64(m.DefaultSteps))
+	adv.steps.SetSensitive(adv.stepsCheck.Active())
+
+	if m.SupportsGuidance() {
+		adv.guidance.SetRange(m.MinGuidance, m.MaxGuidance)
+		adv.guidance.SetValue(m.DefaultGuidance)
+		adv.guidanceCheck.SetSensitive(true)
+	} else {
+		adv.guidanceCheck.SetActive(false)
+		adv.guidanceCheck.SetSensitive(false)
+	}
+	adv.guidance.SetSensitive(adv.guidanceCheck.Active())
+
+	if !m.SupportsGoFast {
+		adv.goFast.SetSelected(0)
+	}
+	adv.goFast.SetSensitive(m.SupportsGoFast)
+
+	if !m.SupportsMegapixels {
+		adv.megapixels.SetSelected(0)
+	}
+	adv.megapixels.SetSensitive(m.SupportsMegapixels)
+}
+
+// apply copies the enabled advanced settings into opts
+func (adv *advancedOptions) apply(opts *flux.GenerateOptions) {
+	opts.Model = adv.selectedModel()
+
+	if adv.stepsCheck.Active() {
+		steps := adv.steps.ValueAsInt()
+		opts.NumInferenceSteps = &steps
+	}
+
+	if adv.guidanceCheck.Active() {
+		guidance := adv.guidance.Value()
+		opts.Guidance = &guidance
+	}
+
+	switch adv.goFast.Selected() {
+	case 1:
+		goFast := true
+		opts.GoFast = &goFast
+	case 2:
+		goFast := false
+		opts.GoFast = &goFast
+	}
+
+	if idx := adv.megapixels.Selected(); idx > 0 && idx <= uint(len(flux.MegapixelOptions)) {
+		opts.Megapixels = flux.MegapixelOptions[idx-1]
+	}
+
+	opts.NegativePrompt = strings.TrimSpace(adv.negative.Text())
+	opts.LoRAs = adv.selectedLoRAs()
+}
@@ -1,8 +1,15 @@
 package app
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
 	"fluxxxer/internal/config"
 	"fluxxxer/internal/flux"
+	"fluxxxer/internal/httpx"
 	"fluxxxer/internal/upscaler"
 
 	"github.com/diamondburned/gotk4/pkg/gio/v2"
@@ -15,47 +22,133 @@ type App struct {
 	win            *gtk.ApplicationWindow
 	entry          *gtk.Entry
 	spinner        *gtk.Spinner
+	cancelBtn      *gtk.Button
 	imageBox       *gtk.Box
 	statusBar      *gtk.Label
+	copyDetailsBtn *gtk.Button
+	errorDetails   string
 	currentWidth   int
 	
+	// Custom output size
+	customRatioEntry *gtk.Entry
+	customSizeBox    *gtk.Box
+	widthSpin        *gtk.SpinButton
+	heightSpin       *gtk.SpinButton
+	
+	// Image-to-image input
+	initImage      string
+	maskImage      string
+	initImageLabel *gtk.Label
+	clearInputBtn  *gtk.Button
+	strengthScale  *gtk.Scale
+	
+	// Model and sampling parameters
+	advanced *advancedOptions
+	
+	// In-flight generation state
+	cancelGenerate context.CancelFunc
+	generationID   int
+	
 	// Mode tracking
 	isGeneratorMode bool
 	generatorToggle *gtk.ToggleButton
 	upscalerToggle  *gtk.ToggleButton
 	
 	// Service clients
-	client         *flux.Client
+	client         flux.Generator
+	clientErr      error
 	upscalerClient *upscaler.Client
 	config         *config.Config
+	
+	// Upscalers that run on this machine; commandUpscaler is nil unless
+	// UPSCALER_COMMAND is set
+	localUpscaler   *upscaler.LocalUpscaler
+	commandUpscaler *upscaler.CommandUpscaler
+	
+	// Batch upscaling queue and its part of the upscaler view
+	batch *batchView
+	
+	// Client for downloading images, on the shared transport, or the
+	// backend's own client when its images need the endpoint's headers
+	httpClient    *http.Client
+	httpClientErr error
 }
 
 // New creates a new application instance
-func New() *App {
-	cfg := config.NewConfig()
+func New(cfg *config.Config) *App {
 	
 	// Create the app instance
 	app := &App{
 		Application:     gtk.NewApplication("com.fluxxxer.app", gio.ApplicationFlagsNone),
-		client:          flux.NewClient(cfg),
 		config:          cfg,
 		isGeneratorMode: true, // Default to generator mode
 	}
 	
+	// Create the configured generation backend; report problems on first use
+	app.client, app.clientErr = flux.NewGenerator(cfg)
+	
+	// Download images through the shared transport; invalid transport
+	// settings are reported when the window opens
+	app.httpClient, app.httpClientErr = httpx.NewClient(cfg)
+	if app.httpClientErr != nil {
+		app.httpClient = &http.Client{}
+	}
+	
+	// Backends serving images from their own endpoint need its headers
+	if fetcher, ok := app.client.(flux.ImageFetcher); ok {
+		app.httpClient = fetcher.ImageClient()
+	}
+	
 	// Initialize upscaler client if configured
 	if cfg.IsUpscalerConfigured() {
 		app.upscalerClient = upscaler.NewClient(cfg)
 	}
 	
+	// Local upscaling needs no configuration
+	app.localUpscaler = upscaler.NewLocalUpscaler(cfg)
+	if cfg.GetUpscalerCommand() != "" {
+		app.commandUpscaler = upscaler.NewCommandUpscaler(cfg)
+	}
+	
+	// Load the batch left over from the last session; a batch that cannot
+	// be read is reported when the window opens
+	app.batch = &batchView{}
+	app.batch.queue, app.batch.queueErr = upscaler.LoadBatch(cfg.GetBatchFile())
+	
 	// Connect activate handler
 	app.Application.ConnectActivate(app.setupUI)
 	
+	// Remove the temporary files still in use on exit
+	app.Application.ConnectShutdown(app.removeTempFiles)
+	
 	return app
 }
 
+// removeTempFiles deletes the temporary files the app still owns
+func (a *App) removeTempFiles() {
+	a.removeMaskFile()
+}
+
 // setStatus updates the status bar with a message
 func (a *App) setStatus(message string) {
 	a.statusBar.SetText(message)
+	a.copyDetailsBtn.SetVisible(false)
+}
+
+// showError reports err in the status bar. API errors get a readable message
+// and a "Copy details" button with the full response for bug reports.
+func (a *App) showError(prefix string, err error) {
+	slog.Error(prefix, "error", err)
+
+	var apiErr *httpx.APIError
+	if !errors.As(err, &apiErr) {
+		a.setStatus(fmt.Sprintf("%s: %v", prefix, err))
+		return
+	}
+
+	a.setStatus(fmt.Sprintf("%s: %s", prefix, apiErr.UserMessage()))
+	a.errorDetails = apiErr.Details()
+	a.copyDetailsBtn.SetVisible(true)
 }
 
 // setMode switches between generator and upscaler modes
@@ -72,18 +165,37 @@ func (a *App) setMode(isGeneratorMode bool) {
 	if isGeneratorMode {
 		a.setStatus("Image Generator Mode")
 	} else {
-		// Check if upscaler is configured
-		if a.config.IsUpscalerConfigured() {
+		// Without the service only local upscaling is available
+		if a.isUpscalerConfigured() {
 			a.setStatus("Image Upscaler Mode - Drag and drop an image to upscale")
 		} else {
-			a.setStatus("Upscaler not configured. Set UPSCALER_API_URL and UPSCALER_API_KEY in your .env file.")
-			// Revert to generator mode if upscaler not configured
-			a.setMode(true)
+			a.setStatus("Image Upscaler Mode - Local upscaling only. Set UPSCALER_API_URL and UPSCALER_API_KEY in your .env file to use the upscaling service.")
 		}
 	}
 }
 
-// isUpscalerConfigured checks if the upscaler is properly configured
+// isUpscalerConfigured checks if the upscaling service is properly configured
 func (a *App) isUpscalerConfigured() bool {
 	return a.config.IsUpscalerConfigured() && a.upscalerClient != nil
 }
+
+// errUpscalerNotConfigured is returned for service upscale types when the
+// service is not configured
+var errUpscalerNotConfigured = errors.New("upscaler not configured. Set UPSCALER_API_URL and UPSCALER_API_KEY in your .env file, or pick the local upscale type")
+
+// upscalerFor returns the backend that handles the upscale type
+func (a *App) upscalerFor(t upscaler.UpscaleType) (upscaler.Upscaler, error) {
+	switch t {
+	case upscaler.UpscaleLocal:
+		return a.localUpscaler, nil
+	case upscaler.UpscaleCommand:
+		if a.commandUpscaler == nil {
+			return nil, errors.New("no upscaler command configured. Set UPSCALER_COMMAND in your .env file")
+		}
+		return a.commandUpscaler, nil
+	}
+	if !a.isUpscalerConfigured() {
+		return nil, errUpscalerNotConfigured
+	}
+	return a.upscalerClient, nil
+}
@@ -0,0 +1,537 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"fluxxxer/internal/upscaler"
+
+	"github.com/diamondburned/gotk4/pkg/gio/v2"
+	"github.com/diamondburned/gotk4/pkg/glib/v2"
+	"github.com/diamondburned/gotk4/pkg/gtk/v4"
+	"github.com/diamondburned/gotk4/pkg/pango"
+)
+
+// maxBatchConcurrency bounds the parallel jobs that can be picked
+const maxBatchConcurrency = 4
+
+// batchView holds the batch upscaling options and job list of the upscaler
+// view
+type batchView struct {
+	queue *upscaler.Batch
+	// queueErr reports a saved batch that could not be read
+	queueErr error
+	// cancel stops the running batch; nil when it is not running
+	cancel context.CancelFunc
+
+	// Options for newly queued jobs
+	typeCombo       *gtk.DropDown
+	promptEntry     *gtk.Entry
+	formatCombo     *gtk.DropDown
+	scaleBox        *gtk.Box
+	scaleCombo      *gtk.DropDown
+	outputDir       string
+	outputLabel     *gtk.Label
+	templateEntry   *gtk.Entry
+	concurrencySpin *gtk.SpinButton
+
+	// Job list
+	list    *gtk.ListBox
+	rows    map[int]*batchRow
+	summary *gtk.Label
+	runBtn  *gtk.Button
+}
+
+// batchRow shows one job in the list
+type batchRow struct {
+	box      *gtk.Box
+	status   *gtk.Label
+	progress *gtk.ProgressBar
+	retryBtn *gtk.Button
+}
+
+// batchFormats and batchScales are the choices of the format and scale
+// dropdowns
+var (
+	batchFormats = []string{"png", "jpeg", "webp"}
+	batchScales  = []int{4, 2}
+)
+
+// createBatchOptions builds the options applied to images queued for batch
+// upscaling
+func (a *App) createBatchOptions() *gtk.Frame {
+	bv := a.batch
+
+	optionsFrame := gtk.NewFrame("Batch Options")
+	optionsBox := gtk.NewBox(gtk.OrientationVertical, 8)
+	optionsBox.SetMarginTop(16)
+	optionsBox.SetMarginBottom(16)
+	optionsBox.SetMarginStart(16)
+	optionsBox.SetMarginEnd(16)
+
+	// newRow labels a row of options
+	newRow := func(label string) *gtk.Box {
+		row := gtk.NewBox(gtk.OrientationHorizontal, 8)
+		rowLabel := gtk.NewLabel(label)
+		rowLabel.SetHAlign(gtk.AlignStart)
+		rowLabel.SetXAlign(0)
+		rowLabel.SetWidthChars(14)
+		row.Append(rowLabel)
+		optionsBox.Append(row)
+		return row
+	}
+
+	// Upscale type, falling back to local upscaling when the service is
+	// not configured
+	bv.typeCombo = gtk.NewDropDown(nil, nil)
+	bv.typeCombo.SetModel(gtk.NewStringList(a.config.GetSupportedUpscaleTypes()))
+	bv.typeCombo.SetHExpand(true)
+
+	defaultType := a.config.GetDefaultUpscaleType()
+	if !a.isUpscalerConfigured() {
+		defaultType = string(upscaler.UpscaleLocal)
+	}
+	for i, t := range a.config.GetSupportedUpscaleTypes() {
+		if t == defaultType {
+			bv.typeCombo.SetSelected(uint(i))
+			break
+		}
+	}
+	newRow("Upscale Type:").Append(bv.typeCombo)
+
+	// Prompt for conservative and creative modes
+	bv.promptEntry = gtk.NewEntry()
+	bv.promptEntry.SetPlaceholderText("Enter a prompt to guide upscaling (for conservative/creative modes)")
+	bv.promptEntry.SetHExpand(true)
+	newRow("Prompt:").Append(bv.promptEntry)
+
+	// Output format
+	bv.formatCombo = gtk.NewDropDown(nil, nil)
+	bv.formatCombo.SetModel(gtk.NewStringList(batchFormats))
+	bv.formatCombo.SetHExpand(true)
+	newRow("Output Format:").Append(bv.formatCombo)
+
+	// Scale factor, for upscaling on this machine only
+	bv.scaleCombo = gtk.NewDropDown(nil, nil)
+	bv.scaleCombo.SetModel(gtk.NewStringList([]string{"4x", "2x"}))
+	bv.scaleCombo.SetHExpand(true)
+	bv.scaleBox = newRow("Scale:")
+	bv.scaleBox.Append(bv.scaleCombo)
+
+	// Output folder, next to each source image unless chosen
+	bv.outputLabel = gtk.NewLabel("")
+	bv.outputLabel.SetXAlign(0)
+	bv.outputLabel.SetHExpand(true)
+	bv.outputLabel.SetEllipsize(pango.EllipsizeMiddle)
+	chooseOutputBtn := gtk.NewButtonWithLabel("Choose...")
+	chooseOutputBtn.ConnectClicked(a.showBatchOutputChooser)
+	clearOutputBtn := gtk.NewButtonWithLabel("Use Source Folders")
+	clearOutputBtn.ConnectClicked(func() {
+		a.setBatchOutputDir("")
+	})
+	outputRow := newRow("Output Folder:")
+	outputRow.Append(bv.outputLabel)
+	outputRow.Append(chooseOutputBtn)
+	outputRow.Append(clearOutputBtn)
+	a.setBatchOutputDir("")
+
+	// Naming template of the upscaled files
+	bv.templateEntry = gtk.NewEntry()
+	bv.templateEntry.SetText(upscaler.DefaultNameTemplate)
+	bv.templateEntry.SetHExpand(true)
+	bv.templateEntry.SetTooltipText("{name} is the source file name without extension, {type} the upscale type, {scale} the scale factor and {ext} the extension of the upscaled image")
+	newRow("File Names:").Append(bv.templateEntry)
+
+	// Jobs upscaled at the same time
+	bv.concurrencySpin = gtk.NewSpinButtonWithRange(1, maxBatchConcurrency, 1)
+	bv.concurrencySpin.SetValue(upscaler.DefaultBatchConcurrency)
+	newRow("Parallel Jobs:").Append(bv.concurrencySpin)
+
+	// Show the options that apply to the selected upscale type
+	updateOptions := func() {
+		upscaleType := upscaler.UpscaleType(a.config.GetSupportedUpscaleTypes()[bv.typeCombo.Selected()])
+		bv.promptEntry.SetSensitive(upscaleType == upscaler.UpscaleConservative || upscaleType == upscaler.UpscaleCreative)
+		bv.scaleBox.SetVisible(upscaleType.IsLocal())
+	}
+	updateOptions()
+	bv.typeCombo.NotifyProperty("selected", updateOptions)
+
+	optionsFrame.SetChild(optionsBox)
+	return optionsFrame
+}
+
+// createBatchList builds the list of batch jobs with their status
+func (a *App) createBatchList() *gtk.Frame {
+	bv := a.batch
+	bv.rows = make(map[int]*batchRow)
+
+	listFrame := gtk.NewFrame("Batch")
+	listBox := gtk.NewBox(gtk.OrientationVertical, 8)
+	listBox.SetMarginTop(8)
+	listBox.SetMarginBottom(8)
+	listBox.SetMarginStart(8)
+	listBox.SetMarginEnd(8)
+
+	// Summary and controls
+	headerBox := gtk.NewBox(gtk.OrientationHorizontal, 8)
+	bv.summary = gtk.NewLabel("")
+	bv.summary.SetXAlign(0)
+	bv.summary.SetHExpand(true)
+
+	bv.runBtn = gtk.NewButtonWithLabel("Resume")
+	bv.runBtn.ConnectClicked(func() {
+		if bv.cancel != nil {
+			bv.cancel()
+			return
+		}
+		a.startBatch()
+	})
+
+	clearBtn := gtk.NewButtonWithLabel("Clear Finished")
+	clearBtn.ConnectClicked(a.clearFinishedBatchJobs)
+
+	headerBox.Append(bv.summary)
+	headerBox.Append(bv.runBtn)
+	headerBox.Append(clearBtn)
+	listBox.Append(headerBox)
+
+	// Jobs
+	bv.list = gtk.NewListBox()
+	bv.list.SetSelectionMode(gtk.SelectionNone)
+	bv.list.SetPlaceholder(gtk.NewLabel("Select several images or a folder to upscale them in a batch"))
+
+	scrollWin := gtk.NewScrolledWindow()
+	scrollWin.SetChild(bv.list)
+	scrollWin.SetVExpand(true)
+	scrollWin.SetMinContentHeight(160)
+	listBox.Append(scrollWin)
+
+	// Show the jobs left over from the last session; they wait for Resume
+	for _, job := range bv.queue.Jobs() {
+		a.addBatchRow(job)
+	}
+	a.updateBatchSummary()
+
+	listFrame.SetChild(listBox)
+	return listFrame
+}
+
+// batchSettings reads the options for newly queued jobs
+func (a *App) batchSettings() upscaler.JobSettings {
+	bv := a.batch
+	return upscaler.JobSettings{
+		Type:         upscaler.UpscaleType(a.config.GetSupportedUpscaleTypes()[bv.typeCombo.Selected()]),
+		Prompt:       bv.promptEntry.Text(),
+		OutputFormat: batchFormats[bv.formatCombo.Selected()],
+		Scale:        batchScales[bv.scaleCombo.Selected()],
+		OutputDir:    bv.outputDir,
+		NameTemplate: strings.TrimSpace(bv.templateEntry.Text()),
+	}
+}
+
+// queueBatch adds the images to the batch with the current options and
+// starts it
+func (a *App) queueBatch(paths []string) {
+	bv := a.batch
+
+	var images []string
+	for _, path := range paths {
+		if isImageFile(path) {
+			images = append(images, path)
+		}
+	}
+	if len(images) == 0 {
+		a.setStatus("No supported images to upscale (PNG, JPEG or WebP)")
+		return
+	}
+
+	settings := a.batchSettings()
+	if (settings.Type == upscaler.UpscaleConservative || settings.Type == upscaler.UpscaleCreative) && settings.Prompt == "" {
+		a.setStatus(fmt.Sprintf("A prompt is required for %s upscaling", settings.Type))
+		return
+	}
+
+	jobs, err := bv.queue.Add(images, settings)
+	if err != nil && jobs == nil {
+		a.setStatus(fmt.Sprintf("Error queueing images: %v", err))
+		return
+	}
+	if err != nil {
+		// Queued, but will not survive a restart
+		a.showError("Error saving upscale batch", err)
+	}
+
+	for _, job := range jobs {
+		a.addBatchRow(job)
+	}
+	a.setStatus(fmt.Sprintf("Queued %d images for upscaling", len(jobs)))
+	a.startBatch()
+}
+
+// startBatch runs the queued jobs unless the batch is already running
+func (a *App) startBatch() {
+	bv := a.batch
+	if bv.cancel != nil || bv.queue.Pending() == 0 {
+		a.updateBatchSummary()
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bv.cancel = cancel
+	a.updateBatchSummary()
+
+	concurrency := bv.concurrencySpin.ValueAsInt()
+	go func() {
+		bv.queue.Run(ctx, concurrency, a.upscalerFor, func(job upscaler.BatchJob, p upscaler.Progress) {
+			glib.IdleAdd(func() {
+				a.updateBatchRow(job, p)
+			})
+		})
+		glib.IdleAdd(func() {
+			cancel()
+			bv.cancel = nil
+			switch {
+			case ctx.Err() != nil:
+				a.updateBatchSummary()
+				a.setStatus("Batch stopped. Click Resume to continue")
+			case bv.queue.Pending() > 0:
+				// Jobs queued or retried after the run picked its work
+				// are started with a new run
+				a.startBatch()
+			default:
+				a.updateBatchSummary()
+				a.setStatus("Batch finished")
+			}
+		})
+	}()
+}
+
+// addBatchRow adds a job to the list
+func (a *App) addBatchRow(job upscaler.BatchJob) {
+	bv := a.batch
+
+	row := &batchRow{box: gtk.NewBox(gtk.OrientationHorizontal, 8)}
+	row.box.SetMarginTop(4)
+	row.box.SetMarginBottom(4)
+	row.box.SetMarginStart(4)
+	row.box.SetMarginEnd(4)
+
+	nameLabel := gtk.NewLabel(filepath.Base(job.Source))
+	nameLabel.SetXAlign(0)
+	nameLabel.SetWidthChars(24)
+	nameLabel.SetMaxWidthChars(24)
+	nameLabel.SetEllipsize(pango.EllipsizeMiddle)
+	nameLabel.SetTooltipText(job.Source)
+
+	typeLabel := gtk.NewLabel(string(job.Settings.Type))
+	typeLabel.SetWidthChars(12)
+
+	row.progress = gtk.NewProgressBar()
+	row.progress.SetVAlign(gtk.AlignCenter)
+	row.progress.SetSizeRequest(120, -1)
+
+	row.status = gtk.NewLabel("")
+	row.status.SetXAlign(0)
+	row.status.SetHExpand(true)
+	row.status.SetEllipsize(pango.EllipsizeEnd)
+
+	row.retryBtn = gtk.NewButtonWithLabel("Retry")
+	row.retryBtn.ConnectClicked(func() {
+		if err := bv.queue.Retry(job.ID); err != nil {
+			a.setStatus(fmt.Sprintf("Error retrying upscale: %v", err))
+			return
+		}
+		job.Status, job.Error = upscaler.JobQueued, ""
+		a.updateBatchRow(job, upscaler.Progress{})
+		a.startBatch()
+	})
+
+	row.box.Append(nameLabel)
+	row.box.Append(typeLabel)
+	row.box.Append(row.progress)
+	row.box.Append(row.status)
+	row.box.Append(row.retryBtn)
+
+	bv.list.Append(row.box)
+	bv.rows[job.ID] = row
+	a.updateBatchRow(job, upscaler.Progress{})
+}
+
+// updateBatchRow shows a change of a job's status, or its progress while it
+// runs
+func (a *App) updateBatchRow(job upscaler.BatchJob, p upscaler.Progress) {
+	row, ok := a.batch.rows[job.ID]
+	if !ok {
+		return
+	}
+
+	// Progress of a running job
+	if p.Phase != "" {
+		row.status.SetText(describeUpscaleProgress(p))
+		if p.Total > 0 {
+			row.progress.SetFraction(float64(p.Bytes) / float64(p.Total))
+		} else {
+			row.progress.Pulse()
+		}
+		return
+	}
+
+	row.retryBtn.SetVisible(job.Status == upscaler.JobFailed)
+	row.status.SetTooltipText("")
+	switch job.Status {
+	case upscaler.JobQueued:
+		row.status.SetText("Queued")
+		row.progress.SetFraction(0)
+	case upscaler.JobRunning:
+		row.status.SetText("Starting...")
+		row.progress.SetFraction(0)
+	case upscaler.JobDone:
+		row.status.SetText("Saved to " + job.Output)
+		row.status.SetTooltipText(job.Output)
+		row.progress.SetFraction(1)
+	case upscaler.JobFailed:
+		row.status.SetText("Failed: " + job.Error)
+		row.status.SetTooltipText(job.Error)
+		row.progress.SetFraction(0)
+	}
+	a.updateBatchSummary()
+}
+
+// updateBatchSummary counts the jobs by status and updates the run button
+func (a *App) updateBatchSummary() {
+	bv := a.batch
+	if bv.summary == nil {
+		return
+	}
+
+	counts := make(map[upscaler.JobStatus]int)
+	for _, job := range bv.queue.Jobs() {
+		counts[job.Status]++
+	}
+
+	var parts []string
+	for _, status := range []upscaler.JobStatus{upscaler.JobRunning, upscaler.JobQueued, upscaler.JobDone, upscaler.JobFailed} {
+		if counts[status] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[status], status))
+		}
+	}
+	if len(parts) == 0 {
+		bv.summary.SetText("No batch jobs")
+	} else {
+		bv.summary.SetText(strings.Join(parts, ", "))
+	}
+
+	if bv.cancel != nil {
+		bv.runBtn.SetLabel("Stop")
+		bv.runBtn.SetSensitive(true)
+	} else {
+		bv.runBtn.SetLabel("Resume")
+		bv.runBtn.SetSensitive(counts[upscaler.JobQueued] > 0)
+	}
+}
+
+// clearFinishedBatchJobs removes the finished jobs from the batch and list
+func (a *App) clearFinishedBatchJobs() {
+	bv := a.batch
+	if err := bv.queue.ClearFinished(); err != nil {
+		a.showError("Error saving upscale batch", err)
+	}
+
+	remaining := make(map[int]bool)
+	for _, job := range bv.queue.Jobs() {
+		remaining[job.ID] = true
+	}
+	for id, row := range bv.rows {
+		if !remaining[id] {
+			bv.list.Remove(row.box)
+			delete(bv.rows, id)
+		}
+	}
+	a.updateBatchSummary()
+}
+
+// setBatchOutputDir sets the output folder of newly queued jobs; empty
+// writes next to each source image
+func (a *App) setBatchOutputDir(dir string) {
+	a.batch.outputDir = dir
+	if dir == "" {
+		a.batch.outputLabel.SetText("Next to each source image")
+	} else {
+		a.batch.outputLabel.SetText(dir)
+	}
+	a.batch.outputLabel.SetTooltipText(dir)
+}
+
+// showBatchOutputChooser picks the output folder of batch jobs
+func (a *App) showBatchOutputChooser() {
+	a.showFolderChooser("Select Output Folder", a.setBatchOutputDir)
+}
+
+// showFolderChooserForUpscale picks a folder whose images are queued for
+// batch upscaling
+func (a *App) showFolderChooserForUpscale() {
+	a.showFolderChooser("Select Folder to Upscale", func(dir string) {
+		paths, err := filesInFolder(dir)
+		if err != nil {
+			a.setStatus(fmt.Sprintf("Error reading folder: %v", err))
+			return
+		}
+		a.queueBatch(paths)
+	})
+}
+
+// filesInFolder lists the regular files directly inside dir, sorted by name
+func filesInFolder(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			paths = append(paths, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return paths, nil
+}
+
+// showFolderChooser shows a folder chooser and passes the chosen folder to
+// onChosen
+func (a *App) showFolderChooser(title string, onChosen func(dir string)) {
+	dialog := gtk.NewFileChooserNative(
+		title,
+		&a.win.Window,
+		gtk.FileChooserActionSelectFolder,
+		"_Select",
+		"_Cancel",
+	)
+
+	dialog.ConnectResponse(func(response int) {
+		if response == int(gtk.ResponseAccept) {
+			if file := dialog.File(); file != nil {
+				onChosen(file.Path())
+			}
+		}
+		dialog.Destroy()
+	})
+
+	dialog.Show()
+}
+
+// chosenPaths returns the paths of the files picked in a chooser that
+// allows several
+func chosenPaths(dialog *gtk.FileChooserNative) []string {
+	files := dialog.Files()
+	paths := make([]string, 0, files.NItems())
+	for i := uint(0); i < files.NItems(); i++ {
+		file := &gio.File{Object: files.Item(i)}
+		if path := file.Path(); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,138 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"fluxxxer/internal/flux"
+
+	"github.com/diamondburned/gotk4/pkg/gtk/v4"
+)
+
+// maxMetadataChars limits how much provider metadata the details popover shows
+const maxMetadataChars = 4000
+
+// createDetailsButton builds a button that pops up how the image was made
+func (a *App) createDetailsButton(img flux.Image) *gtk.MenuButton {
+	grid := gtk.NewGrid()
+	grid.SetRowSpacing(4)
+	grid.SetColumnSpacing(12)
+
+	row := 0
+	for _, detail := range imageDetails(img) {
+		nameLabel := gtk.NewLabel(detail[0] + ":")
+		nameLabel.SetXAlign(1)
+		nameLabel.SetVAlign(gtk.AlignStart)
+		nameLabel.AddCSSClass("dim-label")
+
+		valueLabel := gtk.NewLabel(detail[1])
+		valueLabel.SetXAlign(0)
+		valueLabel.SetWrap(true)
+		valueLabel.SetMaxWidthChars(60)
+		valueLabel.SetSelectable(true)
+
+		grid.Attach(nameLabel, 0, row, 1, 1)
+		grid.Attach(valueLabel, 1, row, 1, 1)
+		row++
+	}
+
+	box := gtk.NewBox(gtk.OrientationVertical, 8)
+	box.SetMarginTop(8)
+	box.SetMarginBottom(8)
+	box.SetMarginStart(8)
+	box.SetMarginEnd(8)
+	box.Append(grid)
+
+	// Raw provider response, for anything not shown above
+	if len(img.Metadata) > 0 {
+		metadataLabel := gtk.NewLabel(formatMetadata(img.Metadata))
+		metadataLabel.SetXAlign(0)
+		metadataLabel.SetYAlign(0)
+		metadataLabel.SetSelectable(true)
+		metadataLabel.AddCSSClass("monospace")
+
+		scrollWin := gtk.NewScrolledWindow()
+		scrollWin.SetMinContentHeight(160)
+		scrollWin.SetMinContentWidth(400)
+		scrollWin.SetChild(metadataLabel)
+
+		expander := gtk.NewExpander("Provider response")
+		expander.SetChild(scrollWin)
+		box.Append(expander)
+	}
+
+	popover := gtk.NewPopover()
+	popover.SetChild(box)
+
+	button := gtk.NewMenuButton()
+	button.SetLabel("Details")
+	button.SetPopover(popover)
+
+	return button
+}
+
+// imageDetails lists the known details of the image as name and value pairs
+func imageDetails(img flux.Image) [][2]string {
+	opts := img.Options
+	details := [][2]string{{"Prompt", img.Prompt}}
+
+	add := func(name, value string) {
+		if value != "" {
+			details = append(details, [2]string{name, value})
+		}
+	}
+
+	if img.Seed != nil {
+		add("Seed", strconv.Itoa(*img.Seed))
+	} else {
+		add("Seed", "unknown")
+	}
+	add("Model", opts.Model)
+	if opts.Width > 0 && opts.Height > 0 {
+		add("Size", fmt.Sprintf("%d x %d", opts.Width, opts.Height))
+	} else {
+		add("Aspect ratio", opts.AspectRatio)
+	}
+	if opts.NumInferenceSteps != nil {
+		add("Steps", strconv.Itoa(*opts.NumInferenceSteps))
+	}
+	if opts.Guidance != nil {
+		add("Guidance", strconv.FormatFloat(*opts.Guidance, 'f', -1, 64))
+	}
+	if opts.GoFast != nil {
+		add("Go fast", strconv.FormatBool(*opts.GoFast))
+	}
+	add("Megapixels", opts.Megapixels)
+	add("Negative prompt", opts.NegativePrompt)
+	for i, l := range opts.LoRAs {
+		add(fmt.Sprintf("LoRA %d", i+1), fmt.Sprintf("%s (%.2f)", l.Weights, l.Scale))
+	}
+	if opts.Image != "" && opts.PromptStrength != nil {
+		add("Prompt strength", strconv.FormatFloat(*opts.PromptStrength, 'f', -1, 64))
+	}
+	add("Format", opts.OutputFormat)
+	add("Request ID", img.RequestID)
+	if img.Latency > 0 {
+		add("Latency", img.Latency.Round(100*time.Millisecond).String())
+	}
+
+	return details
+}
+
+// formatMetadata indents the metadata JSON and shortens it for display
+func formatMetadata(metadata json.RawMessage) string {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, metadata, "", "  "); err != nil {
+		return string(metadata)
+	}
+
+	text := buf.String()
+	if len(text) > maxMetadataChars {
+		text = strings.ToValidUTF8(text[:maxMetadataChars], "") + "\n..."
+	}
+	return text
+}
@@ -0,0 +1,290 @@
+package app
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	coreglib "github.com/diamondburned/gotk4/pkg/core/glib"
+	"github.com/diamondburned/gotk4/pkg/gdk/v4"
+	"github.com/diamondburned/gotk4/pkg/gio/v2"
+	"github.com/diamondburned/gotk4/pkg/gtk/v4"
+)
+
+// dropHighlightClass marks a view while something is dragged over it
+const dropHighlightClass = "drop-highlight"
+
+// dropHighlightCSS styles dropHighlightClass
+const dropHighlightCSS = `
+.drop-highlight {
+	background-color: alpha(@accent_bg_color, 0.1);
+	outline: 2px dashed @accent_bg_color;
+	outline-offset: -6px;
+}
+`
+
+// sniffedImageTypes are the detected content types of supported images
+var sniffedImageTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/webp": true,
+}
+
+// loadDropStyle installs the drop highlight style for the default display
+func (a *App) loadDropStyle() {
+	provider := gtk.NewCSSProvider()
+	provider.LoadFromData(dropHighlightCSS)
+	gtk.StyleContextAddProviderForDisplay(gdk.DisplayGetDefault(), provider, gtk.STYLE_PROVIDER_PRIORITY_APPLICATION)
+}
+
+// addDropTarget accepts drops of the given types on widget, highlighting it
+// while a drag hovers over it, and passes dropped values to onDrop. When a
+// drag offers several types the first in types is used.
+func addDropTarget(widget gtk.Widgetter, types []coreglib.Type, onDrop func(value *coreglib.Value) bool) {
+	base := gtk.BaseWidget(widget)
+
+	target := gtk.NewDropTarget(coreglib.TypeInvalid, gdk.ActionCopy)
+	target.SetGTypes(types)
+	target.ConnectEnter(func(x, y float64) gdk.DragAction {
+		base.AddCSSClass(dropHighlightClass)
+		return gdk.ActionCopy
+	})
+	target.ConnectLeave(func() {
+		base.RemoveCSSClass(dropHighlightClass)
+	})
+	target.ConnectDrop(func(value *coreglib.Value, x, y float64) bool {
+		base.RemoveCSSClass(dropHighlightClass)
+		return onDrop(value)
+	})
+
+	base.AddController(target)
+}
+
+// setupFileDrop lets image files, folders and images dragged from other
+// apps be dropped on the upscaler view. One image opens the upscale dialog,
+// several are queued as a batch.
+func (a *App) setupFileDrop(widget *gtk.Box) {
+	types := []coreglib.Type{gdk.GTypeFileList, gio.GTypeFile, gdk.GTypeTexture}
+	addDropTarget(widget, types, func(value *coreglib.Value) bool {
+		if value.Type() == gdk.GTypeTexture {
+			data, err := droppedTexture(value)
+			if err != nil {
+				a.setStatus(fmt.Sprintf("Error reading dropped image: %v", err))
+				return false
+			}
+			a.handleUpscaleData(data, "dropped.png")
+			return true
+		}
+
+		files := droppedFiles(value)
+		if len(files) == 0 {
+			a.setStatus("Only local files can be dropped to upscale")
+			return false
+		}
+		return a.upscaleDropped(files)
+	})
+}
+
+// upscaleDropped checks dropped files, expanding folders to the files in
+// them, and upscales the images among them
+func (a *App) upscaleDropped(files []*gio.File) bool {
+	var (
+		images   []string
+		rejected []string
+		folder   bool
+	)
+
+	for _, file := range files {
+		path := file.Path()
+		if path == "" {
+			rejected = append(rejected, file.URI())
+			continue
+		}
+
+		candidates := []string{path}
+		inFolder := false
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			folder, inFolder = true, true
+			if candidates, err = filesInFolder(path); err != nil {
+				a.setStatus(fmt.Sprintf("Error reading folder: %v", err))
+				return false
+			}
+		}
+
+		for _, candidate := range candidates {
+			// Other files in a folder are skipped quietly
+			if inFolder && !isImageFile(candidate) {
+				continue
+			}
+			if err := checkImageFile(candidate); err != nil {
+				rejected = append(rejected, filepath.Base(candidate))
+				continue
+			}
+			images = append(images, candidate)
+		}
+	}
+
+	switch {
+	case len(images) == 0 && len(rejected) == 0:
+		a.setStatus("No images to upscale in the dropped folder")
+		return false
+	case len(images) == 0:
+		a.setStatus(fmt.Sprintf("Not a supported image (PNG, JPEG or WebP): %s", strings.Join(rejected, ", ")))
+		return false
+	case len(images) == 1 && !folder:
+		a.handleUpscaleFile(images[0])
+	default:
+		a.queueBatch(images)
+	}
+
+	if len(rejected) > 0 {
+		a.setStatus(fmt.Sprintf("Skipped %d files that are not PNG, JPEG or WebP images: %s",
+			len(rejected), strings.Join(rejected, ", ")))
+	}
+	return true
+}
+
+// setupInputDrop lets an image, an image file or a link to an image be
+// dropped on the generator view as the image-to-image input
+func (a *App) setupInputDrop(widget gtk.Widgetter) {
+	types := []coreglib.Type{gdk.GTypeFileList, gio.GTypeFile, gdk.GTypeTexture, coreglib.TypeString}
+	addDropTarget(widget, types, func(value *coreglib.Value) bool {
+		var (
+			ref string
+			err error
+		)
+
+		switch value.Type() {
+		case gdk.GTypeTexture:
+			var data []byte
+			if data, err = droppedTexture(value); err == nil {
+				ref = "data:image/png;base64," + base64.StdEncoding.EncodeToString(data)
+			}
+		case coreglib.TypeString:
+			text, _ := value.GoValue().(string)
+			ref, err = inputFromText(text)
+		default:
+			files := droppedFiles(value)
+			if len(files) == 0 {
+				err = errors.New("nothing to use was dropped")
+			} else {
+				ref, err = inputFromFile(files[0])
+			}
+		}
+
+		if err != nil {
+			a.setStatus(fmt.Sprintf("Cannot use the dropped item as input: %v", err))
+			return false
+		}
+		a.setInitImage(ref)
+		return true
+	})
+}
+
+// inputFromFile returns the input reference of a dropped file: its path
+// when it is local, its URL when it is on the web
+func inputFromFile(file *gio.File) (string, error) {
+	if path := file.Path(); path != "" {
+		if err := checkImageFile(path); err != nil {
+			return "", err
+		}
+		return path, nil
+	}
+	return inputFromText(file.URI())
+}
+
+// inputFromText returns the input reference of dropped text, which may be
+// a link, a data URL, a file URI or a path. Only the first entry of a URI
+// list is used.
+func inputFromText(text string) (string, error) {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "data:image/") {
+			return line, nil
+		}
+		if strings.HasPrefix(line, "file://") {
+			line = gio.NewFileForURI(line).Path()
+		}
+		if filepath.IsAbs(line) {
+			if err := checkImageFile(line); err != nil {
+				return "", err
+			}
+			return line, nil
+		}
+
+		u, err := url.Parse(line)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", fmt.Errorf("%q is not an image link or file", line)
+		}
+		return line, nil
+	}
+	return "", errors.New("the dropped text is empty")
+}
+
+// droppedFiles returns the files of a dropped file list or file
+func droppedFiles(value *coreglib.Value) []*gio.File {
+	switch value.Type() {
+	case gdk.GTypeFileList:
+		if list, ok := value.GoValue().(*gdk.FileList); ok {
+			return list.Files()
+		}
+	case gio.GTypeFile:
+		if obj := value.Object(); obj != nil {
+			return []*gio.File{{Object: obj}}
+		}
+	}
+	return nil
+}
+
+// droppedTexture encodes a dropped image as PNG in memory, so no temporary
+// file is left behind
+func droppedTexture(value *coreglib.Value) ([]byte, error) {
+	obj := value.Object()
+	if obj == nil {
+		return nil, errors.New("no image was dropped")
+	}
+	texturer, ok := obj.Cast().(gdk.Texturer)
+	if !ok {
+		return nil, errors.New("no image was dropped")
+	}
+
+	png := gdk.BaseTexture(texturer).SaveToPNGBytes()
+	if png == nil || png.Size() == 0 {
+		return nil, errors.New("failed to encode dropped image")
+	}
+	return png.Data(), nil
+}
+
+// checkImageFile checks that path has a supported image extension and that
+// its content is a PNG, JPEG or WebP image
+func checkImageFile(path string) error {
+	if !isImageFile(path) {
+		return fmt.Errorf("%s is not a PNG, JPEG or WebP image", filepath.Base(path))
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open image: %w", err)
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to read image: %w", err)
+	}
+	if !sniffedImageTypes[http.DetectContentType(head[:n])] {
+		return fmt.Errorf("%s is not a PNG, JPEG or WebP image", filepath.Base(path))
+	}
+	return nil
+}
@@ -1,10 +1,14 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
+	"log/slog"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -24,25 +28,19 @@ func (a *App) onGenerateClicked() {
 		return
 	}
 
-	a.spinner.Start()
-	a.clearImages()
-	a.setStatus("Generating images...")
+	if a.clientErr != nil {
+		a.setStatus(fmt.Sprintf("Error: %v", a.clientErr))
+		return
+	}
 
-	// Find aspect ratio dropdown and number of images slider
-	aspectCombo := a.findAspectRatioCombo()
+	// Find number of images slider
 	numOutputsScale := a.findNumOutputsScale()
 	
 	// Get the selected options
-	var aspectRatio string
-	if aspectCombo != nil {
-		selectedIdx := aspectCombo.Selected()
-		if selectedIdx < uint(len(a.config.GetSupportedAspectRatios())) {
-			aspectRatio = a.config.GetSupportedAspectRatios()[selectedIdx]
-		} else {
-			aspectRatio = a.config.GetDefaultAspectRatio()
-		}
-	} else {
-		aspectRatio = a.config.GetDefaultAspectRatio()
+	aspectRatio, width, height := a.selectedSize()
+	if aspectRatio == "" {
+		a.setStatus("Enter a custom aspect ratio as W:H, e.g. 7:5")
+		return
 	}
 	
 	numOutputs := a.config.GetDefaultNumOutputs()
@@ -50,19 +48,82 @@ func (a *App) onGenerateClicked() {
 		numOutputs = int(numOutputsScale.Adjustment().Value())
 	}
 
+	opts := flux.GenerateOptions{
+		NumOutputs:   numOutputs,
+		AspectRatio:  aspectRatio,
+		Width:        width,
+		Height:       height,
+		OutputFormat: a.config.GetDefaultFormat(),
+		Quality:      a.config.GetDefaultQuality(),
+	}
+	if a.initImage != "" {
+		strength := a.strengthScale.Value()
+		opts.Image = a.initImage
+		opts.PromptStrength = &strength
+		opts.Mask = a.maskImage
+	}
+	a.advanced.apply(&opts)
+
+	// Reject out-of-range parameters before clearing the current results
+	if err := opts.Validate(); err != nil {
+		a.setStatus(fmt.Sprintf("Error: %v", err))
+		return
+	}
+
+	// Abort any generation that is still running
+	if a.cancelGenerate != nil {
+		a.cancelGenerate()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.config.GetRequestTimeout())
+	a.cancelGenerate = cancel
+	a.generationID++
+	generationID := a.generationID
+
+	a.spinner.Start()
+	a.cancelBtn.SetSensitive(true)
+	a.clearImages()
+	a.setStatus("Generating images...")
+
 	// Generate images with the selected options
 	go func() {
-		images, err := a.client.GenerateImagesWithOptions(prompt, flux.GenerateOptions{
-			NumOutputs:   numOutputs,
-			AspectRatio:  aspectRatio,
-			OutputFormat: a.config.GetDefaultFormat(),
-			Quality:      a.config.GetDefaultQuality(),
-		})
+		defer cancel()
+
+		opts.OnProgress = func(p *flux.Prediction) {
+			status := fmt.Sprintf("Prediction %s: %s", p.ID, p.Status)
+			if line := p.LastLogLine(); line != "" {
+				status += " - " + line
+			}
+			glib.IdleAdd(func() {
+				if generationID == a.generationID {
+					a.setStatus(status)
+				}
+			})
+		}
+
+		images, err := a.client.GenerateImagesContext(ctx, prompt, opts)
+		if err == nil && len(images) > 0 {
+			slog.Info("Generated images", "count", len(images), "request_id", images[0].RequestID, "latency", images[0].Latency)
+		}
 		
 		glib.IdleAdd(func() {
+			// A newer generation has replaced this one
+			if generationID != a.generationID {
+				return
+			}
+			a.cancelGenerate = nil
+			a.cancelBtn.SetSensitive(false)
 			a.spinner.Stop()
+			if errors.Is(err, context.Canceled) {
+				a.setStatus("Generation cancelled")
+				return
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				a.setStatus(fmt.Sprintf("Generation timed out after %v", a.config.GetRequestTimeout()))
+				return
+			}
 			if err != nil {
-				a.setStatus(fmt.Sprintf("Error: %v", err))
+				a.showError("Error", err)
 				return
 			}
 			a.displayImages(images)
@@ -71,6 +132,76 @@ func (a *App) onGenerateClicked() {
 	}()
 }
 
+// onCancelClicked aborts the in-flight generation request
+func (a *App) onCancelClicked() {
+	if a.cancelGenerate == nil {
+		return
+	}
+	a.cancelGenerate()
+	a.setStatus("Cancelling generation...")
+}
+
+// setInitImage sets or clears the input image used for image-to-image
+// generation. ref may be a URL or a local file path.
+func (a *App) setInitImage(ref string) {
+	// A mask only applies to the image it was painted on
+	a.setMaskImage("")
+
+	a.initImage = ref
+	a.clearInputBtn.SetSensitive(ref != "")
+	a.strengthScale.SetSensitive(ref != "")
+
+	switch {
+	case ref == "":
+		a.initImageLabel.SetText("None")
+		a.initImageLabel.SetTooltipText("")
+	case strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://"):
+		a.initImageLabel.SetText("Generated image")
+		a.initImageLabel.SetTooltipText(ref)
+		a.setStatus("Using generated image as input")
+	case strings.HasPrefix(ref, "data:"):
+		a.initImageLabel.SetText("Generated image")
+		a.initImageLabel.SetTooltipText("")
+		a.setStatus("Using generated image as input")
+	default:
+		a.initImageLabel.SetText(filepath.Base(ref))
+		a.initImageLabel.SetTooltipText(ref)
+		a.setStatus(fmt.Sprintf("Using %s as input", filepath.Base(ref)))
+	}
+}
+
+// setMaskImage sets or clears the inpainting mask for the current input
+// image. Masks are temporary files owned by the app.
+func (a *App) setMaskImage(path string) {
+	if a.maskImage != path {
+		a.removeMaskFile()
+	}
+	a.maskImage = path
+
+	if path == "" {
+		a.initImageLabel.SetText(strings.TrimSuffix(a.initImageLabel.Text(), " (masked)"))
+		return
+	}
+	a.initImageLabel.SetText(a.initImageLabel.Text() + " (masked)")
+	a.setStatus("Mask ready. Describe what to paint in the masked area and click Generate.")
+}
+
+// removeMaskFile deletes the current mask file and forgets it
+func (a *App) removeMaskFile() {
+	removeTempFile(a.maskImage)
+	a.maskImage = ""
+}
+
+// removeTempFile deletes a temporary file the app created, if any
+func removeTempFile(path string) {
+	if path == "" {
+		return
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("Failed to remove temporary file", "path", path, "error", err)
+	}
+}
+
 // Store references to our UI controls for easy access
 var (
 	aspectRatioCombo *gtk.DropDown
@@ -88,6 +219,34 @@ func (a *App) findAspectRatioCombo() *gtk.DropDown {
 	return nil
 }
 
+// Labels of the custom entries after the configured aspect ratios
+const (
+	customRatioLabel = "Custom ratio"
+	customSizeLabel  = "Custom size"
+)
+
+// selectedSize returns the aspect ratio, or the width and height when a
+// custom size is selected
+func (a *App) selectedSize() (aspectRatio string, width, height int) {
+	aspectCombo := a.findAspectRatioCombo()
+	if aspectCombo == nil {
+		return a.config.GetDefaultAspectRatio(), 0, 0
+	}
+	
+	ratios := a.config.GetSupportedAspectRatios()
+	selectedIdx := aspectCombo.Selected()
+	switch {
+	case selectedIdx < uint(len(ratios)):
+		return ratios[selectedIdx], 0, 0
+	case selectedIdx == uint(len(ratios)):
+		return strings.TrimSpace(a.customRatioEntry.Text()), 0, 0
+	case selectedIdx == uint(len(ratios))+1:
+		return flux.AspectRatioCustom, flux.SnapDimension(a.widthSpin.ValueAsInt()), flux.SnapDimension(a.heightSpin.ValueAsInt())
+	default:
+		return a.config.GetDefaultAspectRatio(), 0, 0
+	}
+}
+
 // findNumOutputsScale finds the number of outputs scale in the UI
 func (a *App) findNumOutputsScale() *gtk.Scale {
 	// Return cached reference if available
@@ -100,7 +259,7 @@ func (a *App) findNumOutputsScale() *gtk.Scale {
 }
 
 // displayImages shows the generated images in the UI
-func (a *App) displayImages(urls []string) {
+func (a *App) displayImages(images []flux.Image) {
 	// Get the available width for the images
 	availableWidth := a.currentWidth
 	if availableWidth == 0 {
@@ -108,7 +267,7 @@ func (a *App) displayImages(urls []string) {
 	}
 	
 	// Calculate optimal image size based on number of images and available space
-	numImages := len(urls)
+	numImages := len(images)
 	if numImages == 0 {
 		return
 	}
@@ -134,7 +293,8 @@ func (a *App) displayImages(urls []string) {
 	a.imageBox.Append(imageGrid)
 	
 	// Display each image
-	for i, url := range urls {
+	for i, img := range images {
+		url := img.URL
 		row := i / imagesPerRow
 		col := i % imagesPerRow
 		
@@ -170,7 +330,7 @@ func (a *App) displayImages(urls []string) {
 		imageGrid.Attach(imageFrame, col, row, 1, 1)
 		
 		// Load the image in the background
-		go func(url string, imageBox *gtk.Box, placeholder *gtk.Spinner) {
+		go func(img flux.Image, url string, imageBox *gtk.Box, placeholder *gtk.Spinner) {
 			texture, err := a.loadImageTexture(url)
 			if err != nil {
 				glib.IdleAdd(func() {
@@ -221,74 +381,97 @@ func (a *App) displayImages(urls []string) {
 				// Upscale button
 				upscaleBtn := gtk.NewButtonWithLabel("Upscale")
 				
-				// Enable upscale button if the upscaler is configured
-				upscaleBtn.SetSensitive(a.isUpscalerConfigured())
+				// Without the service the upscale dialog offers local upscaling
+				if !a.isUpscalerConfigured() {
+					upscaleBtn.SetTooltipText("Local upscaling only. Set UPSCALER_API_URL and UPSCALER_API_KEY in your .env file to use the upscaling service.")
+				}
 				
-				if a.isUpscalerConfigured() {
-					upscaleBtn.ConnectClicked(func() {
-						// Log which image we're trying to upscale
-						fmt.Printf("Attempting to upscale image from URL: %s\n", url)
-						
-						// Create a temporary file to save the image for upscaling
-						tmpFile, err := os.CreateTemp("", "temp-image-*.png")
-						if err != nil {
-							a.setStatus(fmt.Sprintf("Error preparing image for upscaling: %v", err))
-							return
-						}
-						tmpPath := tmpFile.Name()
-						tmpFile.Close()
-						
-						// Download the image to the temp file
-						go func() {
-							err := a.downloadAndSaveImage(url, tmpPath)
+				upscaleBtn.ConnectClicked(func() {
+					// Log which image we're trying to upscale
+					if !strings.HasPrefix(url, "data:") {
+						slog.Debug("Preparing generated image for upscaling", "url", url)
+					}
+					
+					// Read the image into memory, from where it is uploaded
+					go func() {
+						data, err := a.readImage(url)
+						glib.IdleAdd(func() {
 							if err != nil {
-								glib.IdleAdd(func() {
-									a.setStatus(fmt.Sprintf("Error preparing image for upscaling: %v", err))
-								})
-								os.Remove(tmpPath)
+								a.setStatus(fmt.Sprintf("Error preparing image for upscaling: %v", err))
 								return
 							}
-							
-							// Now handle the upscale
-							glib.IdleAdd(func() {
-								a.handleUpscaleFile(tmpPath)
-							})
-						}()
-					})
-				} else {
-					upscaleBtn.SetTooltipText("Upscaler not configured. Set UPSCALER_API_URL and UPSCALER_API_KEY in your .env file.")
-				}
+							a.handleUpscaleData(data, imageName(url))
+						})
+					}()
+				})
+				
+				// Use as input button for image-to-image
+				useInputBtn := gtk.NewButtonWithLabel("Use as input")
+				useInputBtn.ConnectClicked(func() {
+					a.setInitImage(url)
+				})
+				
+				// Inpaint button opens the mask editor
+				inpaintBtn := gtk.NewButtonWithLabel("Inpaint")
+				inpaintBtn.ConnectClicked(func() {
+					a.showMaskEditor(url, texture)
+				})
 				
 				// Add buttons to container
 				buttonBox.Append(saveBtn)
 				buttonBox.Append(copyBtn)
 				buttonBox.Append(upscaleBtn)
+				buttonBox.Append(useInputBtn)
+				buttonBox.Append(inpaintBtn)
+				buttonBox.Append(a.createDetailsButton(img))
 				
 				// Add widgets to the image box
 				imageBox.Append(picture)
 				imageBox.Append(buttonBox)
 			})
-		}(url, imageBox, placeholder)
+		}(img, url, imageBox, placeholder)
 	}
 }
 
+// loadImageTexture loads a generated image from a URL, data URI or local file
 func (a *App) loadImageTexture(url string) (*gdk.Texture, error) {
-	resp, err := http.Get(url)
+	data, err := a.readImage(url)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-
-	data, err := io.ReadAll(resp.Body)
+	texture, err := gdk.NewTextureFromBytes(glib.NewBytesWithGo(data))
 	if err != nil {
 		return nil, err
 	}
-	texture, err := gdk.NewTextureFromBytes(glib.NewBytesWithGo(data))
+
+	return texture, nil
+}
+
+// readImage reads a generated image from a URL, data URI or local file
+func (a *App) readImage(url string) ([]byte, error) {
+	reader, err := flux.OpenImage(context.Background(), a.httpClient, url)
 	if err != nil {
 		return nil, err
 	}
+	defer reader.Close()
 
-	return texture, nil
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image: %w", err)
+	}
+	return data, nil
+}
+
+// imageName returns the file name of an image reference, or image.png when
+// it has none
+func imageName(ref string) string {
+	if strings.HasPrefix(ref, "data:") {
+		return "image.png"
+	}
+	if u, err := url.Parse(ref); err == nil && isImageFile(u.Path) {
+		return path.Base(u.Path)
+	}
+	return "image.png"
 }
 
 func (a *App) saveImage(url string) {
@@ -300,8 +483,9 @@ func (a *App) saveImage(url string) {
 		"_Cancel",
 	)
 
+	// Inline images have no file name to offer
 	defaultName := filepath.Base(url)
-	if defaultName == "" || defaultName == "." {
+	if strings.HasPrefix(url, "data:") || defaultName == "" || defaultName == "." {
 		defaultName = "generated_image.png"
 	}
 	dialog.SetCurrentName(defaultName)
@@ -365,15 +549,11 @@ func (a *App) downloadAndSaveImage(url, destPath string) error {
 		return fmt.Errorf("failed to create directory: %w", err)
 	}
 
-	resp, err := http.Get(url)
+	reader, err := flux.OpenImage(context.Background(), a.httpClient, url)
 	if err != nil {
-		return fmt.Errorf("failed to download image: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download image: status code %d", resp.StatusCode)
+		return err
 	}
+	defer reader.Close()
 
 	tmpFile, err := os.CreateTemp(filepath.Dir(destPath), "*.png")
 	if err != nil {
@@ -386,7 +566,7 @@ func (a *App) downloadAndSaveImage(url, destPath string) error {
 		os.Remove(tmpPath)
 	}()
 
-	if _, err := io.Copy(tmpFile, resp.Body); err != nil {
+	if _, err := io.Copy(tmpFile, reader); err != nil {
 		return fmt.Errorf("failed to write image data: %w", err)
 	}
 
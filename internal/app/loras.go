@@ -0,0 +1,200 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+
+	"fluxxxer/internal/config"
+	"fluxxxer/internal/flux"
+
+	"github.com/diamondburned/gotk4/pkg/gtk/v4"
+)
+
+// loraRow is one editable entry in the LoRA manager
+type loraRow struct {
+	box     *gtk.Box
+	name    *gtk.Entry
+	weights *gtk.Entry
+	scale   *gtk.SpinButton
+}
+
+// createLoRAToggles builds the row of per-generation LoRA toggles with a
+// button to open the manager
+func (a *App) createLoRAToggles() *gtk.Box {
+	row := gtk.NewBox(gtk.OrientationHorizontal, 8)
+
+	loraLabel := gtk.NewLabel("LoRAs:")
+
+	a.advanced.loraBox = gtk.NewBox(gtk.OrientationHorizontal, 8)
+
+	manageBtn := gtk.NewButtonWithLabel("Manage LoRAs...")
+	manageBtn.SetMarginStart(16)
+	manageBtn.ConnectClicked(a.showLoRAManager)
+
+	row.Append(loraLabel)
+	row.Append(a.advanced.loraBox)
+	row.Append(manageBtn)
+
+	a.refreshLoRAToggles()
+
+	return row
+}
+
+// refreshLoRAToggles rebuilds the toggles from the saved LoRAs, keeping the
+// selection of LoRAs that are still present
+func (a *App) refreshLoRAToggles() {
+	adv := a.advanced
+
+	active := make(map[string]bool)
+	for i, check := range adv.loraChecks {
+		active[adv.loras[i].Name] = check.Active()
+		adv.loraBox.Remove(check)
+	}
+	if adv.emptyLoRALabel != nil {
+		adv.loraBox.Remove(adv.emptyLoRALabel)
+		adv.emptyLoRALabel = nil
+	}
+
+	adv.loras = a.config.GetLoRAs()
+	adv.loraChecks = nil
+
+	if len(adv.loras) == 0 {
+		adv.emptyLoRALabel = gtk.NewLabel("None saved")
+		adv.loraBox.Append(adv.emptyLoRALabel)
+		return
+	}
+
+	for _, l := range adv.loras {
+		check := gtk.NewCheckButtonWithLabel(fmt.Sprintf("%s (%.2f)", l.Name, l.Scale))
+		check.SetTooltipText(l.Weights)
+		check.SetActive(active[l.Name])
+		adv.loraBox.Append(check)
+		adv.loraChecks = append(adv.loraChecks, check)
+	}
+}
+
+// selectedLoRAs returns the LoRAs toggled on for the next generation
+func (adv *advancedOptions) selectedLoRAs() []flux.LoRA {
+	var loras []flux.LoRA
+	for i, check := range adv.loraChecks {
+		if check.Active() {
+			loras = append(loras, flux.LoRA{
+				Weights: adv.loras[i].Weights,
+				Scale:   adv.loras[i].Scale,
+			})
+		}
+	}
+	return loras
+}
+
+// showLoRAManager opens a dialog to add, edit and remove saved LoRAs
+func (a *App) showLoRAManager() {
+	// Create dialog
+	dialog := gtk.NewDialog()
+	dialog.SetTitle("Manage LoRAs")
+	dialog.SetTransientFor(&a.win.Window)
+	dialog.SetModal(true)
+	dialog.SetDefaultSize(700, 400)
+
+	// Get dialog content area
+	contentArea := dialog.ContentArea()
+	contentArea.SetMarginTop(16)
+	contentArea.SetMarginBottom(16)
+	contentArea.SetMarginStart(16)
+	contentArea.SetMarginEnd(16)
+	contentArea.SetSpacing(8)
+
+	hintLabel := gtk.NewLabel("Weights can be a URL or an identifier the backend understands, such as owner/model on Replicate.")
+	hintLabel.SetWrap(true)
+	hintLabel.SetXAlign(0)
+	contentArea.Append(hintLabel)
+
+	// Rows of name, weights and scale
+	listBox := gtk.NewBox(gtk.OrientationVertical, 8)
+	scrollWin := gtk.NewScrolledWindow()
+	scrollWin.SetVExpand(true)
+	scrollWin.SetChild(listBox)
+	contentArea.Append(scrollWin)
+
+	var rows []*loraRow
+	addRow := func(l config.LoRA) {
+		row := &loraRow{
+			box:     gtk.NewBox(gtk.OrientationHorizontal, 8),
+			name:    gtk.NewEntry(),
+			weights: gtk.NewEntry(),
+			scale:   gtk.NewSpinButtonWithRange(-1, 3, 0.05),
+		}
+		row.name.SetPlaceholderText("Name")
+		row.name.SetText(l.Name)
+		row.weights.SetPlaceholderText("Weights URL or identifier")
+		row.weights.SetText(l.Weights)
+		row.weights.SetHExpand(true)
+		row.scale.SetDigits(2)
+		row.scale.SetValue(l.Scale)
+
+		removeBtn := gtk.NewButtonWithLabel("Remove")
+		removeBtn.ConnectClicked(func() {
+			listBox.Remove(row.box)
+			for i, r := range rows {
+				if r == row {
+					rows = append(rows[:i], rows[i+1:]...)
+					break
+				}
+			}
+		})
+
+		row.box.Append(row.name)
+		row.box.Append(row.weights)
+		row.box.Append(row.scale)
+		row.box.Append(removeBtn)
+		listBox.Append(row.box)
+		rows = append(rows, row)
+	}
+
+	for _, l := range a.config.GetLoRAs() {
+		addRow(l)
+	}
+
+	addBtn := gtk.NewButtonWithLabel("Add LoRA")
+	addBtn.SetHAlign(gtk.AlignStart)
+	addBtn.ConnectClicked(func() {
+		addRow(config.LoRA{Scale: 1})
+	})
+	contentArea.Append(addBtn)
+
+	dialog.AddButton("Cancel", int(gtk.ResponseCancel))
+	dialog.AddButton("Save", int(gtk.ResponseAccept))
+
+	dialog.ConnectResponse(func(responseId int) {
+		if responseId != int(gtk.ResponseAccept) {
+			dialog.Destroy()
+			return
+		}
+
+		loras := make([]config.LoRA, 0, len(rows))
+		for _, row := range rows {
+			l := config.LoRA{
+				Name:    strings.TrimSpace(row.name.Text()),
+				Weights: strings.TrimSpace(row.weights.Text()),
+				Scale:   row.scale.Value(),
+			}
+			// Skip rows that were added but never filled in
+			if l.Name == "" && l.Weights == "" {
+				continue
+			}
+			loras = append(loras, l)
+		}
+
+		// Keep the dialog open so the entries are not lost
+		if err := a.config.SetLoRAs(loras); err != nil {
+			a.setStatus(fmt.Sprintf("Error saving LoRAs: %v", err))
+			return
+		}
+
+		dialog.Destroy()
+		a.refreshLoRAToggles()
+		a.setStatus(fmt.Sprintf("Saved %d LoRAs", len(loras)))
+	})
+
+	dialog.Show()
+}
@@ -0,0 +1,267 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+
+	"github.com/diamondburned/gotk4/pkg/cairo"
+	"github.com/diamondburned/gotk4/pkg/gdk/v4"
+	"github.com/diamondburned/gotk4/pkg/gtk/v4"
+)
+
+// maskEditor paints an inpainting mask over a source image. The mask is an
+// A8 surface the size of the source; opaque pixels mark the area to
+// regenerate.
+type maskEditor struct {
+	source *cairo.Surface
+	mask   *cairo.Surface
+	width  int
+	height int
+
+	area      *gtk.DrawingArea
+	brushSize *gtk.SpinButton
+	eraser    *gtk.ToggleButton
+
+	// Last brush position in image coordinates
+	lastX, lastY float64
+}
+
+// newMaskEditor creates an editor for the given texture
+func newMaskEditor(texture *gdk.Texture) (*maskEditor, error) {
+	img, err := png.Decode(bytes.NewReader(texture.SaveToPNGBytes().Data()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	// Normalise to RGBA so cairo gets a tightly packed buffer
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+
+	return &maskEditor{
+		source: cairo.CreateSurfaceFromImage(rgba),
+		mask:   cairo.CreateImageSurface(cairo.FormatA8, bounds.Dx(), bounds.Dy()),
+		width:  bounds.Dx(),
+		height: bounds.Dy(),
+	}, nil
+}
+
+// layout returns the scale and offset that fit the image in the widget
+func (e *maskEditor) layout(widgetWidth, widgetHeight int) (scale, offsetX, offsetY float64) {
+	scale = math.Min(float64(widgetWidth)/float64(e.width), float64(widgetHeight)/float64(e.height))
+	offsetX = (float64(widgetWidth) - float64(e.width)*scale) / 2
+	offsetY = (float64(widgetHeight) - float64(e.height)*scale) / 2
+	return scale, offsetX, offsetY
+}
+
+// toImage converts widget coordinates to image coordinates
+func (e *maskEditor) toImage(x, y float64) (float64, float64) {
+	scale, offsetX, offsetY := e.layout(e.area.Width(), e.area.Height())
+	return (x - offsetX) / scale, (y - offsetY) / scale
+}
+
+// draw renders the source with the mask as a translucent red overlay
+func (e *maskEditor) draw(_ *gtk.DrawingArea, cr *cairo.Context, width, height int) {
+	scale, offsetX, offsetY := e.layout(width, height)
+
+	cr.Translate(offsetX, offsetY)
+	cr.Scale(scale, scale)
+
+	cr.SetSourceSurface(e.source, 0, 0)
+	cr.Paint()
+
+	cr.SetSourceRGBA(1, 0, 0, 0.5)
+	cr.MaskSurface(e.mask, 0, 0)
+}
+
+// stroke paints (or erases) a round-capped line between two image points
+func (e *maskEditor) stroke(x1, y1, x2, y2 float64) {
+	cr := cairo.Create(e.mask)
+	if e.eraser.Active() {
+		cr.SetOperator(cairo.OperatorClear)
+	} else {
+		cr.SetOperator(cairo.OperatorOver)
+	}
+	cr.SetSourceRGBA(0, 0, 0, 1)
+	cr.SetLineWidth(e.brushSize.Value())
+	cr.SetLineCap(cairo.LineCapRound)
+	cr.MoveTo(x1, y1)
+	cr.LineTo(x2, y2)
+	cr.Stroke()
+	cr.Close()
+
+	e.area.QueueDraw()
+}
+
+// invert swaps painted and unpainted areas
+func (e *maskEditor) invert() {
+	cr := cairo.Create(e.mask)
+	cr.SetOperator(cairo.OperatorXOR)
+	cr.SetSourceRGBA(0, 0, 0, 1)
+	cr.Paint()
+	cr.Close()
+
+	e.area.QueueDraw()
+}
+
+// clear erases the whole mask
+func (e *maskEditor) clear() {
+	cr := cairo.Create(e.mask)
+	cr.SetOperator(cairo.OperatorClear)
+	cr.Paint()
+	cr.Close()
+
+	e.area.QueueDraw()
+}
+
+// isEmpty reports whether nothing has been painted
+func (e *maskEditor) isEmpty() bool {
+	e.mask.Flush()
+	for _, b := range e.mask.Data() {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// exportPNG writes the mask as a grayscale PNG the size of the source image,
+// white where the image should be regenerated
+func (e *maskEditor) exportPNG(path string) error {
+	e.mask.Flush()
+	data := e.mask.Data()
+	stride := e.mask.Stride()
+
+	gray := image.NewGray(image.Rect(0, 0, e.width, e.height))
+	for y := 0; y < e.height; y++ {
+		copy(gray.Pix[y*gray.Stride:y*gray.Stride+e.width], data[y*stride:y*stride+e.width])
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create mask file: %w", err)
+	}
+	defer file.Close()
+
+	if err := png.Encode(file, gray); err != nil {
+		return fmt.Errorf("failed to encode mask: %w", err)
+	}
+	return file.Close()
+}
+
+// showMaskEditor opens the inpainting mask editor for a generated image. On
+// apply, the image becomes the generation input and the mask is attached.
+func (a *App) showMaskEditor(sourceURL string, texture *gdk.Texture) {
+	editor, err := newMaskEditor(texture)
+	if err != nil {
+		a.setStatus(fmt.Sprintf("Error opening mask editor: %v", err))
+		return
+	}
+
+	// Create dialog
+	dialog := gtk.NewDialog()
+	dialog.SetTitle("Paint Inpainting Mask")
+	dialog.SetTransientFor(&a.win.Window)
+	dialog.SetModal(true)
+	dialog.SetDefaultSize(900, 700)
+
+	// Get dialog content area
+	contentArea := dialog.ContentArea()
+	contentArea.SetMarginTop(16)
+	contentArea.SetMarginBottom(16)
+	contentArea.SetMarginStart(16)
+	contentArea.SetMarginEnd(16)
+	contentArea.SetSpacing(16)
+
+	// Tool bar: brush size, eraser, invert, clear
+	toolBox := gtk.NewBox(gtk.OrientationHorizontal, 8)
+
+	brushLabel := gtk.NewLabel("Brush size:")
+	editor.brushSize = gtk.NewSpinButtonWithRange(1, 512, 1)
+	editor.brushSize.SetValue(float64(max(editor.width, editor.height)) / 20)
+
+	editor.eraser = gtk.NewToggleButtonWithLabel("Eraser")
+
+	invertBtn := gtk.NewButtonWithLabel("Invert")
+	invertBtn.ConnectClicked(editor.invert)
+
+	clearBtn := gtk.NewButtonWithLabel("Clear")
+	clearBtn.ConnectClicked(editor.clear)
+
+	hintLabel := gtk.NewLabel("Paint over the areas to regenerate")
+	hintLabel.SetHExpand(true)
+	hintLabel.SetXAlign(1)
+
+	toolBox.Append(brushLabel)
+	toolBox.Append(editor.brushSize)
+	toolBox.Append(editor.eraser)
+	toolBox.Append(invertBtn)
+	toolBox.Append(clearBtn)
+	toolBox.Append(hintLabel)
+
+	// Drawing area showing the image with the mask overlay
+	editor.area = gtk.NewDrawingArea()
+	editor.area.SetHExpand(true)
+	editor.area.SetVExpand(true)
+	editor.area.SetDrawFunc(editor.draw)
+
+	drag := gtk.NewGestureDrag()
+	drag.ConnectDragBegin(func(startX, startY float64) {
+		x, y := editor.toImage(startX, startY)
+		editor.lastX, editor.lastY = x, y
+		editor.stroke(x, y, x, y)
+	})
+	drag.ConnectDragUpdate(func(offsetX, offsetY float64) {
+		startX, startY, ok := drag.StartPoint()
+		if !ok {
+			return
+		}
+		x, y := editor.toImage(startX+offsetX, startY+offsetY)
+		editor.stroke(editor.lastX, editor.lastY, x, y)
+		editor.lastX, editor.lastY = x, y
+	})
+	editor.area.AddController(drag)
+
+	contentArea.Append(toolBox)
+	contentArea.Append(editor.area)
+
+	dialog.AddButton("Cancel", int(gtk.ResponseCancel))
+	dialog.AddButton("Use Mask", int(gtk.ResponseAccept))
+
+	dialog.ConnectResponse(func(responseId int) {
+		defer dialog.Destroy()
+
+		if responseId != int(gtk.ResponseAccept) {
+			return
+		}
+
+		if editor.isEmpty() {
+			a.setStatus("Mask is empty. Paint the areas to regenerate first.")
+			return
+		}
+
+		tmpFile, err := os.CreateTemp("", "mask-*.png")
+		if err != nil {
+			a.setStatus(fmt.Sprintf("Error saving mask: %v", err))
+			return
+		}
+		maskPath := tmpFile.Name()
+		tmpFile.Close()
+
+		if err := editor.exportPNG(maskPath); err != nil {
+			os.Remove(maskPath)
+			a.setStatus(fmt.Sprintf("Error saving mask: %v", err))
+			return
+		}
+
+		a.setInitImage(sourceURL)
+		a.setMaskImage(maskPath)
+	})
+
+	dialog.Show()
+}
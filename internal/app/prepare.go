@@ -0,0 +1,93 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"fluxxxer/internal/upscaler"
+
+	"github.com/diamondburned/gotk4/pkg/glib/v2"
+	"github.com/diamondburned/gotk4/pkg/gtk/v4"
+)
+
+// confirmPreparedImage asks whether the adjusted copy of an image may be
+// uploaded, showing its size before and after. It is called off the main
+// thread and blocks until the user answers; declining returns an error
+// wrapping context.Canceled.
+func (a *App) confirmPreparedImage(ctx context.Context, parent *gtk.Window, prepared *upscaler.PreparedImage) error {
+	answer := make(chan bool, 1)
+	var dialog *gtk.Dialog
+
+	glib.IdleAdd(func() {
+		dialog = gtk.NewDialog()
+		dialog.SetTitle("Adjust Image for Upscaling")
+		dialog.SetTransientFor(parent)
+		dialog.SetModal(true)
+
+		// Get dialog content area
+		contentArea := dialog.ContentArea()
+		contentArea.SetMarginTop(16)
+		contentArea.SetMarginBottom(16)
+		contentArea.SetMarginStart(16)
+		contentArea.SetMarginEnd(16)
+		contentArea.SetSpacing(8)
+
+		introLabel := gtk.NewLabel("The image exceeds the upscaler's limits. This copy will be uploaded instead; the original file is not changed.")
+		introLabel.SetWrap(true)
+		introLabel.SetXAlign(0)
+		contentArea.Append(introLabel)
+
+		grid := gtk.NewGrid()
+		grid.SetRowSpacing(4)
+		grid.SetColumnSpacing(16)
+		for i, row := range [][2]string{
+			{"Before:", describeImageInfo(prepared.Original)},
+			{"After:", describeImageInfo(prepared.Result)},
+			{"Changes:", strings.Join(prepared.Changes, ", ")},
+		} {
+			nameLabel := gtk.NewLabel(row[0])
+			nameLabel.SetXAlign(0)
+			valueLabel := gtk.NewLabel(row[1])
+			valueLabel.SetXAlign(0)
+			valueLabel.SetWrap(true)
+			grid.Attach(nameLabel, 0, i, 1, 1)
+			grid.Attach(valueLabel, 1, i, 1, 1)
+		}
+		contentArea.Append(grid)
+
+		dialog.AddButton("Cancel", int(gtk.ResponseCancel))
+		dialog.AddButton("Upload", int(gtk.ResponseAccept))
+
+		dialog.ConnectResponse(func(responseId int) {
+			// Never block the main thread should a second response arrive
+			select {
+			case answer <- responseId == int(gtk.ResponseAccept):
+			default:
+			}
+			dialog.Destroy()
+		})
+
+		dialog.Show()
+	})
+
+	select {
+	case ok := <-answer:
+		if !ok {
+			return fmt.Errorf("upload of adjusted image declined: %w", context.Canceled)
+		}
+		return nil
+	case <-ctx.Done():
+		glib.IdleAdd(func() {
+			if dialog != nil {
+				dialog.Destroy()
+			}
+		})
+		return ctx.Err()
+	}
+}
+
+// describeImageInfo renders the dimensions, format and size of an image
+func describeImageInfo(info upscaler.ImageInfo) string {
+	return fmt.Sprintf("%d × %d %s, %s", info.Width, info.Height, strings.ToUpper(info.Format), formatBytes(info.Bytes))
+}
@@ -1,8 +1,13 @@
 package app
 
 import (
+	"fmt"
+
+	"fluxxxer/internal/flux"
+
 	"github.com/diamondburned/gotk4/pkg/gdk/v4"
 	"github.com/diamondburned/gotk4/pkg/gtk/v4"
+	"github.com/diamondburned/gotk4/pkg/pango"
 	
 	// Import gio with underscore to use in file methods but avoid unused import error
 	_ "github.com/diamondburned/gotk4/pkg/gio/v2"
@@ -44,10 +49,25 @@ func (a *App) setupUI() {
 	mainBox.Append(stack)
 	
 	// Create status bar
+	statusBox := gtk.NewBox(gtk.OrientationHorizontal, 8)
+	statusBox.SetMarginTop(8)
+	
 	a.statusBar = gtk.NewLabel("")
 	a.statusBar.SetXAlign(0)
-	a.statusBar.SetMarginTop(8)
-	mainBox.Append(a.statusBar)
+	a.statusBar.SetHExpand(true)
+	a.statusBar.SetWrap(true)
+	statusBox.Append(a.statusBar)
+	
+	// Copy details button, shown only after an API error
+	a.copyDetailsBtn = gtk.NewButtonWithLabel("Copy details")
+	a.copyDetailsBtn.SetVisible(false)
+	a.copyDetailsBtn.ConnectClicked(func() {
+		gdk.DisplayGetDefault().Clipboard().SetText(a.errorDetails)
+		a.setStatus("Error details copied to clipboard")
+	})
+	statusBox.Append(a.copyDetailsBtn)
+	
+	mainBox.Append(statusBox)
 
 	// Show the window
 	a.win.SetChild(mainBox)
@@ -58,6 +78,28 @@ func (a *App) setupUI() {
 		// Set initial mode
 		a.setMode(a.isGeneratorMode)
 		
+		// Report a saved LoRA list that could not be read
+		if a.config.LoRAsError != nil {
+			a.setStatus(fmt.Sprintf("Error loading LoRAs: %v", a.config.LoRAsError))
+		}
+		
+		// Report extra API headers that could not be parsed
+		if a.config.APIHeadersError != nil {
+			a.setStatus(fmt.Sprintf("Error in FLUX_API_HEADERS: %v", a.config.APIHeadersError))
+		}
+		
+		// Report a CA bundle or client certificate that could not be loaded
+		if a.httpClientErr != nil {
+			a.setStatus(fmt.Sprintf("Error in HTTP settings: %v", a.httpClientErr))
+		}
+		
+		// Report a batch that could not be loaded, or jobs waiting for Resume
+		if a.batch.queueErr != nil {
+			a.setStatus(fmt.Sprintf("Error loading upscale batch: %v", a.batch.queueErr))
+		} else if pending := a.batch.queue.Pending(); pending > 0 {
+			a.setStatus(fmt.Sprintf("%d upscale jobs left from the last session; click Resume in the upscaler to continue", pending))
+		}
+		
 		// Update stack based on current mode
 		if a.isGeneratorMode {
 			stack.SetVisibleChildName("generator")
@@ -79,8 +121,11 @@ func (a *App) setupUI() {
 		}
 	})
 	
-	// Setup simple drop to handle files for the upscaler
+	// Accept images dropped on the upscaler, and inputs dropped on the
+	// generator
+	a.loadDropStyle()
 	a.setupFileDrop(upscalerView)
+	a.setupInputDrop(generatorView)
 	
 	a.win.Show()
 }
@@ -109,10 +154,16 @@ func (a *App) createHeaderArea() *gtk.Box {
 	a.spinner = gtk.NewSpinner()
 	a.spinner.SetMarginStart(8)
 	
+	// Cancel button, only sensitive while a generation is running
+	a.cancelBtn = gtk.NewButtonWithLabel("Cancel")
+	a.cancelBtn.SetSensitive(false)
+	a.cancelBtn.ConnectClicked(a.onCancelClicked)
+	
 	// Add elements to input box
 	inputBox.Append(a.entry)
 	inputBox.Append(generateBtn)
 	inputBox.Append(a.spinner)
+	inputBox.Append(a.cancelBtn)
 	
 	// Create options area (aspect ratio, number of outputs, etc.)
 	optionsBox := gtk.NewBox(gtk.OrientationHorizontal, 16)
@@ -123,18 +174,50 @@ func (a *App) createHeaderArea() *gtk.Box {
 	aspectLabel.SetMarginEnd(4)
 	
 	// Create and store reference to aspect ratio dropdown
+	// The configured ratios are followed by the two custom choices
+	ratios := a.config.GetSupportedAspectRatios()
 	aspectRatioCombo = gtk.NewDropDown(nil, nil)
-	aspectModel := gtk.NewStringList(a.config.GetSupportedAspectRatios())
+	aspectModel := gtk.NewStringList(append(append([]string{}, ratios...), customRatioLabel, customSizeLabel))
 	aspectRatioCombo.SetModel(aspectModel)
 	
-	// Set default aspect ratio
-	for i, ratio := range a.config.GetSupportedAspectRatios() {
+	// Free-form W:H ratio, shown for "Custom ratio"
+	a.customRatioEntry = gtk.NewEntry()
+	a.customRatioEntry.SetPlaceholderText("W:H")
+	a.customRatioEntry.SetMaxWidthChars(7)
+	a.customRatioEntry.SetWidthChars(7)
+	
+	// Explicit dimensions, shown for "Custom size"
+	a.customSizeBox = gtk.NewBox(gtk.OrientationHorizontal, 4)
+	a.widthSpin = gtk.NewSpinButtonWithRange(flux.MinDimension, flux.MaxDimension, flux.DimensionStep)
+	a.widthSpin.SetSnapToTicks(true)
+	a.widthSpin.SetValue(1024)
+	a.heightSpin = gtk.NewSpinButtonWithRange(flux.MinDimension, flux.MaxDimension, flux.DimensionStep)
+	a.heightSpin.SetSnapToTicks(true)
+	a.heightSpin.SetValue(1024)
+	a.customSizeBox.Append(a.widthSpin)
+	a.customSizeBox.Append(gtk.NewLabel("×"))
+	a.customSizeBox.Append(a.heightSpin)
+	
+	// Set default aspect ratio; one that is not in the list becomes a custom ratio
+	aspectRatioCombo.SetSelected(uint(len(ratios)))
+	a.customRatioEntry.SetText(a.config.GetDefaultAspectRatio())
+	for i, ratio := range ratios {
 		if ratio == a.config.GetDefaultAspectRatio() {
 			aspectRatioCombo.SetSelected(uint(i))
+			a.customRatioEntry.SetText("")
 			break
 		}
 	}
 	
+	// Only show the inputs for the selected custom mode
+	updateCustomSize := func() {
+		selected := aspectRatioCombo.Selected()
+		a.customRatioEntry.SetVisible(selected == uint(len(ratios)))
+		a.customSizeBox.SetVisible(selected == uint(len(ratios))+1)
+	}
+	aspectRatioCombo.NotifyProperty("selected", updateCustomSize)
+	updateCustomSize()
+	
 	// Number of outputs slider
 	numOutputsLabel := gtk.NewLabel("Images:")
 	numOutputsLabel.SetMarginStart(16)
@@ -154,11 +237,55 @@ func (a *App) createHeaderArea() *gtk.Box {
 	numOutputsScale.SetSizeRequest(120, -1)
 	numOutputsScale.SetDigits(0)
 	
+	// Input image picker for image-to-image generation
+	inputLabel := gtk.NewLabel("Input:")
+	inputLabel.SetMarginStart(16)
+	inputLabel.SetMarginEnd(4)
+	
+	chooseInputBtn := gtk.NewButtonWithLabel("Choose Image...")
+	chooseInputBtn.ConnectClicked(a.showFileChooserForInput)
+	
+	a.initImageLabel = gtk.NewLabel("None")
+	a.initImageLabel.SetEllipsize(pango.EllipsizeMiddle)
+	a.initImageLabel.SetMaxWidthChars(24)
+	
+	a.clearInputBtn = gtk.NewButtonWithLabel("Clear")
+	a.clearInputBtn.SetSensitive(false)
+	a.clearInputBtn.ConnectClicked(func() {
+		a.setInitImage("")
+	})
+	
+	// Prompt strength: 0 keeps the input image, 1 ignores it
+	strengthLabel := gtk.NewLabel("Strength:")
+	strengthLabel.SetMarginStart(8)
+	strengthLabel.SetMarginEnd(4)
+	
+	a.strengthScale = gtk.NewScale(gtk.OrientationHorizontal, gtk.NewAdjustment(
+		0.8,  // value
+		0,    // min
+		1,    // max
+		0.05, // step
+		0,    // page increment
+		0,    // page size
+	))
+	a.strengthScale.SetDrawValue(true)
+	a.strengthScale.SetDigits(2)
+	a.strengthScale.SetSizeRequest(100, -1)
+	a.strengthScale.SetSensitive(false)
+	
 	// Add options elements
 	optionsBox.Append(aspectLabel)
 	optionsBox.Append(aspectRatioCombo)
+	optionsBox.Append(a.customRatioEntry)
+	optionsBox.Append(a.customSizeBox)
 	optionsBox.Append(numOutputsLabel)
 	optionsBox.Append(numOutputsScale)
+	optionsBox.Append(inputLabel)
+	optionsBox.Append(chooseInputBtn)
+	optionsBox.Append(a.initImageLabel)
+	optionsBox.Append(a.clearInputBtn)
+	optionsBox.Append(strengthLabel)
+	optionsBox.Append(a.strengthScale)
 	
 	// Mode switcher section for switching between generator and upscaler
 	modeBox := gtk.NewBox(gtk.OrientationHorizontal, 4)
@@ -174,10 +301,9 @@ func (a *App) createHeaderArea() *gtk.Box {
 	a.upscalerToggle.SetLabel("Upscaler")
 	a.upscalerToggle.SetActive(!a.isGeneratorMode)
 	
-	// Disable upscaler button if not configured
+	// Without the upscaling service only local upscaling is available
 	if !a.isUpscalerConfigured() {
-		a.upscalerToggle.SetSensitive(false)
-		a.upscalerToggle.SetTooltipText("Upscaler not configured. Set UPSCALER_API_URL and UPSCALER_API_KEY in your .env file.")
+		a.upscalerToggle.SetTooltipText("Local upscaling only. Set UPSCALER_API_URL and UPSCALER_API_KEY in your .env file to use the upscaling service.")
 	}
 	
 	// Add toggles to mode box
@@ -206,9 +332,10 @@ func (a *App) createHeaderArea() *gtk.Box {
 	// Add the mode switcher to the options box
 	optionsBox.Append(modeBox)
 	
-	// Add both rows to the header
+	// Add both rows and the advanced settings to the header
 	headerBox.Append(inputBox)
 	headerBox.Append(optionsBox)
+	headerBox.Append(a.createAdvancedSection())
 	
 	return headerBox
 }
@@ -235,7 +362,6 @@ func (a *App) createUpscalerView() *gtk.Box {
 	placeholderBox.SetHAlign(gtk.AlignCenter)
 	placeholderBox.SetVAlign(gtk.AlignCenter)
 	placeholderBox.SetHExpand(true)
-	placeholderBox.SetVExpand(true)
 	
 	// Add an icon
 	iconTheme := gtk.IconThemeGetForDisplay(gdk.DisplayGetDefault())
@@ -251,84 +377,79 @@ func (a *App) createUpscalerView() *gtk.Box {
 	placeholderBox.Append(dropLabel)
 	
 	// Add instructions
-	infoLabel := gtk.NewLabel("Or click the button below to select an image file")
+	infoLabel := gtk.NewLabel("Or select images or a folder; several images are upscaled as a batch")
 	placeholderBox.Append(infoLabel)
 	
-	// Add a select file button
-	selectBtn := gtk.NewButtonWithLabel("Select Image")
-	selectBtn.SetHAlign(gtk.AlignCenter)
-	selectBtn.SetMarginTop(16)
+	// Add select file and folder buttons
+	buttonBox := gtk.NewBox(gtk.OrientationHorizontal, 8)
+	buttonBox.SetHAlign(gtk.AlignCenter)
+	buttonBox.SetMarginTop(16)
+	
+	selectBtn := gtk.NewButtonWithLabel("Select Images")
 	selectBtn.ConnectClicked(func() {
 		a.showFileChooserForUpscale()
 	})
-	placeholderBox.Append(selectBtn)
-	
-	// Add upscale options
-	optionsFrame := gtk.NewFrame("Upscale Options")
-	optionsBox := gtk.NewBox(gtk.OrientationVertical, 8)
-	optionsBox.SetMarginTop(16)
-	optionsBox.SetMarginBottom(16)
-	optionsBox.SetMarginStart(16)
-	optionsBox.SetMarginEnd(16)
-	
-	// Upscale type
-	typeBox := gtk.NewBox(gtk.OrientationHorizontal, 8)
-	typeLabel := gtk.NewLabel("Upscale Type:")
-	typeLabel.SetHAlign(gtk.AlignStart)
-	typeLabel.SetXAlign(0)
-	
-	typeCombo := gtk.NewDropDown(nil, nil)
-	typeCombo.SetModel(gtk.NewStringList(a.config.GetSupportedUpscaleTypes()))
-	typeCombo.SetHExpand(true)
-	
-	// Set default upscale type
-	defaultType := a.config.GetDefaultUpscaleType()
-	for i, t := range a.config.GetSupportedUpscaleTypes() {
-		if t == defaultType {
-			typeCombo.SetSelected(uint(i))
-			break
-		}
-	}
-	
-	typeBox.Append(typeLabel)
-	typeBox.Append(typeCombo)
-	
-	// Prompt for conservative and creative modes
-	promptBox := gtk.NewBox(gtk.OrientationHorizontal, 8)
-	promptLabel := gtk.NewLabel("Prompt:")
-	promptLabel.SetHAlign(gtk.AlignStart)
-	promptLabel.SetXAlign(0)
+	buttonBox.Append(selectBtn)
 	
-	promptEntry := gtk.NewEntry()
-	promptEntry.SetPlaceholderText("Enter a prompt to guide upscaling (for conservative/creative modes)")
-	promptEntry.SetHExpand(true)
+	folderBtn := gtk.NewButtonWithLabel("Upscale Folder...")
+	folderBtn.ConnectClicked(a.showFolderChooserForUpscale)
+	buttonBox.Append(folderBtn)
 	
-	promptBox.Append(promptLabel)
-	promptBox.Append(promptEntry)
+	placeholderBox.Append(buttonBox)
 	
-	// Add options to the options box
-	optionsBox.Append(typeBox)
-	optionsBox.Append(promptBox)
-	
-	optionsFrame.SetChild(optionsBox)
+	// Add batch options and jobs
+	optionsFrame := a.createBatchOptions()
+	listFrame := a.createBatchList()
 	
 	// Add elements to the upscaler box
 	upscalerBox.Append(placeholderBox)
 	upscalerBox.Append(optionsFrame)
+	upscalerBox.Append(listFrame)
 	
 	return upscalerBox
 }
 
-// setupFileDrop sets up a simple file drop handler
-func (a *App) setupFileDrop(widget *gtk.Box) {
-	// For now, this is a simplified version without drag-and-drop
-	// We'll rely on the file picker button
-}
-
 // showFileChooserForUpscale shows a file chooser dialog for upscaling
 func (a *App) showFileChooserForUpscale() {
 	dialog := gtk.NewFileChooserNative(
-		"Select Image to Upscale",
+		"Select Images to Upscale",
+		&a.win.Window,
+		gtk.FileChooserActionOpen,
+		"_Open",
+		"_Cancel",
+	)
+	dialog.SetSelectMultiple(true)
+	
+	// Add image filters
+	filter := gtk.NewFileFilter()
+	filter.AddPattern("*.png")
+	filter.AddPattern("*.jpg")
+	filter.AddPattern("*.jpeg")
+	filter.AddPattern("*.webp")
+	filter.SetName("Image files")
+	dialog.AddFilter(filter)
+	
+	dialog.ConnectResponse(func(response int) {
+		if response == int(gtk.ResponseAccept) {
+			// A single image opens the upscale dialog, several go to the batch
+			paths := chosenPaths(dialog)
+			switch {
+			case len(paths) == 1:
+				a.handleUpscaleFile(paths[0])
+			case len(paths) > 1:
+				a.queueBatch(paths)
+			}
+		}
+		dialog.Destroy()
+	})
+	
+	dialog.Show()
+}
+
+// showFileChooserForInput shows a file chooser for the image-to-image input
+func (a *App) showFileChooserForInput() {
+	dialog := gtk.NewFileChooserNative(
+		"Select Input Image",
 		&a.win.Window,
 		gtk.FileChooserActionOpen,
 		"_Open",
@@ -348,7 +469,7 @@ func (a *App) showFileChooserForUpscale() {
 		if response == int(gtk.ResponseAccept) {
 			file := dialog.File()
 			if file != nil {
-				a.handleUpscaleFile(file.Path())
+				a.setInitImage(file.Path())
 			}
 		}
 		dialog.Destroy()
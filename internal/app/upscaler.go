@@ -1,9 +1,15 @@
 package app
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
-	"net/http"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
@@ -18,11 +24,6 @@ import (
 
 // handleUpscaleFile processes an image file for upscaling
 func (a *App) handleUpscaleFile(filePath string) {
-	if !a.isUpscalerConfigured() {
-		a.setStatus("Upscaler not configured. Please set UPSCALER_API_URL and UPSCALER_API_KEY in your .env file.")
-		return
-	}
-
 	// Check if file exists and is an image
 	if !isImageFile(filePath) {
 		a.setStatus(fmt.Sprintf("File is not a supported image format: %s", filePath))
@@ -30,11 +31,47 @@ func (a *App) handleUpscaleFile(filePath string) {
 	}
 
 	// Show the upscale confirmation dialog
-	a.showUpscaleConfirmDialog(filePath)
+	a.showUpscaleConfirmDialog(upscaleSource{path: filePath, name: filepath.Base(filePath)})
+}
+
+// handleUpscaleData offers to upscale an image held in memory, such as a
+// generated image, without writing it to a file first
+func (a *App) handleUpscaleData(data []byte, name string) {
+	a.showUpscaleConfirmDialog(upscaleSource{data: data, name: name})
+}
+
+// upscaleSource is an image to upscale, read from a file or held in memory
+type upscaleSource struct {
+	// path is the image file, empty for an image held in memory
+	path string
+	// data is the image when it is not a file
+	data []byte
+	// name is the file name the upscaled image is offered under
+	name string
+}
+
+// texture loads the image for display
+func (s upscaleSource) texture() (*gdk.Texture, error) {
+	if s.path != "" {
+		return loadTextureFromFile(s.path)
+	}
+	texture, err := gdk.NewTextureFromBytes(glib.NewBytesWithGo(s.data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create texture: %w", err)
+	}
+	return texture, nil
+}
+
+// prepare fits the image to the limits of the upscale type
+func (s upscaleSource) prepare(t upscaler.UpscaleType) (*upscaler.PreparedImage, error) {
+	if s.path != "" {
+		return upscaler.PrepareImage(s.path, t)
+	}
+	return upscaler.PrepareData(s.data, t)
 }
 
 // showUpscaleConfirmDialog shows a dialog with upscale options
-func (a *App) showUpscaleConfirmDialog(imagePath string) {
+func (a *App) showUpscaleConfirmDialog(src upscaleSource) {
 	// Create dialog
 	dialog := gtk.NewDialog()
 	dialog.SetTitle("Upscale Image")
@@ -66,7 +103,7 @@ func (a *App) showUpscaleConfirmDialog(imagePath string) {
 	imageFrame.SetHExpand(true)
 
 	// Load and display the image preview
-	texture, err := loadTextureFromFile(imagePath)
+	texture, err := src.texture()
 	if err != nil {
 		errorLabel := gtk.NewLabel(fmt.Sprintf("Error loading image: %v", err))
 		imageFrame.SetChild(errorLabel)
@@ -97,8 +134,12 @@ func (a *App) showUpscaleConfirmDialog(imagePath string) {
 	typeCombo.SetModel(gtk.NewStringList(a.config.GetSupportedUpscaleTypes()))
 	typeCombo.SetHExpand(true)
 
-	// Set default upscale type
+	// Set default upscale type, falling back to local upscaling when the
+	// service is not configured
 	defaultType := a.config.GetDefaultUpscaleType()
+	if !a.isUpscalerConfigured() {
+		defaultType = string(upscaler.UpscaleLocal)
+	}
 	for i, t := range a.config.GetSupportedUpscaleTypes() {
 		if t == defaultType {
 			typeCombo.SetSelected(uint(i))
@@ -140,10 +181,43 @@ func (a *App) showUpscaleConfirmDialog(imagePath string) {
 	formatBox.Append(formatLabel)
 	formatBox.Append(formatCombo)
 
+	// Scale factor, for upscaling on this machine only
+	scaleBox := gtk.NewBox(gtk.OrientationHorizontal, 8)
+	scaleLabel := gtk.NewLabel("Scale:")
+	scaleLabel.SetHAlign(gtk.AlignStart)
+	scaleLabel.SetXAlign(0)
+	scaleLabel.SetWidthChars(12)
+
+	scaleFactors := []int{4, 2}
+	scaleCombo := gtk.NewDropDown(nil, nil)
+	scaleCombo.SetModel(gtk.NewStringList([]string{"4x", "2x"}))
+	scaleCombo.SetHExpand(true)
+
+	scaleBox.Append(scaleLabel)
+	scaleBox.Append(scaleCombo)
+
+	// Tiled mode keeps the full resolution of images over the provider's
+	// limits instead of shrinking them first
+	tileCheck := gtk.NewCheckButtonWithLabel("Upscale in tiles (keeps the full resolution of large images)")
+
+	// Show the options that apply to the selected upscale type
+	updateOptions := func() {
+		upscaleType := upscaler.UpscaleType(a.config.GetSupportedUpscaleTypes()[typeCombo.Selected()])
+		local := upscaleType.IsLocal()
+		promptEntry.SetSensitive(upscaleType == upscaler.UpscaleConservative || upscaleType == upscaler.UpscaleCreative)
+		scaleBox.SetVisible(local)
+		tileCheck.SetSensitive(!local)
+		tileCheck.SetActive(!local && exceedsUpscaleLimits(src, upscaleType))
+	}
+	updateOptions()
+	typeCombo.NotifyProperty("selected", updateOptions)
+
 	// Add options to the options box
 	optionsBox.Append(typeBox)
 	optionsBox.Append(promptBox)
 	optionsBox.Append(formatBox)
+	optionsBox.Append(scaleBox)
+	optionsBox.Append(tileCheck)
 
 	// Add spinner for loading state
 	spinnerBox := gtk.NewBox(gtk.OrientationHorizontal, 8)
@@ -152,9 +226,28 @@ func (a *App) showUpscaleConfirmDialog(imagePath string) {
 	
 	spinner := gtk.NewSpinner()
 	spinnerLabel := gtk.NewLabel("Upscaling image...")
+	cancelBtn := gtk.NewButtonWithLabel("Cancel")
+	
+	// Share of finished tiles, only shown for tiled upscales
+	tileBar := gtk.NewProgressBar()
+	tileBar.SetShowText(true)
+	tileBar.SetVisible(false)
 	
 	spinnerBox.Append(spinner)
 	spinnerBox.Append(spinnerLabel)
+	spinnerBox.Append(tileBar)
+	spinnerBox.Append(cancelBtn)
+	
+	// cancelUpscale aborts the running job; closed is set once the dialog
+	// is gone so late progress and results are dropped
+	var cancelUpscale context.CancelFunc
+	closed := false
+	cancelBtn.ConnectClicked(func() {
+		if cancelUpscale != nil {
+			cancelUpscale()
+			spinnerLabel.SetText("Cancelling...")
+		}
+	})
 	
 	// Hide the spinner initially
 	spinnerBox.SetVisible(false)
@@ -172,207 +265,298 @@ func (a *App) showUpscaleConfirmDialog(imagePath string) {
 	// Connect response handler
 	dialog.ConnectResponse(func(responseId int) {
 		if responseId == int(gtk.ResponseAccept) {
+			// Ignore a second click while a job is running
+			if cancelUpscale != nil {
+				return
+			}
+
 			// Get selected options
 			upscaleType := a.config.GetSupportedUpscaleTypes()[typeCombo.Selected()]
 			prompt := promptEntry.Text()
 			outputFormat := []string{"png", "jpeg", "webp"}[formatCombo.Selected()]
 
 			// Show spinner
+			spinnerLabel.SetText("Preparing image...")
 			spinnerBox.SetVisible(true)
 			spinner.Start()
-			// upscaleButton.SetSensitive(false) - Not available in this version
-
-			// Check if the image file is too large and might cause OOM
-			fileInfo, err := os.Stat(imagePath)
-			if err == nil && fileInfo.Size() > 5*1024*1024 {
-				// Display a warning that the image is large and might cause OOM
-				a.setStatus(fmt.Sprintf("Warning: Image is large (%d MB). Server may run out of memory.", 
-					fileInfo.Size()/(1024*1024)))
-			}
-			
-			// Upscale the image
-			go a.upscaleImage(imagePath, upscaler.UpscaleOptions{
+			dialog.SetResponseSensitive(int(gtk.ResponseAccept), false)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancelUpscale = cancel
+
+			opts := upscaler.UpscaleOptions{
 				Type:         upscaler.UpscaleType(upscaleType),
 				Prompt:       prompt,
 				OutputFormat: outputFormat,
-			}, func(result *upscaler.UpscaleResult, err error) {
+				Scale:        scaleFactors[scaleCombo.Selected()],
+				OnProgress: func(p upscaler.Progress) {
+					text := describeUpscaleProgress(p)
+					glib.IdleAdd(func() {
+						if !closed && cancelUpscale != nil {
+							spinnerLabel.SetText(text)
+						}
+					})
+				},
+			}
+
+			// finish reports the outcome of the job
+			finish := func(path string, err error) {
 				// Update UI on main thread
 				glib.IdleAdd(func() {
+					cancel()
+					cancelUpscale = nil
+					// Nobody is left to show a late result to
+					if closed {
+						removeTempFile(path)
+						return
+					}
+
 					spinner.Stop()
 					spinnerBox.SetVisible(false)
+					tileBar.SetVisible(false)
+					dialog.SetResponseSensitive(int(gtk.ResponseAccept), true)
 					
+					// Keep the dialog open so the options can be changed
+					// and the upscale retried
+					if errors.Is(err, context.Canceled) {
+						a.setStatus("Upscale cancelled")
+						return
+					}
+
+					// Finished tiles are kept, so upscaling again resumes
+					var tileErr *upscaler.TileError
+					if errors.As(err, &tileErr) {
+						slog.Error("Tiled upscale incomplete", "error", err)
+						a.setStatus(fmt.Sprintf("%d of %d tiles failed: %v. Click Upscale to retry them.", len(tileErr.Failed), tileErr.Tiles, tileErr.Err))
+						return
+					}
+
 					if err != nil {
-						errMsg := fmt.Sprintf("Error upscaling image: %v", err)
-						a.setStatus(errMsg)
-						
-						// Show a detailed error in the console
-						fmt.Println("======== UPSCALING FAILED ========")
-						fmt.Println(errMsg)
-						fmt.Println("=================================")
-						
+						a.showError("Error upscaling image", err)
 						dialog.Destroy()
 						return
 					}
 					
-					// Check if we have a URL in the result
-					if result == nil || result.URL == "" {
-						errMsg := "No upscaled image URL returned from server"
-						a.setStatus(errMsg)
-						fmt.Println("======== UPSCALING FAILED ========")
-						fmt.Println(errMsg)
-						fmt.Println("=================================")
-						
+					slog.Debug("Loading upscaled image", "path", path)
+					
+					// Load image from the temporary file
+					texture, err := loadTextureFromFile(path)
+					if err != nil {
+						a.setStatus(fmt.Sprintf("Error loading upscaled image: %v", err))
+						removeTempFile(path)
 						dialog.Destroy()
 						return
 					}
 					
-					// Check if the URL is a local file path (from direct binary response)
-					if result.URL != "" && strings.HasPrefix(result.URL, "/tmp/upscaled-") {
-						fmt.Println("Using direct upscaled image from local path:", result.URL)
-						
-						// Load image from the temporary file
-						texture, err := loadTextureFromFile(result.URL)
-						if err != nil {
-							a.setStatus(fmt.Sprintf("Error loading upscaled image: %v", err))
-							dialog.Destroy()
-							return
-						}
-						
-						// Show the image in a dialog
-						a.showUpscaledImageDialog(texture, result.URL, filepath.Base(imagePath))
-						dialog.Destroy()
-					} else if result.URL != "" {
-						// Download and save the upscaled image from URL
-						fmt.Println("Downloading upscaled image from URL:", result.URL)
-						a.handleUpscaledImage(result, filepath.Base(imagePath))
-						dialog.Destroy()
-					} else {
-						a.setStatus("Error: No upscaled image URL returned")
-						dialog.Destroy()
-					}
+					// Show the image in a dialog
+					a.showUpscaledImageDialog(texture, path, src.name)
+					dialog.Destroy()
 				})
-			})
+			}
+
+			// Upscale the image
+			if tileCheck.Active() {
+				tileBar.SetFraction(0)
+				tileBar.SetText("")
+				tileBar.SetVisible(true)
+				go a.upscaleImageTiled(ctx, src, opts, func(p upscaler.TileProgress) {
+					text := describeTileProgress(p)
+					fraction := float64(p.Done) / float64(max(p.Tiles, 1))
+					barText := fmt.Sprintf("%d/%d tiles", p.Done, p.Tiles)
+					glib.IdleAdd(func() {
+						if !closed && cancelUpscale != nil {
+							spinnerLabel.SetText(text)
+							tileBar.SetFraction(fraction)
+							tileBar.SetText(barText)
+						}
+					})
+				}, finish)
+			} else {
+				go a.upscaleImage(ctx, &dialog.Window, src, opts, finish)
+			}
 		} else {
+			// Closing the dialog abandons a running job
+			if cancelUpscale != nil {
+				cancelUpscale()
+			}
+			closed = true
 			dialog.Destroy()
 		}
 	})
 
-	// Make the prompt entry initially insensitive if fast mode is selected
-	if defaultType == "fast" {
-		promptEntry.SetSensitive(false)
-	}
-
-	// TODO: Connect to change event when available
-	// Make prompt entry sensitive/insensitive based on upscale type
-
 	dialog.Show()
 }
 
-// upscaleImage sends a request to upscale the image
-func (a *App) upscaleImage(imagePath string, opts upscaler.UpscaleOptions, callback func(*upscaler.UpscaleResult, error)) {
+// upscaleImage fits the image to the upscaler's limits, asking over parent
+// before uploading a changed copy, sends it to be upscaled and downloads the
+// result, passing the local path of the upscaled image to callback
+func (a *App) upscaleImage(ctx context.Context, parent *gtk.Window, src upscaleSource, opts upscaler.UpscaleOptions, callback func(string, error)) {
 	// Validate options
 	if opts.Type == upscaler.UpscaleConservative || opts.Type == upscaler.UpscaleCreative {
 		if opts.Prompt == "" {
-			callback(nil, fmt.Errorf("prompt is required for %s upscaling", opts.Type))
+			callback("", fmt.Errorf("prompt is required for %s upscaling", opts.Type))
 			return
 		}
 	}
 
-	// Call the upscaler client
-	result, err := a.upscalerClient.UpscaleImageFromPath(imagePath, opts)
-	callback(result, err)
-}
+	backend, err := a.upscalerFor(opts.Type)
+	if err != nil {
+		callback("", err)
+		return
+	}
 
-// handleUpscaledImage processes and displays the upscaled image
-func (a *App) handleUpscaledImage(result *upscaler.UpscaleResult, originalName string) {
-	// Check if the URL is already a local file (direct binary response handling)
-	if strings.HasPrefix(result.URL, "/tmp/upscaled-") {
-		fmt.Println("Image is already local at:", result.URL)
-		a.setStatus("Loading upscaled image...")
-		
-		go func() {
-			// Load the image for display
-			texture, err := loadTextureFromFile(result.URL)
-			if err != nil {
-				glib.IdleAdd(func() {
-					a.setStatus(fmt.Sprintf("Error loading upscaled image: %v", err))
-				})
+	// Downscale or recompress images the service would reject; upscaling
+	// on this machine has no such limits
+	if !opts.Type.IsLocal() {
+		prepared, err := src.prepare(opts.Type)
+		if err != nil {
+			callback("", err)
+			return
+		}
+		defer prepared.Cleanup()
+
+		if prepared.Changed() {
+			if err := a.confirmPreparedImage(ctx, parent, prepared); err != nil {
+				callback("", err)
 				return
 			}
-			
-			// Show the upscaled image in a dialog
-			glib.IdleAdd(func() {
-				a.showUpscaledImageDialog(texture, result.URL, originalName)
-			})
-		}()
+		}
+		src.path, src.data = prepared.Path, prepared.Data
+	}
+
+	// Call the upscaler, streaming images held in memory from there
+	var result *upscaler.UpscaleResult
+	if src.path != "" {
+		result, err = backend.UpscaleImageContext(ctx, src.path, opts)
+	} else {
+		result, err = backend.UpscaleReader(ctx, bytes.NewReader(src.data), src.name, opts)
+	}
+	if err != nil {
+		callback("", err)
 		return
 	}
 
-	// Otherwise download from URL
-	a.setStatus("Downloading upscaled image...")
-	
-	go func() {
-		// Create a temporary file
-		ext := filepath.Ext(originalName)
-		if ext == "" {
-			ext = ".png"
-		}
-		
-		tmpFile, err := os.CreateTemp("", "upscaled-*"+ext)
-		if err != nil {
-			glib.IdleAdd(func() {
-				a.setStatus(fmt.Sprintf("Error creating temporary file: %v", err))
-			})
+	// Fetch results that are still on the service
+	path, err := backend.Download(ctx, result, opts.OnProgress)
+	callback(path, err)
+}
+
+// upscaleImageTiled upscales the image in tiles, passing the local path of
+// the stitched image to callback
+func (a *App) upscaleImageTiled(ctx context.Context, src upscaleSource, opts upscaler.UpscaleOptions, onProgress func(upscaler.TileProgress), callback func(string, error)) {
+	if opts.Type == upscaler.UpscaleConservative || opts.Type == upscaler.UpscaleCreative {
+		if opts.Prompt == "" {
+			callback("", fmt.Errorf("prompt is required for %s upscaling", opts.Type))
 			return
 		}
-		
-		tmpPath := tmpFile.Name()
-		defer tmpFile.Close()
-		
-		// Download the image
-		fmt.Println("Downloading from URL:", result.URL)
-		resp, err := http.Get(result.URL)
+	}
+
+	if !a.isUpscalerConfigured() {
+		callback("", errUpscalerNotConfigured)
+		return
+	}
+
+	// Tiles report through onProgress instead
+	opts.OnProgress = nil
+
+	var (
+		result *upscaler.UpscaleResult
+		err    error
+	)
+	tiles := upscaler.TileOptions{OnProgress: onProgress}
+	if src.path != "" {
+		result, err = a.upscalerClient.UpscaleTiled(ctx, src.path, opts, tiles)
+	} else {
+		result, err = a.upscalerClient.UpscaleTiledData(ctx, src.data, opts, tiles)
+	}
+	if err != nil {
+		callback("", err)
+		return
+	}
+	callback(result.URL, nil)
+}
+
+// exceedsUpscaleLimits reports whether the image is larger than the upscale
+// type accepts
+func exceedsUpscaleLimits(src upscaleSource, t upscaler.UpscaleType) bool {
+	var r io.Reader = bytes.NewReader(src.data)
+	if src.path != "" {
+		file, err := os.Open(src.path)
 		if err != nil {
-			glib.IdleAdd(func() {
-				a.setStatus(fmt.Sprintf("Error downloading upscaled image: %v", err))
-			})
-			return
+			return false
 		}
-		defer resp.Body.Close()
-		
-		if resp.StatusCode != http.StatusOK {
-			glib.IdleAdd(func() {
-				a.setStatus(fmt.Sprintf("Error downloading upscaled image: status code %d", resp.StatusCode))
-			})
-			return
+		defer file.Close()
+		r = file
+	}
+
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return false
+	}
+	limits := upscaler.LimitsFor(t)
+	return cfg.Width*cfg.Height > limits.MaxPixels ||
+		(limits.MaxSide > 0 && max(cfg.Width, cfg.Height) > limits.MaxSide)
+}
+
+// describeTileProgress turns a tile progress report into the text shown
+// next to the spinner
+func describeTileProgress(p upscaler.TileProgress) string {
+	text := fmt.Sprintf("Tile %d of %d", p.Tile+1, p.Tiles)
+	switch {
+	case p.Err != nil:
+		text += " failed"
+	case p.Progress.Phase != "":
+		text += ": " + describeUpscaleProgress(p.Progress)
+	default:
+		text += " done"
+	}
+	if p.Failed > 0 {
+		text += fmt.Sprintf(" (%d failed)", p.Failed)
+	}
+	return text
+}
+
+// describeUpscaleProgress turns an upscale progress report into the text
+// shown next to the spinner
+func describeUpscaleProgress(p upscaler.Progress) string {
+	switch p.Phase {
+	case upscaler.PhaseUploading, upscaler.PhaseDownloading:
+		verb := "Uploading"
+		if p.Phase == upscaler.PhaseDownloading {
+			verb = "Downloading"
 		}
-		
-		// Save the image to the temporary file
-		_, err = io.Copy(tmpFile, resp.Body)
-		if err != nil {
-			glib.IdleAdd(func() {
-				a.setStatus(fmt.Sprintf("Error saving upscaled image: %v", err))
-			})
-			return
+		if p.Total > 0 {
+			return fmt.Sprintf("%s image... %s of %s (%d%%)", verb, formatBytes(p.Bytes), formatBytes(p.Total), p.Bytes*100/p.Total)
 		}
-		
-		// Close the file to ensure all data is written
-		tmpFile.Close()
-		
-		// Load the image for display
-		texture, err := loadTextureFromFile(tmpPath)
-		if err != nil {
-			glib.IdleAdd(func() {
-				a.setStatus(fmt.Sprintf("Error loading upscaled image: %v", err))
-			})
-			return
+		return fmt.Sprintf("%s image... %s", verb, formatBytes(p.Bytes))
+	case upscaler.PhaseQueued:
+		if p.Polls > 0 {
+			return fmt.Sprintf("Queued (poll %d)...", p.Polls)
 		}
-		
-		// Show the upscaled image in a dialog
-		glib.IdleAdd(func() {
-			a.showUpscaledImageDialog(texture, tmpPath, originalName)
-		})
-	}()
+		return "Queued..."
+	case upscaler.PhaseProcessing:
+		status := p.Status
+		if status == "" {
+			status = "processing"
+		}
+		// Local upscaling is never polled
+		if p.Polls == 0 {
+			return fmt.Sprintf("Processing (%s)...", status)
+		}
+		return fmt.Sprintf("Processing (poll %d, %s)...", p.Polls, status)
+	}
+	return "Upscaling image..."
+}
+
+// formatBytes renders a byte count for display
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
+	case n >= 1024:
+		return fmt.Sprintf("%.0f KB", float64(n)/1024)
+	}
+	return fmt.Sprintf("%d B", n)
 }
 
 // showUpscaledImageDialog displays the upscaled image with options to save or copy
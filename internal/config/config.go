@@ -1,26 +1,84 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
+
+	"fluxxxer/internal/logging"
 )
 
 // Config holds application configuration
 type Config struct {
 	// Flux API settings
 	APIEndpoint        string
+	APIMode            string
+	Backend            string
+	APIKey             string
+	ComfyUIWorkflow    string
+	
+	// How the API key is sent: bearer, token, header or none. APIKeyHeader
+	// names the header for the header scheme; APIHeaders are sent as is.
+	AuthScheme         string
+	APIKeyHeader       string
+	APIHeaders         map[string]string
+	APIHeadersError    error
+	
 	DefaultNumOutputs  int
 	DefaultAspectRatio string
+	AspectRatios       []string
 	DefaultFormat      string
 	DefaultQuality     int
+	DefaultModel       string
 	DisableSafetyCheck bool
+	RequestTimeout     time.Duration
+	
+	// Saved LoRAs, kept in loras.json in the config directory
+	LoRAs              []LoRA
+	LoRAsPath          string
+	LoRAsError         error
 	
 	// Upscaler API settings
 	UpscalerAPIURL     string
 	UpscalerAPIKey     string
 	UpscalerAppID      string
 	DefaultUpscaleType string
+	// UpscalerDecoder names the decoder for upscaler responses; "auto"
+	// detects it
+	UpscalerDecoder    string
+	
+	// Local upscaler settings: the resampling filter and the strength of
+	// the edge sharpening, 0 to turn it off
+	LocalUpscaleFilter string
+	LocalSharpen       float64
+	
+	// External upscaler command template, such as
+	// "realesrgan -i {in} -o {out} -s {scale}", and how long it may run
+	UpscalerCommand    string
+	CommandTimeout     time.Duration
+	
+	// Upscale batch queue, kept in batch.json in the state directory
+	BatchFile          string
+	
+	// HTTP retry settings shared by all clients
+	RetryMaxAttempts   int
+	RetryBudget        time.Duration
+	
+	// HTTP transport settings shared by all clients
+	ConnectTimeout     time.Duration
+	ReadTimeout        time.Duration
+	CAFile             string
+	ClientCertFile     string
+	ClientKeyFile      string
+	
+	// Logging settings; an empty LogFile means the default under the XDG
+	// state directory
+	LogLevel           string
+	LogFormat          string
+	LogFile            string
 	
 	// UI settings
 	WindowWidth        int
@@ -32,17 +90,47 @@ func NewConfig() *Config {
 	cfg := &Config{
 		// Flux API settings
 		APIEndpoint:        os.Getenv("FLUX_API_URL"),
+		APIMode:            "auto",
+		Backend:            "flux",
+		APIKey:             os.Getenv("FLUX_API_KEY"),
+		ComfyUIWorkflow:    os.Getenv("COMFYUI_WORKFLOW"),
 		DefaultNumOutputs:  4,
 		DefaultAspectRatio: "1:1",
+		AspectRatios:       []string{"1:1", "4:3", "3:4", "16:9", "9:16"},
 		DefaultFormat:      "png",
 		DefaultQuality:     1,
+		DefaultModel:       strings.ToLower(os.Getenv("FLUX_MODEL")),
 		DisableSafetyCheck: true,
+		RequestTimeout:     120 * time.Second,
 		
 		// Upscaler API settings
 		UpscalerAPIURL:     os.Getenv("UPSCALER_API_URL"),
 		UpscalerAPIKey:     os.Getenv("UPSCALER_API_KEY"),
 		UpscalerAppID:      os.Getenv("UPSCALER_APP_ID"),
 		DefaultUpscaleType: "fast",
+		UpscalerDecoder:    "auto",
+		
+		// Local upscaler settings
+		LocalUpscaleFilter: "lanczos3",
+		LocalSharpen:       0.6,
+		UpscalerCommand:    os.Getenv("UPSCALER_COMMAND"),
+		CommandTimeout:     600 * time.Second,
+		
+		// HTTP retry settings
+		RetryMaxAttempts:   3,
+		RetryBudget:        60 * time.Second,
+		
+		// HTTP transport settings
+		ConnectTimeout:     15 * time.Second,
+		ReadTimeout:        120 * time.Second,
+		CAFile:             os.Getenv("FLUXXXER_CA_FILE"),
+		ClientCertFile:     os.Getenv("FLUXXXER_CLIENT_CERT"),
+		ClientKeyFile:      os.Getenv("FLUXXXER_CLIENT_KEY"),
+		
+		// Logging settings
+		LogLevel:           "info",
+		LogFormat:          "text",
+		LogFile:            os.Getenv("FLUXXXER_LOG_FILE"),
 		
 		// UI settings
 		WindowWidth:        2000,
@@ -65,6 +153,18 @@ func NewConfig() *Config {
 		cfg.DefaultAspectRatio = val
 	}
 
+	if val := os.Getenv("FLUX_ASPECT_RATIOS"); val != "" {
+		var ratios []string
+		for _, ratio := range strings.Split(val, ",") {
+			if ratio = strings.TrimSpace(ratio); ratio != "" {
+				ratios = append(ratios, ratio)
+			}
+		}
+		if len(ratios) > 0 {
+			cfg.AspectRatios = ratios
+		}
+	}
+
 	if val := os.Getenv("FLUX_FORMAT"); val != "" {
 		cfg.DefaultFormat = strings.ToLower(val)
 	}
@@ -78,11 +178,103 @@ func NewConfig() *Config {
 	if val := os.Getenv("FLUX_DISABLE_SAFETY"); val != "" {
 		cfg.DisableSafetyCheck = val == "true" || val == "1" || val == "yes"
 	}
+
+	if val := os.Getenv("FLUX_BACKEND"); val != "" {
+		cfg.Backend = strings.ToLower(val)
+	}
+
+	if val := os.Getenv("FLUX_API_MODE"); val != "" {
+		cfg.APIMode = strings.ToLower(val)
+	}
+
+	if val := os.Getenv("FLUX_AUTH_SCHEME"); val != "" {
+		cfg.AuthScheme = strings.ToLower(val)
+	}
+
+	if val := os.Getenv("FLUX_API_KEY_HEADER"); val != "" {
+		cfg.APIKeyHeader = strings.TrimSpace(val)
+		// Naming a header implies sending the key in it
+		if cfg.AuthScheme == "" {
+			cfg.AuthScheme = "header"
+		}
+	}
+
+	if val := os.Getenv("FLUX_API_HEADERS"); val != "" {
+		cfg.APIHeaders, cfg.APIHeadersError = parseHeaders(val)
+	}
+
+	if val := os.Getenv("FLUX_TIMEOUT"); val != "" {
+		if seconds, err := strconv.Atoi(val); err == nil && seconds > 0 {
+			cfg.RequestTimeout = time.Duration(seconds) * time.Second
+		}
+	}
 	
 	// Override Upscaler API defaults with environment variables
 	if val := os.Getenv("UPSCALER_TYPE"); val != "" {
 		cfg.DefaultUpscaleType = strings.ToLower(val)
 	}
+	if val := os.Getenv("UPSCALER_RESPONSE_FORMAT"); val != "" {
+		cfg.UpscalerDecoder = strings.ToLower(val)
+	}
+	if val := os.Getenv("UPSCALER_LOCAL_FILTER"); val != "" {
+		cfg.LocalUpscaleFilter = strings.ToLower(val)
+	}
+	if val := os.Getenv("UPSCALER_LOCAL_SHARPEN"); val != "" {
+		if amount, err := strconv.ParseFloat(val, 64); err == nil && amount >= 0 && amount <= 2 {
+			cfg.LocalSharpen = amount
+		}
+	}
+	if val := os.Getenv("UPSCALER_COMMAND_TIMEOUT"); val != "" {
+		if seconds, err := strconv.Atoi(val); err == nil && seconds > 0 {
+			cfg.CommandTimeout = time.Duration(seconds) * time.Second
+		}
+	}
+
+	// Override retry defaults with environment variables
+	if val := os.Getenv("FLUXXXER_RETRY_ATTEMPTS"); val != "" {
+		if attempts, err := strconv.Atoi(val); err == nil && attempts > 0 {
+			cfg.RetryMaxAttempts = attempts
+		}
+	}
+
+	if val := os.Getenv("FLUXXXER_RETRY_BUDGET"); val != "" {
+		if seconds, err := strconv.Atoi(val); err == nil && seconds >= 0 {
+			cfg.RetryBudget = time.Duration(seconds) * time.Second
+		}
+	}
+
+	// Override transport defaults with environment variables
+	if val := os.Getenv("FLUXXXER_CONNECT_TIMEOUT"); val != "" {
+		if seconds, err := strconv.Atoi(val); err == nil && seconds >= 0 {
+			cfg.ConnectTimeout = time.Duration(seconds) * time.Second
+		}
+	}
+
+	if val := os.Getenv("FLUXXXER_READ_TIMEOUT"); val != "" {
+		if seconds, err := strconv.Atoi(val); err == nil && seconds >= 0 {
+			cfg.ReadTimeout = time.Duration(seconds) * time.Second
+		}
+	}
+
+	// Override logging defaults with environment variables
+	if val := os.Getenv("FLUXXXER_LOG"); val != "" {
+		cfg.LogLevel = strings.ToLower(val)
+	}
+
+	if val := os.Getenv("FLUXXXER_LOG_FORMAT"); val != "" {
+		cfg.LogFormat = strings.ToLower(val)
+	}
+
+	// Keep the upscale batch queue next to the log
+	if dir, err := logging.StateDir(); err == nil {
+		cfg.BatchFile = filepath.Join(dir, "batch.json")
+	}
+
+	// Load saved LoRAs; a broken file is reported by the UI
+	if dir, err := Dir(); err == nil {
+		cfg.LoRAsPath = filepath.Join(dir, loraFile)
+		cfg.LoRAs, cfg.LoRAsError = loadLoRAs(cfg.LoRAsPath)
+	}
 
 	// Override UI defaults with environment variables
 	if val := os.Getenv("FLUX_WINDOW_WIDTH"); val != "" {
@@ -107,6 +299,42 @@ func (c *Config) GetAPIEndpoint() string {
 	return c.APIEndpoint
 }
 
+// GetAPIMode returns how results are delivered: auto, sync or prediction
+func (c *Config) GetAPIMode() string {
+	return c.APIMode
+}
+
+// GetBackend returns the name of the image-generation backend
+func (c *Config) GetBackend() string {
+	return c.Backend
+}
+
+// GetAPIKey returns the API key for the generation backend
+func (c *Config) GetAPIKey() string {
+	return c.APIKey
+}
+
+// GetAuthScheme returns how the API key is sent: bearer, token, header or
+// none. Empty means bearer when a key is set.
+func (c *Config) GetAuthScheme() string {
+	return c.AuthScheme
+}
+
+// GetAPIKeyHeader returns the header carrying the API key for the header scheme
+func (c *Config) GetAPIKeyHeader() string {
+	return c.APIKeyHeader
+}
+
+// GetAPIHeaders returns extra headers sent with every API request
+func (c *Config) GetAPIHeaders() map[string]string {
+	return c.APIHeaders
+}
+
+// GetComfyUIWorkflow returns the path of the ComfyUI workflow template
+func (c *Config) GetComfyUIWorkflow() string {
+	return c.ComfyUIWorkflow
+}
+
 // GetDefaultNumOutputs returns the default number of outputs
 func (c *Config) GetDefaultNumOutputs() int {
 	return c.DefaultNumOutputs
@@ -127,11 +355,22 @@ func (c *Config) GetDefaultQuality() int {
 	return c.DefaultQuality
 }
 
+// GetDefaultModel returns the default Flux model variant, empty for the
+// endpoint's own model
+func (c *Config) GetDefaultModel() string {
+	return c.DefaultModel
+}
+
 // GetDisableSafetyCheck returns whether safety checks are disabled
 func (c *Config) GetDisableSafetyCheck() bool {
 	return c.DisableSafetyCheck
 }
 
+// GetRequestTimeout returns the deadline applied to a single generation request
+func (c *Config) GetRequestTimeout() time.Duration {
+	return c.RequestTimeout
+}
+
 // Upscaler API getters
 
 // GetUpscalerAPIURL returns the upscaler API URL
@@ -154,6 +393,108 @@ func (c *Config) GetDefaultUpscaleType() string {
 	return c.DefaultUpscaleType
 }
 
+// GetUpscalerDecoder returns the name of the upscaler response decoder,
+// "auto" to detect it
+func (c *Config) GetUpscalerDecoder() string {
+	return c.UpscalerDecoder
+}
+
+// GetLocalUpscaleFilter returns the resampling filter of the local upscaler
+func (c *Config) GetLocalUpscaleFilter() string {
+	return c.LocalUpscaleFilter
+}
+
+// GetLocalSharpen returns the edge sharpening strength of the local
+// upscaler
+func (c *Config) GetLocalSharpen() float64 {
+	return c.LocalSharpen
+}
+
+// GetUpscalerCommand returns the template of the external upscaler command,
+// empty when none is configured
+func (c *Config) GetUpscalerCommand() string {
+	return c.UpscalerCommand
+}
+
+// GetUpscalerCommandTimeout returns how long the upscaler command may run
+func (c *Config) GetUpscalerCommandTimeout() time.Duration {
+	return c.CommandTimeout
+}
+
+// GetBatchFile returns the file the upscale batch queue is saved to, empty
+// when there is no state directory
+func (c *Config) GetBatchFile() string {
+	return c.BatchFile
+}
+
+// Retry getters
+
+// GetRetryMaxAttempts returns the maximum number of attempts per request
+func (c *Config) GetRetryMaxAttempts() int {
+	return c.RetryMaxAttempts
+}
+
+// GetRetryBudget returns the total time allowed for retrying one request
+func (c *Config) GetRetryBudget() time.Duration {
+	return c.RetryBudget
+}
+
+// Transport getters
+
+// GetConnectTimeout returns the limit for dialing and the TLS handshake
+func (c *Config) GetConnectTimeout() time.Duration {
+	return c.ConnectTimeout
+}
+
+// GetReadTimeout returns how long a connection may go without receiving data
+func (c *Config) GetReadTimeout() time.Duration {
+	return c.ReadTimeout
+}
+
+// GetCAFile returns the path of an extra PEM CA bundle to trust
+func (c *Config) GetCAFile() string {
+	return c.CAFile
+}
+
+// GetClientCertFile returns the path of the PEM client certificate for mTLS
+func (c *Config) GetClientCertFile() string {
+	return c.ClientCertFile
+}
+
+// GetClientKeyFile returns the path of the PEM client key for mTLS
+func (c *Config) GetClientKeyFile() string {
+	return c.ClientKeyFile
+}
+
+// Logging getters
+
+// GetLogLevel returns the minimum level logged: debug, info, warn or error
+func (c *Config) GetLogLevel() string {
+	return c.LogLevel
+}
+
+// GetLogFormat returns the log format: text or json
+func (c *Config) GetLogFormat() string {
+	return c.LogFormat
+}
+
+// GetLogFile returns the log file path, "none" to disable it, or empty for
+// the default
+func (c *Config) GetLogFile() string {
+	return c.LogFile
+}
+
+// Secrets returns the configured credentials, to be masked in logs
+func (c *Config) Secrets() []string {
+	secrets := []string{c.APIKey, c.UpscalerAPIKey, c.UpscalerAppID}
+	for name, value := range c.APIHeaders {
+		if logging.IsSensitiveKey(name) {
+			secrets = append(secrets, value)
+		}
+	}
+	return secrets
+}
+
 // UI getters
 
 // GetWindowWidth returns the default window width
@@ -168,17 +509,43 @@ func (c *Config) GetWindowHeight() int {
 
 // Helper methods
 
-// GetSupportedAspectRatios returns a list of supported aspect ratios
+// GetSupportedAspectRatios returns the aspect ratios the endpoint accepts
+// natively; other ratios are sent as a custom width and height
 func (c *Config) GetSupportedAspectRatios() []string {
-	return []string{"1:1", "4:3", "3:4", "16:9", "9:16"}
+	return c.AspectRatios
 }
 
-// GetSupportedUpscaleTypes returns a list of supported upscaling types
+// GetSupportedUpscaleTypes returns a list of supported upscaling types,
+// including the external command when one is configured
 func (c *Config) GetSupportedUpscaleTypes() []string {
-	return []string{"fast", "conservative", "creative"}
+	types := []string{"fast", "conservative", "creative", "local"}
+	if c.UpscalerCommand != "" {
+		types = append(types, "command")
+	}
+	return types
 }
 
-// IsUpscalerConfigured returns true if the upscaler is configured
+// IsUpscalerConfigured returns true if the upscaling service is configured;
+// local upscaling works without it
 func (c *Config) IsUpscalerConfigured() bool {
 	return c.UpscalerAPIURL != "" && c.UpscalerAPIKey != ""
-}
\ No newline at end of file
+}
+
+// parseHeaders parses comma-separated Name=value pairs, such as
+// "X-Org-ID=acme,X-Team=art"
+func parseHeaders(val string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for i, pair := range strings.Split(val, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		// The entry is not quoted in the error since it may hold a secret
+		if !ok || name == "" {
+			return headers, fmt.Errorf("entry %d is not Name=value", i+1)
+		}
+		headers[name] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
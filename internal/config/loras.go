@@ -0,0 +1,83 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// loraFile is the name of the saved LoRA list inside the config directory
+const loraFile = "loras.json"
+
+// LoRA is a saved LoRA with the scale it is applied at by default
+type LoRA struct {
+	Name    string  `json:"name"`
+	Weights string  `json:"weights"`
+	Scale   float64 `json:"scale"`
+}
+
+// Dir returns the fluxxxer config directory, $XDG_CONFIG_HOME/fluxxxer
+func Dir() (string, error) {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate config directory: %w", err)
+	}
+	return filepath.Join(base, "fluxxxer"), nil
+}
+
+// loadLoRAs reads the saved LoRAs; a missing file means none are saved
+func loadLoRAs(path string) ([]LoRA, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read LoRAs: %w", err)
+	}
+
+	var loras []LoRA
+	if err := json.Unmarshal(data, &loras); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return loras, nil
+}
+
+// GetLoRAs returns the saved LoRAs
+func (c *Config) GetLoRAs() []LoRA {
+	return c.LoRAs
+}
+
+// SetLoRAs replaces the saved LoRAs and writes them to the config directory
+func (c *Config) SetLoRAs(loras []LoRA) error {
+	for _, l := range loras {
+		if l.Name == "" || l.Weights == "" {
+			return errors.New("every LoRA needs a name and weights")
+		}
+	}
+
+	if c.LoRAsPath == "" {
+		return errors.New("no config directory to save LoRAs in")
+	}
+
+	data, err := json.MarshalIndent(loras, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode LoRAs: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.LoRAsPath), 0o755); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+
+	// Write to a temporary file first so a crash cannot truncate the list
+	tmp := c.LoRAsPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to save LoRAs: %w", err)
+	}
+	if err := os.Rename(tmp, c.LoRAsPath); err != nil {
+		return fmt.Errorf("failed to save LoRAs: %w", err)
+	}
+
+	c.LoRAs = loras
+	return nil
+}
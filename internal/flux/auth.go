@@ -0,0 +1,150 @@
+package flux
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"fluxxxer/internal/httpx"
+)
+
+// Auth schemes for sending the API key
+const (
+	// AuthBearer sends "Authorization: Bearer <key>"; it is the default
+	AuthBearer = "bearer"
+	// AuthToken sends "Authorization: Token <key>", as older Replicate
+	// clients do
+	AuthToken = "token"
+	// AuthHeader sends the bare key in the header named by GetAPIKeyHeader
+	AuthHeader = "header"
+	// AuthNone sends no key, for endpoints authenticated by other headers
+	AuthNone = "none"
+)
+
+// DefaultAPIKeyHeader is used by the header scheme when no name is set
+const DefaultAPIKeyHeader = "X-API-Key"
+
+// apiHeaders builds the headers sent with every API request: the extra
+// headers and, if withKey is set, the API key in the configured scheme
+func apiHeaders(config Config, withKey bool) (http.Header, error) {
+	header := make(http.Header)
+	for name, value := range config.GetAPIHeaders() {
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid header name %q in FLUX_API_HEADERS", name)
+		}
+		header.Set(name, value)
+	}
+
+	key := config.GetAPIKey()
+	if !withKey || key == "" {
+		return header, nil
+	}
+
+	switch scheme := strings.ToLower(config.GetAuthScheme()); scheme {
+	case "", AuthBearer:
+		header.Set("Authorization", "Bearer "+key)
+	case AuthToken:
+		header.Set("Authorization", "Token "+key)
+	case AuthHeader:
+		name := config.GetAPIKeyHeader()
+		if name == "" {
+			name = DefaultAPIKeyHeader
+		}
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid API key header name %q", name)
+		}
+		header.Set(name, key)
+	case AuthNone:
+	default:
+		return nil, fmt.Errorf("unknown auth scheme %q (expected %s, %s, %s or %s)", scheme, AuthBearer, AuthToken, AuthHeader, AuthNone)
+	}
+
+	return header, nil
+}
+
+// newAPIClient returns an HTTP client on the shared transport that adds the
+// API headers to requests for the configured endpoint's host. Other hosts,
+// such as the CDN serving the images or a site hosting an input image, never
+// see the credentials.
+func newAPIClient(config Config, withKey bool) (*http.Client, error) {
+	header, err := apiHeaders(config, withKey)
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := httpx.NewTransport(generationTransportConfig{config})
+	if err != nil {
+		return nil, err
+	}
+	if len(header) == 0 {
+		return &http.Client{Transport: base}, nil
+	}
+
+	endpoint, err := url.Parse(config.GetAPIEndpoint())
+	if err != nil {
+		return nil, fmt.Errorf("invalid API URL: %w", err)
+	}
+	if endpoint.Host == "" {
+		return nil, errors.New("invalid API URL: no host")
+	}
+
+	return &http.Client{
+		Transport: &headerTransport{
+			host:   endpoint.Host,
+			header: header,
+			base:   base,
+		},
+	}, nil
+}
+
+// generationTransportConfig stretches the read timeout to the request
+// timeout: a synchronous endpoint sends nothing until the images are ready
+type generationTransportConfig struct {
+	Config
+}
+
+// GetReadTimeout implements httpx.TransportConfig
+func (c generationTransportConfig) GetReadTimeout() time.Duration {
+	timeout := c.Config.GetReadTimeout()
+	if timeout <= 0 {
+		return timeout
+	}
+	return max(timeout, c.Config.GetRequestTimeout())
+}
+
+// headerTransport adds fixed headers to requests for one host
+type headerTransport struct {
+	host   string
+	header http.Header
+	base   http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.EqualFold(req.URL.Host, t.host) {
+		return t.base.RoundTrip(req)
+	}
+
+	// A RoundTripper must not modify the caller's request
+	req = req.Clone(req.Context())
+	for name, values := range t.header {
+		req.Header[name] = values
+	}
+	return t.base.RoundTrip(req)
+}
+
+// validHeaderName reports whether name is a valid HTTP header field name
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return false
+		}
+	}
+	return true
+}
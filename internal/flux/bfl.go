@@ -0,0 +1,428 @@
+package flux
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"fluxxxer/internal/httpx"
+)
+
+func init() {
+	Register("bfl", func(config Config) (Generator, error) {
+		return NewBFLClient(config)
+	})
+}
+
+// BFLClient talks to the Black Forest Labs API, which creates one image per
+// task and returns a polling URL for the result
+type BFLClient struct {
+	apiURL          string
+	apiKey          string
+	httpClient      *http.Client
+	retry           httpx.RetryPolicy
+	config          Config
+	pollInterval    time.Duration
+	maxPollInterval time.Duration
+}
+
+// bflFillPath is the inpainting endpoint, on the same host as the API
+const bflFillPath = "/v1/flux-pro-1.0-fill"
+
+// bflModelPaths are the endpoints of the models BFL serves, on the same
+// host as the API
+var bflModelPaths = map[string]string{
+	"dev": "/v1/flux-dev",
+	"pro": "/v1/flux-pro",
+}
+
+// bflRequest is the body accepted by the BFL generation endpoints
+type bflRequest struct {
+	Prompt          string `json:"prompt"`
+	Width           int    `json:"width,omitempty"`
+	Height          int    `json:"height,omitempty"`
+	Seed            *int   `json:"seed,omitempty"`
+	OutputFormat    string `json:"output_format,omitempty"`
+	SafetyTolerance int    `json:"safety_tolerance,omitempty"`
+
+	// Steps and Guidance are accepted by the dev and pro endpoints
+	Steps    *int     `json:"steps,omitempty"`
+	Guidance *float64 `json:"guidance,omitempty"`
+
+	// ImagePrompt is a base64 image to remix
+	ImagePrompt         string   `json:"image_prompt,omitempty"`
+	ImagePromptStrength *float64 `json:"image_prompt_strength,omitempty"`
+
+	// Image and Mask are used by the fill (inpainting) endpoint
+	Image string `json:"image,omitempty"`
+	Mask  string `json:"mask,omitempty"`
+}
+
+// bflResult is the polling response for a BFL task
+type bflResult struct {
+	ID       string   `json:"id"`
+	Status   string   `json:"status"`
+	Progress *float64 `json:"progress,omitempty"`
+	Result   struct {
+		Sample string `json:"sample"`
+		Seed   *int   `json:"seed,omitempty"`
+	} `json:"result"`
+
+	// raw is the response body the result was decoded from
+	raw []byte
+}
+
+// NewBFLClient creates a client for the BFL API
+func NewBFLClient(config Config) (*BFLClient, error) {
+	if config.GetAPIEndpoint() == "" {
+		return nil, errors.New("API URL not configured")
+	}
+	if config.GetAPIKey() == "" {
+		return nil, errors.New("the bfl backend requires FLUX_API_KEY")
+	}
+
+	// BFL takes the key in x-key, so only the extra headers are added
+	httpClient, err := newAPIClient(config, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BFLClient{
+		apiURL:          config.GetAPIEndpoint(),
+		apiKey:          config.GetAPIKey(),
+		httpClient:      httpClient,
+		retry:           httpx.NewRetryPolicy(config.GetRetryMaxAttempts(), config.GetRetryBudget()),
+		config:          config,
+		pollInterval:    500 * time.Millisecond,
+		maxPollInterval: 5 * time.Second,
+	}, nil
+}
+
+// bflUnsupportedOptions rejects the sampling options the BFL API has no
+// input for, rather than silently generating without them
+func bflUnsupportedOptions(opts GenerateOptions) error {
+	var names []string
+	if opts.GoFast != nil {
+		names = append(names, "go fast")
+	}
+	if opts.Megapixels != "" {
+		names = append(names, "megapixels")
+	}
+	if opts.NegativePrompt != "" {
+		names = append(names, "a negative prompt")
+	}
+	if model := strings.ToLower(opts.Model); model != "" {
+		switch {
+		case opts.Mask != "":
+			// Inpainting always runs on the fill model
+			names = append(names, "choosing a model for inpainting")
+		case bflModelPaths[model] == "":
+			names = append(names, "the "+model+" model")
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return fmt.Errorf("the bfl backend does not support %s", strings.Join(names, ", "))
+}
+
+// GenerateImagesContext submits one task per requested output and waits for
+// all of them to finish
+func (c *BFLClient) GenerateImagesContext(ctx context.Context, prompt string, opts GenerateOptions) ([]Image, error) {
+	if prompt == "" {
+		return nil, errors.New("prompt cannot be empty")
+	}
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	if len(opts.LoRAs) > 0 {
+		return nil, errLoRAsUnsupported
+	}
+
+	if err := bflUnsupportedOptions(opts); err != nil {
+		return nil, err
+	}
+
+	image, err := c.inlineImage(ctx, opts.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	mask, err := c.inlineImage(ctx, opts.Mask)
+	if err != nil {
+		return nil, err
+	}
+
+	// BFL wants multiples of 32
+	width, height, err := pixelSize(opts, c.config.GetDefaultAspectRatio(), 32)
+	if err != nil {
+		return nil, err
+	}
+
+	body := bflRequest{
+		Prompt: prompt,
+		Width:  width,
+		Height: height,
+		Seed:   opts.Seed,
+
+		Steps:    opts.NumInferenceSteps,
+		Guidance: opts.Guidance,
+	}
+	// BFL only accepts jpeg and png
+	if opts.OutputFormat == "png" || opts.OutputFormat == "jpeg" {
+		body.OutputFormat = opts.OutputFormat
+	}
+	if c.config.GetDisableSafetyCheck() {
+		body.SafetyTolerance = 6
+	}
+	if mask != "" {
+		// Inpainting goes to the fill endpoint, which sizes the output
+		// from the input image
+		body.Image = image
+		body.Mask = mask
+		body.Width, body.Height = 0, 0
+	} else if image != "" {
+		body.ImagePrompt = image
+		// BFL weights the image rather than the prompt, so invert the strength
+		if opts.PromptStrength != nil {
+			strength := 1 - *opts.PromptStrength
+			body.ImagePromptStrength = &strength
+		}
+	}
+
+	resolved := opts
+	resolved.Width, resolved.Height = body.Width, body.Height
+	base := Image{Prompt: prompt, Seed: opts.Seed, Options: resolved}
+	base.Options.OnProgress = nil
+
+	// The configured endpoint runs unless a model or inpainting is asked for
+	endpoint := c.apiURL
+	path := bflModelPaths[strings.ToLower(opts.Model)]
+	if mask != "" {
+		path = bflFillPath
+	}
+	if path != "" {
+		if endpoint, err = c.endpointURL(path); err != nil {
+			return nil, err
+		}
+	}
+
+	n := max(opts.NumOutputs, 1)
+	images := make([]Image, n)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			img, err := c.generateOne(ctx, endpoint, body, base, opts.OnProgress)
+			if err != nil {
+				// One failed image fails the batch, so stop the rest
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			images[i] = img
+		}(i)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return images, nil
+}
+
+// inlineImage returns an input image as the raw base64 BFL expects. URLs,
+// such as the signed URLs of earlier results, are downloaded first.
+func (c *BFLClient) inlineImage(ctx context.Context, ref string) (string, error) {
+	if ref == "" {
+		return "", nil
+	}
+	data, err := readInputImage(ctx, c.httpClient, c.retry, ref)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// generateOne submits a single task to endpoint and polls it to completion,
+// filling in the task details on a copy of base
+func (c *BFLClient) generateOne(ctx context.Context, endpoint string, body bflRequest, base Image, onProgress func(*Prediction)) (Image, error) {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return Image{}, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(jsonData))
+	if err != nil {
+		return Image{}, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-key", c.apiKey)
+
+	start := time.Now()
+	resp, err := c.retry.ForCreate().Do(c.httpClient, req)
+	if err != nil {
+		return Image{}, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Image{}, httpx.NewAPIError(resp)
+	}
+
+	var task struct {
+		ID         string `json:"id"`
+		PollingURL string `json:"polling_url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&task); err != nil {
+		return Image{}, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if task.ID == "" {
+		return Image{}, errors.New("response has no task id")
+	}
+
+	slog.Debug("BFL task submitted", "id", task.ID)
+
+	pollURL := task.PollingURL
+	if pollURL == "" {
+		pollURL, err = c.resultURL(task.ID)
+		if err != nil {
+			return Image{}, err
+		}
+	}
+
+	delay := c.pollInterval
+	for {
+		if err := sleepContext(ctx, delay); err != nil {
+			return Image{}, fmt.Errorf("waiting for task %s: %w", task.ID, err)
+		}
+		delay = min(delay*3/2, c.maxPollInterval)
+
+		result, err := c.poll(ctx, pollURL)
+		if err != nil {
+			return Image{}, err
+		}
+		if result == nil {
+			continue
+		}
+
+		if onProgress != nil {
+			onProgress(result.toPrediction(task.ID))
+		}
+
+		switch result.Status {
+		case "Ready":
+			if result.Result.Sample == "" {
+				return Image{}, fmt.Errorf("task %s finished without an image", task.ID)
+			}
+			image := base
+			image.URL = result.Result.Sample
+			image.RequestID = task.ID
+			image.Latency = time.Since(start)
+			image.Metadata = metadata(result.raw)
+			if result.Result.Seed != nil {
+				image.Seed = result.Result.Seed
+			}
+			return image, nil
+		case "Pending", "Queued", "Processing":
+			continue
+		default:
+			return Image{}, fmt.Errorf("task %s failed: %s", task.ID, result.Status)
+		}
+	}
+}
+
+// poll fetches the task state. A nil result means a transient server error.
+func (c *BFLClient) poll(ctx context.Context, pollURL string) (*bflResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pollURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create poll request: %w", err)
+	}
+	req.Header.Set("x-key", c.apiKey)
+
+	resp, err := c.retry.Do(c.httpClient, req)
+	if err != nil {
+		return nil, fmt.Errorf("poll request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		io.Copy(io.Discard, resp.Body)
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("poll failed: %w", httpx.NewAPIError(resp))
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read poll response: %w", err)
+	}
+
+	var result bflResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode poll response: %w", err)
+	}
+	result.raw = body
+	return &result, nil
+}
+
+// resultURL builds the legacy get_result URL on the same host as the API
+func (c *BFLClient) resultURL(id string) (string, error) {
+	result, err := c.endpointURL("/v1/get_result")
+	if err != nil {
+		return "", err
+	}
+	return result + "?" + url.Values{"id": {id}}.Encode(), nil
+}
+
+// endpointURL returns the URL of another endpoint on the same host as the
+// API
+func (c *BFLClient) endpointURL(path string) (string, error) {
+	u, err := url.Parse(c.apiURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid API URL: %w", err)
+	}
+	u.Path, u.RawPath, u.RawQuery = path, "", ""
+	return u.String(), nil
+}
+
+// toPrediction maps a BFL task state onto the common progress type
+func (r *bflResult) toPrediction(id string) *Prediction {
+	p := &Prediction{ID: id}
+	switch r.Status {
+	case "Ready":
+		p.Status = StatusSucceeded
+	case "Pending", "Queued", "Processing":
+		p.Status = StatusProcessing
+	default:
+		p.Status = StatusFailed
+	}
+	if r.Progress != nil {
+		p.Logs = fmt.Sprintf("%.0f%%", *r.Progress*100)
+	}
+	return p
+}
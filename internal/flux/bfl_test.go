@@ -0,0 +1,334 @@
+package flux
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bflSubmit is a task submitted to bflServer
+type bflSubmit struct {
+	path string
+	key  string
+	body map[string]interface{}
+}
+
+// bflServer fakes the BFL API: tasks are submitted to any /v1 path and
+// polled at their polling_url until they are ready
+type bflServer struct {
+	*httptest.Server
+
+	// PollsUntilReady is how many polls report Pending before Ready
+	PollsUntilReady int
+	// FailWith, if set, is the final status instead of Ready
+	FailWith string
+	// Sample is served for every /samples/ URL
+	Sample []byte
+	// NoPollingURL leaves polling_url out, as older API versions did
+	NoPollingURL bool
+
+	mu      sync.Mutex
+	submits []bflSubmit
+	polls   map[string]int
+}
+
+func newBFLServer() *bflServer {
+	s := &bflServer{polls: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Submits returns the tasks submitted so far
+func (s *bflServer) Submits() []bflSubmit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]bflSubmit(nil), s.submits...)
+}
+
+func (s *bflServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost:
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.submits = append(s.submits, bflSubmit{path: r.URL.Path, key: r.Header.Get("x-key"), body: body})
+		id := fmt.Sprintf("task-%d", len(s.submits))
+		task := map[string]string{"id": id, "polling_url": s.URL + "/v1/get_result?id=" + id}
+		if s.NoPollingURL {
+			delete(task, "polling_url")
+		}
+		writeJSON(w, task)
+
+	case r.URL.Path == "/v1/get_result":
+		id := r.URL.Query().Get("id")
+		s.polls[id]++
+		switch {
+		case s.polls[id] <= s.PollsUntilReady:
+			writeJSON(w, map[string]interface{}{"id": id, "status": "Pending", "progress": 0.5})
+		case s.FailWith != "":
+			writeJSON(w, map[string]interface{}{"id": id, "status": s.FailWith})
+		default:
+			writeJSON(w, map[string]interface{}{"id": id, "status": "Ready", "result": map[string]interface{}{
+				"sample": s.URL + "/samples/" + id + ".png",
+				"seed":   7,
+			}})
+		}
+
+	case strings.HasPrefix(r.URL.Path, "/samples/"):
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(s.Sample)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// newBFLTestClient returns a client for the server's flux-dev endpoint that
+// polls quickly
+func newBFLTestClient(t *testing.T, server *bflServer) *BFLClient {
+	t.Helper()
+
+	cfg := testConfig(server.URL+"/v1/flux-dev", ModeAuto)
+	cfg.APIKey = "key"
+	client, err := NewBFLClient(cfg)
+	if err != nil {
+		t.Fatalf("NewBFLClient: %v", err)
+	}
+	client.pollInterval = time.Millisecond
+	client.maxPollInterval = 5 * time.Millisecond
+	return client
+}
+
+func TestBFLRejectsUnsupportedOptions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected %s %s", r.Method, r.URL)
+		http.Error(w, "unexpected", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	cfg := testConfig(server.URL, ModeAuto)
+	cfg.APIKey = "key"
+	client, err := NewBFLClient(cfg)
+	if err != nil {
+		t.Fatalf("NewBFLClient: %v", err)
+	}
+
+	goFast := true
+	tests := []struct {
+		name    string
+		opts    GenerateOptions
+		wantErr string
+	}{
+		{name: "go fast", opts: GenerateOptions{GoFast: &goFast}, wantErr: "does not support go fast"},
+		{name: "megapixels", opts: GenerateOptions{Megapixels: "1"}, wantErr: "does not support megapixels"},
+		{name: "negative prompt", opts: GenerateOptions{NegativePrompt: "blurry"}, wantErr: "does not support a negative prompt"},
+		{name: "several", opts: GenerateOptions{GoFast: &goFast, NegativePrompt: "blurry"}, wantErr: "does not support go fast, a negative prompt"},
+		{name: "schnell", opts: GenerateOptions{Model: "schnell"}, wantErr: "does not support the schnell model"},
+		{name: "model for inpainting", opts: GenerateOptions{Model: "dev", Image: "data:image/png;base64,AA==", Mask: "data:image/png;base64,AA=="}, wantErr: "does not support choosing a model for inpainting"},
+		{name: "loras", opts: GenerateOptions{LoRAs: []LoRA{{Weights: "owner/model", Scale: 1}}}, wantErr: errLoRAsUnsupported.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.NumOutputs = 1
+			_, err := client.GenerateImagesContext(context.Background(), "a lighthouse", tt.opts)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBFLInpaintingUsesFillEndpoint(t *testing.T) {
+	server := newBFLServer()
+	defer server.Close()
+
+	pngData := testPNG(t)
+	image := "data:image/png;base64," + base64.StdEncoding.EncodeToString(pngData)
+	mask := "data:image/png;base64," + base64.StdEncoding.EncodeToString(append(pngData, 0))
+
+	images, err := newBFLTestClient(t, server).GenerateImagesContext(context.Background(), "a red door", GenerateOptions{
+		NumOutputs: 1,
+		Image:      image,
+		Mask:       mask,
+	})
+	if err != nil {
+		t.Fatalf("GenerateImagesContext: %v", err)
+	}
+	if len(images) != 1 {
+		t.Fatalf("got %d images, want 1", len(images))
+	}
+
+	submits := server.Submits()
+	if len(submits) != 1 {
+		t.Fatalf("got %d submits, want 1", len(submits))
+	}
+	got := submits[0]
+	if got.path != bflFillPath {
+		t.Errorf("masked request went to %s, want %s", got.path, bflFillPath)
+	}
+	if got.body["image"] != stripDataURI(image) || got.body["mask"] != stripDataURI(mask) {
+		t.Error("the fill request does not carry the image and mask as raw base64")
+	}
+	for _, field := range []string{"width", "height", "image_prompt"} {
+		if _, ok := got.body[field]; ok {
+			t.Errorf("the fill request sets %s", field)
+		}
+	}
+}
+
+func TestBFLDownloadsRemoteInput(t *testing.T) {
+	server := newBFLServer()
+	defer server.Close()
+	server.Sample = testPNG(t)
+
+	// An earlier result, used as the input, is a URL on the delivery host
+	strength := 0.75
+	_, err := newBFLTestClient(t, server).GenerateImagesContext(context.Background(), "at night", GenerateOptions{
+		NumOutputs:     1,
+		Image:          server.URL + "/samples/earlier.png",
+		PromptStrength: &strength,
+	})
+	if err != nil {
+		t.Fatalf("GenerateImagesContext: %v", err)
+	}
+
+	got := server.Submits()[0]
+	if got.path != "/v1/flux-dev" {
+		t.Errorf("request went to %s, want the configured endpoint", got.path)
+	}
+	if got.body["image_prompt"] != base64.StdEncoding.EncodeToString(server.Sample) {
+		t.Errorf("image_prompt = %.40v, want the downloaded image as base64", got.body["image_prompt"])
+	}
+	if got.body["image_prompt_strength"] != 0.25 {
+		t.Errorf("image_prompt_strength = %v, want the inverted prompt strength", got.body["image_prompt_strength"])
+	}
+}
+
+func TestBFLModelEndpoints(t *testing.T) {
+	server := newBFLServer()
+	defer server.Close()
+	client := newBFLTestClient(t, server)
+
+	// The configured endpoint serves requests without a model
+	for _, model := range []string{"", "pro", "Dev"} {
+		if _, err := client.GenerateImagesContext(context.Background(), "a lighthouse", GenerateOptions{NumOutputs: 1, Model: model}); err != nil {
+			t.Fatalf("model %q: %v", model, err)
+		}
+	}
+
+	var paths []string
+	for _, submit := range server.Submits() {
+		paths = append(paths, submit.path)
+	}
+	if want := []string{"/v1/flux-dev", "/v1/flux-pro", "/v1/flux-dev"}; !slices.Equal(paths, want) {
+		t.Errorf("paths = %v, want %v", paths, want)
+	}
+}
+
+func TestBFLGenerate(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		server := newBFLServer()
+		server.PollsUntilReady = 2
+		server.NoPollingURL = legacy
+
+		var (
+			mu       sync.Mutex
+			statuses []PredictionStatus
+			logs     []string
+		)
+		seed, steps := 5, 30
+		images, err := newBFLTestClient(t, server).GenerateImagesContext(context.Background(), "a lighthouse", GenerateOptions{
+			NumOutputs:        2,
+			AspectRatio:       "16:9",
+			Seed:              &seed,
+			NumInferenceSteps: &steps,
+			OutputFormat:      "webp",
+			OnProgress: func(p *Prediction) {
+				mu.Lock()
+				defer mu.Unlock()
+				statuses = append(statuses, p.Status)
+				logs = append(logs, p.Logs)
+			},
+		})
+		server.Close()
+		if err != nil {
+			t.Fatalf("legacy %v: GenerateImagesContext: %v", legacy, err)
+		}
+
+		// One task is submitted per image
+		submits := server.Submits()
+		if len(submits) != 2 || len(images) != 2 {
+			t.Fatalf("legacy %v: %d submits and %d images, want 2 of each", legacy, len(submits), len(images))
+		}
+		for _, submit := range submits {
+			body := submit.body
+			if submit.key != "key" {
+				t.Errorf("x-key = %q, want the API key", submit.key)
+			}
+			if body["prompt"] != "a lighthouse" || body["seed"] != 5.0 || body["steps"] != 30.0 {
+				t.Errorf("body = %v, want the prompt, seed and steps", body)
+			}
+			if width, height := body["width"].(float64), body["height"].(float64); width <= height || int(width)%32 != 0 || int(height)%32 != 0 {
+				t.Errorf("size = %vx%v, want 16:9 in multiples of 32", width, height)
+			}
+			// BFL has no webp output
+			if _, ok := body["output_format"]; ok {
+				t.Errorf("output_format = %v, want it left out", body["output_format"])
+			}
+		}
+
+		var ids []string
+		for _, img := range images {
+			ids = append(ids, img.RequestID)
+			if img.URL != server.URL+"/samples/"+img.RequestID+".png" {
+				t.Errorf("URL = %s, want the task's sample", img.URL)
+			}
+			if img.Seed == nil || *img.Seed != 7 || len(img.Metadata) == 0 {
+				t.Errorf("image details = %v %d bytes, want the result's seed and metadata", img.Seed, len(img.Metadata))
+			}
+			if img.Options.Width == 0 || img.Options.OnProgress != nil {
+				t.Errorf("Options = %+v, want the resolved size without OnProgress", img.Options)
+			}
+		}
+		slices.Sort(ids)
+		if !slices.Equal(ids, []string{"task-1", "task-2"}) {
+			t.Errorf("request IDs = %v, want one task per image", ids)
+		}
+
+		mu.Lock()
+		if len(statuses) != 6 || statuses[5] != StatusSucceeded || !slices.Contains(logs, "50%") {
+			t.Errorf("progress = %v %q, want two polls pending at 50%% and one ready per task", statuses, logs)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestBFLTaskFailed(t *testing.T) {
+	server := newBFLServer()
+	defer server.Close()
+	server.FailWith = "Content Moderated"
+
+	_, err := newBFLTestClient(t, server).GenerateImagesContext(context.Background(), "a lighthouse", GenerateOptions{NumOutputs: 1})
+	if err == nil || !strings.Contains(err.Error(), "task task-1 failed: Content Moderated") {
+		t.Errorf("err = %v, want the task to fail", err)
+	}
+}
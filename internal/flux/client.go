@@ -6,35 +6,84 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"time"
+
+	"fluxxxer/internal/httpx"
 )
 
 // Config interface to avoid import cycle
 type Config interface {
+	httpx.TransportConfig
+
 	GetAPIEndpoint() string
 	GetDefaultNumOutputs() int
 	GetDefaultAspectRatio() string
+	GetSupportedAspectRatios() []string
 	GetDefaultFormat() string
 	GetDefaultQuality() int
+	GetDefaultModel() string
 	GetDisableSafetyCheck() bool
+	GetRequestTimeout() time.Duration
+	GetAPIMode() string
+	GetBackend() string
+	GetAPIKey() string
+	GetAuthScheme() string
+	GetAPIKeyHeader() string
+	GetAPIHeaders() map[string]string
+	GetComfyUIWorkflow() string
+	GetRetryMaxAttempts() int
+	GetRetryBudget() time.Duration
 }
 
+// API modes describing how the endpoint delivers results
+const (
+	// ModeAuto detects the protocol from the shape of the first response
+	ModeAuto = "auto"
+	// ModeSync expects the endpoint to block and return a JSON array of URLs
+	ModeSync = "sync"
+	// ModePrediction expects a prediction object that is polled until done
+	ModePrediction = "prediction"
+)
+
 // Client manages API communication with the Flux service
 type Client struct {
-	apiURL     string
-	httpClient *http.Client
-	config     Config
+	apiURL          string
+	mode            string
+	httpClient      *http.Client
+	retry           httpx.RetryPolicy
+	config          Config
+	pollInterval    time.Duration
+	maxPollInterval time.Duration
+
+	// clientErr reports invalid auth or transport settings on the first
+	// request
+	clientErr error
 }
 
 // NewClient creates a new Flux API client
 func NewClient(config Config) *Client {
+	mode := config.GetAPIMode()
+	if mode == "" {
+		mode = ModeAuto
+	}
+
+	httpClient, clientErr := newAPIClient(config, true)
+	if clientErr != nil {
+		httpClient = &http.Client{}
+	}
+
 	return &Client{
-		apiURL: config.GetAPIEndpoint(),
-		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
-		},
-		config: config,
+		apiURL:          config.GetAPIEndpoint(),
+		mode:            mode,
+		httpClient:      httpClient,
+		clientErr:       clientErr,
+		retry:           httpx.NewRetryPolicy(config.GetRetryMaxAttempts(), config.GetRetryBudget()),
+		config:          config,
+		pollInterval:    500 * time.Millisecond,
+		maxPollInterval: 5 * time.Second,
 	}
 }
 
@@ -45,20 +94,63 @@ type GenerateOptions struct {
 	OutputFormat string
 	Quality      int
 	Seed         *int
+
+	// Width and Height request an explicit size instead of AspectRatio; both
+	// must be multiples of DimensionStep
+	Width  int
+	Height int
+
+	// Model selects the Flux variant (see Models); empty uses the endpoint's
+	// own model. The sampling parameters below are only sent when set.
+	Model             string
+	NumInferenceSteps *int
+	Guidance          *float64
+	GoFast            *bool
+	// Megapixels is the approximate output size, one of MegapixelOptions
+	Megapixels     string
+	NegativePrompt string
+
+	// LoRAs are applied on top of the model, in order
+	LoRAs []LoRA
+
+	// Image is an optional input image for image-to-image generation: a URL,
+	// a data URI or a local file path, which is uploaded inline as base64
+	Image string
+	// PromptStrength is how far to move away from Image, from 0 (keep the
+	// input) to 1 (ignore it)
+	PromptStrength *float64
+	// Mask is an optional inpainting mask in the same forms as Image. White
+	// areas are regenerated, black areas are kept from Image.
+	Mask string
+
+	// OnProgress, if set, is called with every prediction state observed
+	// while polling an asynchronous endpoint
+	OnProgress func(*Prediction)
 }
 
 // GenerateImages creates images based on the provided prompt
-func (c *Client) GenerateImages(prompt string) ([]string, error) {
+func (c *Client) GenerateImages(prompt string) ([]Image, error) {
 	return c.GenerateImagesWithOptions(prompt, GenerateOptions{
 		NumOutputs:   c.config.GetDefaultNumOutputs(),
 		AspectRatio:  c.config.GetDefaultAspectRatio(),
 		OutputFormat: c.config.GetDefaultFormat(),
 		Quality:      c.config.GetDefaultQuality(),
+		Model:        c.config.GetDefaultModel(),
 	})
 }
 
-// GenerateImagesWithOptions creates images with custom options
-func (c *Client) GenerateImagesWithOptions(prompt string, opts GenerateOptions) ([]string, error) {
+// GenerateImagesWithOptions creates images with custom options, bounded by the
+// configured request timeout
+func (c *Client) GenerateImagesWithOptions(prompt string, opts GenerateOptions) ([]Image, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.GetRequestTimeout())
+	defer cancel()
+
+	return c.GenerateImagesContext(ctx, prompt, opts)
+}
+
+// GenerateImagesContext creates images with custom options. The request is
+// aborted when ctx is cancelled or its deadline expires.
+func (c *Client) GenerateImagesContext(ctx context.Context, prompt string, opts GenerateOptions) ([]Image, error) {
 	if prompt == "" {
 		return nil, errors.New("prompt cannot be empty")
 	}
@@ -67,45 +159,130 @@ func (c *Client) GenerateImagesWithOptions(prompt string, opts GenerateOptions)
 		return nil, errors.New("API URL not configured")
 	}
 
+	if c.clientErr != nil {
+		return nil, c.clientErr
+	}
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	image, err := resolveImage(opts.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	mask, err := resolveImage(opts.Mask)
+	if err != nil {
+		return nil, err
+	}
+
+	aspectRatio, width, height, err := requestSize(opts, c.config.GetSupportedAspectRatios())
+	if err != nil {
+		return nil, err
+	}
+
 	input := Input{
 		Prompt:             prompt,
 		NumOutputs:         opts.NumOutputs,
-		AspectRatio:        opts.AspectRatio,
+		AspectRatio:        aspectRatio,
+		Width:              width,
+		Height:             height,
 		OutputFormat:       opts.OutputFormat,
 		OutputQuality:      opts.Quality,
 		DisableSafetyCheck: c.config.GetDisableSafetyCheck(),
 		Seed:               opts.Seed,
+		Model:              opts.Model,
+		NumInferenceSteps:  opts.NumInferenceSteps,
+		Guidance:           opts.Guidance,
+		GoFast:             opts.GoFast,
+		Megapixels:         opts.Megapixels,
+		NegativePrompt:     opts.NegativePrompt,
+		Image:              image,
+		Mask:               mask,
+	}
+	if image != "" {
+		input.PromptStrength = opts.PromptStrength
+	}
+	if err := applyLoRAs(&input, opts.LoRAs); err != nil {
+		return nil, err
 	}
 
+	resolved := opts
+	resolved.AspectRatio, resolved.Width, resolved.Height = aspectRatio, width, height
+	base := Image{Prompt: prompt, Seed: opts.Seed, Options: resolved}
+
 	payload := map[string]interface{}{"input": input}
 	jsonData, err := json.Marshal(payload)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.apiURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	slog.Debug("Sending generation request", "url", c.apiURL, "mode", c.mode, "outputs", opts.NumOutputs, "model", opts.Model)
+
+	start := time.Now()
+	resp, err := c.retry.ForCreate().Do(c.httpClient, req)
 	if err != nil {
 		return nil, fmt.Errorf("request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API returned non-200 status code: %d", resp.StatusCode)
+	// Prediction-style endpoints answer with 201 Created or 202 Accepted
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusAccepted {
+		return nil, httpx.NewAPIError(resp)
 	}
 
-	var urls []string
-	if err := json.NewDecoder(resp.Body).Decode(&urls); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
 
-	return urls, nil
+	// A JSON object with an id means the endpoint handed back a prediction
+	// to poll; other objects are results such as {"output": [...]}
+	trimmed := bytes.TrimSpace(body)
+	if c.mode != ModeSync && len(trimmed) > 0 && trimmed[0] == '{' {
+		var prediction Prediction
+		if err := json.Unmarshal(trimmed, &prediction); err != nil {
+			return nil, fmt.Errorf("failed to decode prediction: %w", err)
+		}
+		if prediction.ID != "" {
+			prediction.Raw = trimmed
+			final, err := c.awaitPrediction(ctx, &prediction, opts.OnProgress)
+			if err != nil {
+				return nil, err
+			}
+			urls, err := final.OutputURLs()
+			if err != nil {
+				return nil, err
+			}
+			base.RequestID = final.ID
+			base.Latency = time.Since(start)
+			base.Metadata = metadata(final.Raw)
+			base.Seed = findSeed(opts.Seed, final.Logs, string(base.Metadata))
+			return newImages(urls, base), nil
+		}
+		if c.mode == ModePrediction {
+			return nil, errors.New("prediction response has no id")
+		}
+	}
+
+	if c.mode == ModePrediction {
+		return nil, errors.New("expected a prediction object from the API")
+	}
+
+	urls, err := decodeResponse(resp.Header.Get("Content-Type"), body)
+	if err != nil {
+		return nil, err
+	}
+	base.RequestID = httpx.RequestID(resp.Header)
+	base.Latency = time.Since(start)
+	base.Metadata = metadata(trimmed)
+	base.Seed = findSeed(opts.Seed, string(base.Metadata))
+	return newImages(urls, base), nil
 }
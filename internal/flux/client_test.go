@@ -0,0 +1,248 @@
+package flux
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"fluxxxer/internal/config"
+	"fluxxxer/internal/flux/fluxtest"
+)
+
+// testConfig returns a configuration for a client of the endpoint at url
+func testConfig(url, mode string) *config.Config {
+	return &config.Config{
+		APIEndpoint:        url,
+		APIMode:            mode,
+		Backend:            DefaultBackend,
+		DefaultNumOutputs:  1,
+		DefaultAspectRatio: "1:1",
+		AspectRatios:       []string{"1:1", "4:3", "3:4", "16:9", "9:16"},
+		DefaultFormat:      "png",
+		DefaultQuality:     1,
+		RequestTimeout:     10 * time.Second,
+		RetryMaxAttempts:   1,
+	}
+}
+
+// newTestClient returns a client for the endpoint at url that polls quickly
+func newTestClient(url, mode string) *Client {
+	c := NewClient(testConfig(url, mode))
+	c.pollInterval = time.Millisecond
+	c.maxPollInterval = 5 * time.Millisecond
+	return c
+}
+
+func TestGenerateImagesModes(t *testing.T) {
+	tests := []struct {
+		name      string
+		sync      bool
+		mode      string
+		requestID string
+		wantErr   string
+	}{
+		{name: "auto detects a prediction", mode: ModeAuto, requestID: "pred-1"},
+		{name: "auto detects a sync response", sync: true, mode: ModeAuto, requestID: "pred-1"},
+		{name: "prediction", mode: ModePrediction, requestID: "pred-1"},
+		{name: "sync", sync: true, mode: ModeSync, requestID: "pred-1"},
+		{name: "prediction mode rejects a sync response", sync: true, mode: ModePrediction, wantErr: "expected a prediction object"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var server *fluxtest.Server
+			if tt.sync {
+				server = fluxtest.NewSyncServer()
+			} else {
+				server = fluxtest.NewPredictionServer()
+			}
+			defer server.Close()
+
+			seed := 42
+			images, err := newTestClient(server.URL, tt.mode).GenerateImagesContext(context.Background(), "a lighthouse", GenerateOptions{
+				NumOutputs:  2,
+				AspectRatio: "16:9",
+				Seed:        &seed,
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GenerateImagesContext: %v", err)
+			}
+
+			if len(images) != 2 {
+				t.Fatalf("got %d images, want 2", len(images))
+			}
+			for _, img := range images {
+				if !strings.HasPrefix(img.URL, server.URL+"/images/") {
+					t.Errorf("URL = %q, want an image on the server", img.URL)
+				}
+				if img.RequestID != tt.requestID {
+					t.Errorf("RequestID = %q, want %q", img.RequestID, tt.requestID)
+				}
+				if img.Seed == nil || *img.Seed != seed {
+					t.Errorf("Seed = %v, want %d", img.Seed, seed)
+				}
+				if img.Prompt != "a lighthouse" || img.Options.AspectRatio != "16:9" {
+					t.Errorf("details = %q %q, want the request's", img.Prompt, img.Options.AspectRatio)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateImagesPollsUntilSucceeded(t *testing.T) {
+	server := fluxtest.NewPredictionServer()
+	defer server.Close()
+	server.PollsUntilDone = 3
+
+	var statuses []PredictionStatus
+	images, err := newTestClient(server.URL, ModePrediction).GenerateImagesContext(context.Background(), "a lighthouse", GenerateOptions{
+		NumOutputs: 1,
+		OnProgress: func(p *Prediction) {
+			statuses = append(statuses, p.Status)
+		},
+	})
+	if err != nil {
+		t.Fatalf("GenerateImagesContext: %v", err)
+	}
+	if len(images) != 1 {
+		t.Fatalf("got %d images, want 1", len(images))
+	}
+
+	want := []PredictionStatus{StatusStarting, StatusProcessing, StatusProcessing, StatusProcessing, StatusSucceeded}
+	if !slices.Equal(statuses, want) {
+		t.Errorf("statuses = %v, want %v", statuses, want)
+	}
+	if images[0].Seed == nil {
+		t.Error("Seed = nil, want the seed from the prediction logs")
+	}
+	if images[0].Options.OnProgress != nil {
+		t.Error("OnProgress kept on the image, want it cleared")
+	}
+}
+
+func TestGenerateImagesPredictionFailed(t *testing.T) {
+	server := fluxtest.NewPredictionServer()
+	defer server.Close()
+	server.FailWith = "NSFW content detected"
+
+	_, err := newTestClient(server.URL, ModeAuto).GenerateImagesContext(context.Background(), "a lighthouse", GenerateOptions{NumOutputs: 1})
+	if err == nil || !strings.Contains(err.Error(), "prediction pred-1 failed: NSFW content detected") {
+		t.Fatalf("err = %v, want the provider error", err)
+	}
+}
+
+func TestGenerateImagesCancelCallsCancelEndpoint(t *testing.T) {
+	server := fluxtest.NewPredictionServer()
+	defer server.Close()
+	server.PollsUntilDone = 1000
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := newTestClient(server.URL, ModePrediction).GenerateImagesContext(ctx, "a lighthouse", GenerateOptions{
+		NumOutputs: 1,
+		OnProgress: func(p *Prediction) {
+			if p.Status == StatusProcessing {
+				cancel()
+			}
+		},
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+
+	status, ok := server.Prediction("pred-1")
+	if !ok || status != string(StatusCanceled) {
+		t.Errorf("server status = %q, want %q", status, StatusCanceled)
+	}
+}
+
+func TestGenerateImagesPredictionWithoutID(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"starting"}`))
+	}))
+	defer server.Close()
+
+	_, err := newTestClient(server.URL, ModePrediction).GenerateImagesContext(context.Background(), "a lighthouse", GenerateOptions{NumOutputs: 1})
+	if err == nil || !strings.Contains(err.Error(), "prediction response has no id") {
+		t.Fatalf("err = %v, want a missing id error", err)
+	}
+}
+
+func TestPredictionMapping(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantURLs []string
+		urlsErr  bool
+		wantErr  string
+		wantLog  string
+	}{
+		{
+			name:     "string output",
+			body:     `{"id":"p","status":"succeeded","output":"https://cdn/a.png"}`,
+			wantURLs: []string{"https://cdn/a.png"},
+		},
+		{
+			name:     "list output",
+			body:     `{"id":"p","status":"succeeded","output":["https://cdn/a.png","https://cdn/b.png"]}`,
+			wantURLs: []string{"https://cdn/a.png", "https://cdn/b.png"},
+		},
+		{
+			name:    "null output",
+			body:    `{"id":"p","status":"failed","output":null,"error":"out of memory"}`,
+			urlsErr: true,
+			wantErr: "out of memory",
+		},
+		{
+			name:    "object error",
+			body:    `{"id":"p","status":"failed","error":{"code":"oom"}}`,
+			urlsErr: true,
+			wantErr: `{"code":"oom"}`,
+		},
+		{
+			name:    "logs",
+			body:    `{"id":"p","status":"processing","logs":"Using seed: 1\nstep 1/4\nstep 2/4\n"}`,
+			urlsErr: true,
+			wantLog: "step 2/4",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p Prediction
+			if err := json.Unmarshal([]byte(tt.body), &p); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+
+			urls, err := p.OutputURLs()
+			if tt.urlsErr != (err != nil) {
+				t.Fatalf("OutputURLs err = %v, want error %v", err, tt.urlsErr)
+			}
+			if !slices.Equal(urls, tt.wantURLs) {
+				t.Errorf("OutputURLs = %v, want %v", urls, tt.wantURLs)
+			}
+			if got := p.ErrorMessage(); got != tt.wantErr {
+				t.Errorf("ErrorMessage = %q, want %q", got, tt.wantErr)
+			}
+			if tt.wantLog != "" {
+				if got := p.LastLogLine(); got != tt.wantLog {
+					t.Errorf("LastLogLine = %q, want %q", got, tt.wantLog)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,515 @@
+package flux
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"fluxxxer/internal/httpx"
+)
+
+func init() {
+	Register("comfyui", func(config Config) (Generator, error) {
+		return NewComfyUIClient(config)
+	})
+}
+
+// ComfyUIClient queues a workflow on a self-hosted ComfyUI server and
+// collects the images it produces
+type ComfyUIClient struct {
+	baseURL      string
+	workflow     []byte
+	httpClient   *http.Client
+	retry        httpx.RetryPolicy
+	config       Config
+	pollInterval time.Duration
+}
+
+// NewComfyUIClient creates a ComfyUI client. The workflow must be exported in
+// ComfyUI's API format; string values {{prompt}}, {{negative_prompt}},
+// {{seed}}, {{width}}, {{height}}, {{batch_size}}, {{steps}} and {{guidance}}
+// are replaced for every request. For image-to-image, {{image}} becomes the
+// uploaded input and {{denoise}} the prompt strength; for inpainting, {{mask}}
+// becomes the uploaded mask. LoRAs fill {{lora_1}} and {{lora_1_strength}},
+// {{lora_2}} and so on. The workflow decides the model; a selected model
+// only sets the default steps and guidance.
+func NewComfyUIClient(config Config) (*ComfyUIClient, error) {
+	if config.GetAPIEndpoint() == "" {
+		return nil, errors.New("API URL not configured")
+	}
+
+	path := config.GetComfyUIWorkflow()
+	if path == "" {
+		return nil, errors.New("the comfyui backend requires COMFYUI_WORKFLOW")
+	}
+	workflow, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read workflow: %w", err)
+	}
+	if !json.Valid(workflow) {
+		return nil, fmt.Errorf("workflow %s is not valid JSON", path)
+	}
+
+	// ComfyUI itself has no auth, but it is often behind a gateway that does
+	httpClient, err := newAPIClient(config, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ComfyUIClient{
+		baseURL:      strings.TrimSuffix(config.GetAPIEndpoint(), "/"),
+		workflow:     workflow,
+		httpClient:   httpClient,
+		retry:        httpx.NewRetryPolicy(config.GetRetryMaxAttempts(), config.GetRetryBudget()),
+		config:       config,
+		pollInterval: time.Second,
+	}, nil
+}
+
+// comfyImage identifies an output file on the ComfyUI server
+type comfyImage struct {
+	Filename  string `json:"filename"`
+	Subfolder string `json:"subfolder"`
+	Type      string `json:"type"`
+}
+
+// comfyHistory is one entry of the /history response
+type comfyHistory struct {
+	Outputs map[string]struct {
+		Images []comfyImage `json:"images"`
+	} `json:"outputs"`
+	Status struct {
+		StatusStr string `json:"status_str"`
+		Completed bool   `json:"completed"`
+	} `json:"status"`
+
+	// raw is the history entry the outputs were decoded from
+	raw []byte
+}
+
+// GenerateImagesContext queues the workflow and waits for its outputs
+func (c *ComfyUIClient) GenerateImagesContext(ctx context.Context, prompt string, opts GenerateOptions) ([]Image, error) {
+	if prompt == "" {
+		return nil, errors.New("prompt cannot be empty")
+	}
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	workflow, resolved, err := c.buildWorkflow(ctx, prompt, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"prompt":    workflow,
+		"client_id": "fluxxxer",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/prompt", bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	start := time.Now()
+	resp, err := c.retry.ForCreate().Do(c.httpClient, req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, httpx.NewAPIError(resp)
+	}
+
+	var queued struct {
+		PromptID string `json:"prompt_id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&queued); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if queued.PromptID == "" {
+		return nil, errors.New("response has no prompt id")
+	}
+	slog.Debug("ComfyUI prompt queued", "prompt_id", queued.PromptID, "seed", *resolved.Seed)
+
+	for {
+		if opts.OnProgress != nil {
+			opts.OnProgress(&Prediction{ID: queued.PromptID, Status: StatusProcessing})
+		}
+
+		if err := sleepContext(ctx, c.pollInterval); err != nil {
+			c.cancelPrompt(queued.PromptID)
+			return nil, fmt.Errorf("waiting for prompt %s: %w", queued.PromptID, err)
+		}
+
+		history, err := c.history(ctx, queued.PromptID)
+		if err != nil {
+			if ctx.Err() != nil {
+				c.cancelPrompt(queued.PromptID)
+			}
+			return nil, err
+		}
+		if history == nil {
+			continue
+		}
+
+		if history.Status.StatusStr == "error" {
+			return nil, fmt.Errorf("prompt %s failed", queued.PromptID)
+		}
+		if !history.Status.Completed {
+			continue
+		}
+
+		urls := c.imageURLs(history)
+		if len(urls) == 0 {
+			return nil, fmt.Errorf("prompt %s produced no images", queued.PromptID)
+		}
+		if opts.OnProgress != nil {
+			opts.OnProgress(&Prediction{ID: queued.PromptID, Status: StatusSucceeded})
+		}
+		return newImages(urls, Image{
+			Prompt:    prompt,
+			Seed:      resolved.Seed,
+			Options:   resolved,
+			RequestID: queued.PromptID,
+			Latency:   time.Since(start),
+			Metadata:  metadata(history.raw),
+		}), nil
+	}
+}
+
+// buildWorkflow substitutes the request parameters into the workflow template.
+// It also returns opts with the size, seed, steps and guidance it used.
+func (c *ComfyUIClient) buildWorkflow(ctx context.Context, prompt string, opts GenerateOptions) (interface{}, GenerateOptions, error) {
+	var workflow interface{}
+	if err := json.Unmarshal(c.workflow, &workflow); err != nil {
+		return nil, opts, fmt.Errorf("failed to parse workflow: %w", err)
+	}
+
+	width, height, err := pixelSize(opts, c.config.GetDefaultAspectRatio(), DimensionStep)
+	if err != nil {
+		return nil, opts, err
+	}
+
+	seed := int(rand.Int63n(1 << 32))
+	if opts.Seed != nil {
+		seed = *opts.Seed
+	}
+
+	model, err := ModelDefaults(opts.Model)
+	if err != nil {
+		return nil, opts, err
+	}
+	steps := model.DefaultSteps
+	if opts.NumInferenceSteps != nil {
+		steps = *opts.NumInferenceSteps
+	}
+	guidance := model.DefaultGuidance
+	if opts.Guidance != nil {
+		guidance = *opts.Guidance
+	}
+
+	resolved := opts
+	resolved.OnProgress = nil
+	resolved.Width, resolved.Height = width, height
+	resolved.Seed = &seed
+	resolved.NumInferenceSteps = &steps
+	if model.SupportsGuidance() {
+		resolved.Guidance = &guidance
+	}
+
+	values := map[string]interface{}{
+		"{{negative_prompt}}": opts.NegativePrompt,
+		"{{seed}}":            seed,
+		"{{width}}":           width,
+		"{{height}}":          height,
+		"{{batch_size}}":      max(opts.NumOutputs, 1),
+		"{{steps}}":           steps,
+		"{{guidance}}":        guidance,
+	}
+
+	for i, l := range opts.LoRAs {
+		values[fmt.Sprintf("{{lora_%d}}", i+1)] = l.Weights
+		values[fmt.Sprintf("{{lora_%d_strength}}", i+1)] = l.Scale
+	}
+
+	if opts.Image != "" {
+		name, err := c.uploadImage(ctx, opts.Image, "fluxxxer-input")
+		if err != nil {
+			return nil, opts, err
+		}
+		denoise := 0.8
+		if opts.PromptStrength != nil {
+			denoise = *opts.PromptStrength
+		}
+		values["{{image}}"] = name
+		values["{{denoise}}"] = denoise
+		resolved.PromptStrength = &denoise
+	}
+
+	if opts.Mask != "" {
+		name, err := c.uploadImage(ctx, opts.Mask, "fluxxxer-mask")
+		if err != nil {
+			return nil, opts, err
+		}
+		values["{{mask}}"] = name
+	}
+
+	return substitute(workflow, prompt, values), resolved, nil
+}
+
+// substitute walks the decoded workflow and replaces placeholders. Whole-value
+// placeholders become numbers; {{prompt}} is replaced inside any string.
+func substitute(v interface{}, prompt string, values map[string]interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = substitute(child, prompt, values)
+		}
+		return v
+	case []interface{}:
+		for i, child := range v {
+			v[i] = substitute(child, prompt, values)
+		}
+		return v
+	case string:
+		if value, ok := values[v]; ok {
+			return value
+		}
+		return strings.ReplaceAll(v, "{{prompt}}", prompt)
+	default:
+		return v
+	}
+}
+
+// uploadImage sends an image to ComfyUI and returns the name to use in a
+// LoadImage node. The name is prefix and a hash of the content, so runs
+// sharing a server never replace each other's inputs before they execute.
+func (c *ComfyUIClient) uploadImage(ctx context.Context, ref, prefix string) (string, error) {
+	data, err := readInputImage(ctx, c.httpClient, c.retry, ref)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	name := prefix + "-" + hex.EncodeToString(sum[:8]) + extensionFor(data)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("image", name)
+	if err != nil {
+		return "", fmt.Errorf("failed to create form file: %w", err)
+	}
+	if _, err := part.Write(data); err != nil {
+		return "", fmt.Errorf("failed to write image data: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return "", fmt.Errorf("failed to close multipart writer: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/upload/image", body)
+	if err != nil {
+		return "", fmt.Errorf("failed to create upload request: %w", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := c.retry.Do(c.httpClient, req)
+	if err != nil {
+		return "", fmt.Errorf("upload failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("upload failed: %w", httpx.NewAPIError(resp))
+	}
+
+	// ComfyUI may rename the upload, for example when a different image
+	// already has the name
+	var uploaded struct {
+		Name      string `json:"name"`
+		Subfolder string `json:"subfolder"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&uploaded); err != nil {
+		return "", fmt.Errorf("failed to decode upload response: %w", err)
+	}
+	if uploaded.Name == "" {
+		return "", errors.New("upload response has no file name")
+	}
+	if uploaded.Subfolder != "" {
+		return uploaded.Subfolder + "/" + uploaded.Name, nil
+	}
+	return uploaded.Name, nil
+}
+
+// history fetches the history entry for a prompt. A nil entry means the
+// prompt has not finished yet.
+func (c *ComfyUIClient) history(ctx context.Context, promptID string) (*comfyHistory, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/history/"+url.PathEscape(promptID), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create poll request: %w", err)
+	}
+
+	resp, err := c.retry.Do(c.httpClient, req)
+	if err != nil {
+		return nil, fmt.Errorf("poll request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		io.Copy(io.Discard, resp.Body)
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("poll failed: %w", httpx.NewAPIError(resp))
+	}
+
+	var entries map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("failed to decode history: %w", err)
+	}
+
+	raw, ok := entries[promptID]
+	if !ok {
+		return nil, nil
+	}
+
+	var entry comfyHistory
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return nil, fmt.Errorf("failed to decode history: %w", err)
+	}
+	entry.raw = raw
+	return &entry, nil
+}
+
+// ImageClient implements ImageFetcher: the /view URLs are on the server,
+// behind the same gateway as the API
+func (c *ComfyUIClient) ImageClient() *http.Client {
+	return c.httpClient
+}
+
+// imageURLs lists the /view URLs for every image output, in node order
+func (c *ComfyUIClient) imageURLs(history *comfyHistory) []string {
+	nodes := make([]string, 0, len(history.Outputs))
+	for node := range history.Outputs {
+		nodes = append(nodes, node)
+	}
+	// Node IDs are numbers, so order them by length before text
+	sort.Slice(nodes, func(i, j int) bool {
+		if len(nodes[i]) != len(nodes[j]) {
+			return len(nodes[i]) < len(nodes[j])
+		}
+		return nodes[i] < nodes[j]
+	})
+
+	var urls []string
+	for _, node := range nodes {
+		for _, img := range history.Outputs[node].Images {
+			// Skip previews and other temporary outputs
+			if img.Type != "" && img.Type != "output" {
+				continue
+			}
+			query := url.Values{
+				"filename":  {img.Filename},
+				"subfolder": {img.Subfolder},
+				"type":      {img.Type},
+			}
+			urls = append(urls, c.baseURL+"/view?"+query.Encode())
+		}
+	}
+	return urls
+}
+
+// cancelPrompt removes a prompt from the queue, and interrupts it if it is
+// already executing. Other users' jobs on a shared server are left alone.
+// It is best effort.
+func (c *ComfyUIClient) cancelPrompt(promptID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	running, err := c.promptRunning(ctx, promptID)
+	if err != nil {
+		slog.Debug("Failed to read the ComfyUI queue", "prompt_id", promptID, "error", err)
+		return
+	}
+
+	if running {
+		// Servers that know the prompt_id field only stop this prompt, in
+		// case it finished since the queue was read
+		c.post(ctx, "/interrupt", map[string]string{"prompt_id": promptID})
+		return
+	}
+	c.post(ctx, "/queue", map[string][]string{"delete": {promptID}})
+}
+
+// promptRunning reports whether the queue shows the prompt executing
+func (c *ComfyUIClient) promptRunning(ctx context.Context, promptID string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/queue", nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, httpx.NewAPIError(resp)
+	}
+
+	// Queue entries are [number, prompt_id, prompt, extra_data, outputs]
+	var queue struct {
+		Running [][]json.RawMessage `json:"queue_running"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&queue); err != nil {
+		return false, fmt.Errorf("failed to decode queue: %w", err)
+	}
+	for _, entry := range queue.Running {
+		var id string
+		if len(entry) > 1 && json.Unmarshal(entry[1], &id) == nil && id == promptID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// post sends a JSON body to a ComfyUI endpoint, ignoring the response
+func (c *ComfyUIClient) post(ctx context.Context, path string, body interface{}) {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(jsonData))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
@@ -0,0 +1,333 @@
+package flux
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWorkflow uses every placeholder of the workflow template
+const testWorkflow = `{
+	"3": {"class_type": "KSampler", "inputs": {"seed": "{{seed}}", "steps": "{{steps}}", "cfg": "{{guidance}}", "denoise": "{{denoise}}"}},
+	"5": {"class_type": "EmptyLatentImage", "inputs": {"width": "{{width}}", "height": "{{height}}", "batch_size": "{{batch_size}}"}},
+	"6": {"class_type": "CLIPTextEncode", "inputs": {"text": "a photo of {{prompt}}, detailed"}},
+	"7": {"class_type": "CLIPTextEncode", "inputs": {"text": "{{negative_prompt}}"}},
+	"10": {"class_type": "LoadImage", "inputs": {"image": "{{image}}"}},
+	"11": {"class_type": "LoadImage", "inputs": {"image": "{{mask}}"}},
+	"12": {"class_type": "LoraLoader", "inputs": {"lora_name": "{{lora_1}}", "strength_model": "{{lora_1_strength}}"}}
+}`
+
+// comfyServer fakes a ComfyUI server: uploads, one queued prompt, its
+// history once it has been polled enough, the queue and /view
+type comfyServer struct {
+	*httptest.Server
+
+	// PollsUntilDone is how many history polls find nothing
+	PollsUntilDone int
+	// Status is the final status_str, "success" when empty
+	Status string
+	// Running reports the prompt as executing in the queue
+	Running bool
+
+	mu       sync.Mutex
+	uploads  []string
+	fields   []string
+	workflow map[string]map[string]interface{}
+	polls    int
+	posts    map[string]string
+}
+
+func newComfyServer() *comfyServer {
+	s := &comfyServer{posts: make(map[string]string)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *comfyServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/upload/image":
+		file, header, err := r.FormFile("image")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		file.Close()
+		s.uploads = append(s.uploads, header.Filename)
+		for name := range r.MultipartForm.Value {
+			s.fields = append(s.fields, name)
+		}
+		writeJSON(w, map[string]string{"name": header.Filename, "subfolder": "team", "type": "input"})
+
+	case r.Method == http.MethodPost && r.URL.Path == "/prompt":
+		var body struct {
+			Prompt map[string]map[string]interface{} `json:"prompt"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.workflow = body.Prompt
+		writeJSON(w, map[string]string{"prompt_id": "p-1"})
+
+	case r.URL.Path == "/history/p-1":
+		s.polls++
+		if s.polls <= s.PollsUntilDone {
+			writeJSON(w, map[string]interface{}{})
+			return
+		}
+		status := s.Status
+		if status == "" {
+			status = "success"
+		}
+		image := func(name, kind string) map[string]string {
+			return map[string]string{"filename": name, "subfolder": "", "type": kind}
+		}
+		writeJSON(w, map[string]interface{}{"p-1": map[string]interface{}{
+			"outputs": map[string]interface{}{
+				"9":  map[string]interface{}{"images": []interface{}{image("b_00001_.png", "output"), image("preview.png", "temp")}},
+				"13": map[string]interface{}{"images": []interface{}{image("a_00001_.png", "output")}},
+			},
+			"status": map[string]interface{}{"status_str": status, "completed": status == "success"},
+		}})
+
+	case r.Method == http.MethodGet && r.URL.Path == "/queue":
+		running := []interface{}{}
+		if s.Running {
+			running = append(running, []interface{}{0, "p-1", map[string]interface{}{}, map[string]interface{}{}, []string{"9"}})
+		}
+		// Another user's prompt waits behind this one
+		writeJSON(w, map[string]interface{}{
+			"queue_running": running,
+			"queue_pending": []interface{}{[]interface{}{1, "other", map[string]interface{}{}, map[string]interface{}{}, []string{"9"}}},
+		})
+
+	case r.Method == http.MethodPost:
+		body, _ := io.ReadAll(r.Body)
+		s.posts[r.URL.Path] = string(body)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newComfyTestClient returns a client for the server that polls quickly
+func newComfyTestClient(t *testing.T, server *comfyServer) *ComfyUIClient {
+	t.Helper()
+
+	workflow := filepath.Join(t.TempDir(), "workflow.json")
+	if err := os.WriteFile(workflow, []byte(testWorkflow), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(server.URL, "")
+	cfg.ComfyUIWorkflow = workflow
+	client, err := NewComfyUIClient(cfg)
+	if err != nil {
+		t.Fatalf("NewComfyUIClient: %v", err)
+	}
+	client.pollInterval = time.Millisecond
+	return client
+}
+
+func TestComfyUIGenerate(t *testing.T) {
+	server := newComfyServer()
+	defer server.Close()
+	server.PollsUntilDone = 2
+
+	pngData := testPNG(t)
+	seed, steps, strength := 42, 20, 0.6
+	var statuses []PredictionStatus
+	images, err := newComfyTestClient(t, server).GenerateImagesContext(context.Background(), "a lighthouse", GenerateOptions{
+		NumOutputs:        2,
+		Width:             512,
+		Height:            768,
+		Seed:              &seed,
+		Model:             "dev",
+		NumInferenceSteps: &steps,
+		NegativePrompt:    "blurry",
+		LoRAs:             []LoRA{{Weights: "detail.safetensors", Scale: 0.8}},
+		Image:             "data:image/png;base64," + base64.StdEncoding.EncodeToString(pngData),
+		PromptStrength:    &strength,
+		Mask:              "data:image/png;base64," + base64.StdEncoding.EncodeToString(append(pngData, 0)),
+		OnProgress: func(p *Prediction) {
+			statuses = append(statuses, p.Status)
+		},
+	})
+	if err != nil {
+		t.Fatalf("GenerateImagesContext: %v", err)
+	}
+
+	// Inputs are uploaded under names of their own, without replacing others
+	if len(server.uploads) != 2 || !strings.HasPrefix(server.uploads[0], "fluxxxer-input-") || !strings.HasPrefix(server.uploads[1], "fluxxxer-mask-") {
+		t.Fatalf("uploads = %v, want the input and the mask", server.uploads)
+	}
+	if server.uploads[0] == "fluxxxer-input-.png" || !strings.HasSuffix(server.uploads[0], ".png") {
+		t.Errorf("input uploaded as %s, want a content hash and the image's extension", server.uploads[0])
+	}
+	if slices.Contains(server.fields, "overwrite") {
+		t.Error("uploads ask to overwrite existing files")
+	}
+
+	inputs := func(node string) map[string]interface{} {
+		inputs, _ := server.workflow[node]["inputs"].(map[string]interface{})
+		return inputs
+	}
+	want := map[string]map[string]interface{}{
+		"3":  {"seed": 42.0, "steps": 20.0, "cfg": 3.0, "denoise": 0.6},
+		"5":  {"width": 512.0, "height": 768.0, "batch_size": 2.0},
+		"6":  {"text": "a photo of a lighthouse, detailed"},
+		"7":  {"text": "blurry"},
+		"10": {"image": "team/" + server.uploads[0]},
+		"11": {"image": "team/" + server.uploads[1]},
+		"12": {"lora_name": "detail.safetensors", "strength_model": 0.8},
+	}
+	for node, values := range want {
+		for name, value := range values {
+			if got := inputs(node)[name]; got != value {
+				t.Errorf("node %s input %s = %v, want %v", node, name, got, value)
+			}
+		}
+	}
+
+	// Outputs come in node order, without previews
+	var urls []string
+	for _, img := range images {
+		urls = append(urls, img.URL)
+		if img.RequestID != "p-1" || img.Seed == nil || *img.Seed != 42 || len(img.Metadata) == 0 {
+			t.Errorf("image details = %q %v %d bytes, want the prompt's", img.RequestID, img.Seed, len(img.Metadata))
+		}
+		if img.Options.Guidance == nil || *img.Options.Guidance != 3 {
+			t.Errorf("Guidance = %v, want the model default", img.Options.Guidance)
+		}
+	}
+	wantURLs := []string{
+		server.URL + "/view?filename=b_00001_.png&subfolder=&type=output",
+		server.URL + "/view?filename=a_00001_.png&subfolder=&type=output",
+	}
+	if !slices.Equal(urls, wantURLs) {
+		t.Errorf("URLs = %v, want %v", urls, wantURLs)
+	}
+
+	wantStatuses := []PredictionStatus{StatusProcessing, StatusProcessing, StatusProcessing, StatusSucceeded}
+	if !slices.Equal(statuses, wantStatuses) {
+		t.Errorf("statuses = %v, want %v", statuses, wantStatuses)
+	}
+}
+
+func TestComfyUIPromptFailed(t *testing.T) {
+	server := newComfyServer()
+	defer server.Close()
+	server.Status = "error"
+
+	_, err := newComfyTestClient(t, server).GenerateImagesContext(context.Background(), "a lighthouse", GenerateOptions{NumOutputs: 1})
+	if err == nil || !strings.Contains(err.Error(), "prompt p-1 failed") {
+		t.Errorf("err = %v, want the prompt to fail", err)
+	}
+}
+
+func TestComfyUICancel(t *testing.T) {
+	tests := []struct {
+		name     string
+		running  bool
+		wantPath string
+		wantBody string
+	}{
+		{name: "queued", wantPath: "/queue", wantBody: `{"delete":["p-1"]}`},
+		{name: "running", running: true, wantPath: "/interrupt", wantBody: `{"prompt_id":"p-1"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newComfyServer()
+			defer server.Close()
+			server.PollsUntilDone = 1 << 30
+			server.Running = tt.running
+
+			ctx, cancel := context.WithCancel(context.Background())
+			_, err := newComfyTestClient(t, server).GenerateImagesContext(ctx, "a lighthouse", GenerateOptions{
+				NumOutputs: 1,
+				OnProgress: func(*Prediction) { cancel() },
+			})
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("err = %v, want context.Canceled", err)
+			}
+
+			// Only this prompt is stopped, so other users' jobs keep running
+			server.mu.Lock()
+			defer server.mu.Unlock()
+			if len(server.posts) != 1 || server.posts[tt.wantPath] != tt.wantBody {
+				t.Errorf("posts = %v, want only %s %s", server.posts, tt.wantPath, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestComfyUIImageClientSendsHeaders(t *testing.T) {
+	type seen struct{ auth, gateway string }
+	record := func(got *seen) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			*got = seen{r.Header.Get("Authorization"), r.Header.Get("X-Gateway")}
+			w.Write([]byte("image"))
+		}
+	}
+
+	var server, other seen
+	comfy := httptest.NewServer(record(&server))
+	defer comfy.Close()
+	elsewhere := httptest.NewServer(record(&other))
+	defer elsewhere.Close()
+
+	workflow := filepath.Join(t.TempDir(), "workflow.json")
+	if err := os.WriteFile(workflow, []byte(`{}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(comfy.URL, "")
+	cfg.Backend = "comfyui"
+	cfg.ComfyUIWorkflow = workflow
+	cfg.APIKey = "secret"
+	cfg.APIHeaders = map[string]string{"X-Gateway": "team"}
+
+	gen, err := NewGenerator(cfg)
+	if err != nil {
+		t.Fatalf("NewGenerator: %v", err)
+	}
+	fetcher, ok := gen.(ImageFetcher)
+	if !ok {
+		t.Fatal("the comfyui backend does not fetch its own images")
+	}
+	client := fetcher.ImageClient()
+
+	// Results on the server get the auth and extra headers
+	fetch := func(url string) {
+		t.Helper()
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	fetch(comfy.URL + "/view?filename=out.png&type=output")
+	if server != (seen{"Bearer secret", "team"}) {
+		t.Errorf("the server saw %+v, want the auth and extra headers", server)
+	}
+
+	// Other hosts never see them
+	fetch(elsewhere.URL + "/input.png")
+	if other != (seen{}) {
+		t.Errorf("another host saw %+v, want no headers", other)
+	}
+}
@@ -0,0 +1,288 @@
+// Package fluxtest provides fake Flux endpoints for exercising the client
+// offline and for running the app without the real service.
+package fluxtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxImageSide caps the placeholder images the server renders
+const maxImageSide = 2048
+
+// Server is a fake Flux endpoint. In prediction mode it behaves like
+// Replicate: predictions are created by POSTing to the server root and
+// advance one state per poll. In sync mode the POST blocks and returns the
+// image URLs directly. Images are gradient placeholders sized from the
+// requested aspect ratio or dimensions.
+type Server struct {
+	*httptest.Server
+
+	sync bool
+
+	// PollsUntilDone is how many polls a prediction stays in processing
+	PollsUntilDone int
+	// FailWith, if set, makes every prediction fail with this message
+	FailWith string
+
+	mu          sync.Mutex
+	nextID      int
+	predictions map[string]*prediction
+}
+
+type prediction struct {
+	id         string
+	status     string
+	numOutputs int
+	width      int
+	height     int
+	polls      int
+	logs       string
+}
+
+// maxSeed bounds the seeds picked for requests that do not send one
+const maxSeed = 1 << 32
+
+// NewPredictionServer starts a fake prediction endpoint. Call Close when done.
+func NewPredictionServer() *Server {
+	return newServer(false)
+}
+
+// NewSyncServer starts a fake endpoint that answers every request with a
+// JSON array of image URLs. Call Close when done.
+func NewSyncServer() *Server {
+	return newServer(true)
+}
+
+func newServer(sync bool) *Server {
+	s := &Server{
+		sync:           sync,
+		PollsUntilDone: 2,
+		predictions:    make(map[string]*prediction),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /{$}", s.handleCreate)
+	mux.HandleFunc("GET /predictions/{id}", s.handleGet)
+	mux.HandleFunc("POST /predictions/{id}/cancel", s.handleCancel)
+	mux.HandleFunc("GET /images/{name}", s.handleImage)
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Prediction returns the current status of a prediction, for assertions
+func (s *Server) Prediction(id string) (status string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.predictions[id]
+	if !ok {
+		return "", false
+	}
+	return p.status, true
+}
+
+func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Input struct {
+			Prompt      string `json:"prompt"`
+			NumOutputs  int    `json:"num_outputs"`
+			AspectRatio string `json:"aspect_ratio"`
+			Width       int    `json:"width"`
+			Height      int    `json:"height"`
+			Seed        *int   `json:"seed"`
+		} `json:"input"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, `{"detail":"invalid JSON body"}`, http.StatusBadRequest)
+		return
+	}
+	if body.Input.Prompt == "" {
+		http.Error(w, `{"detail":"prompt is required"}`, http.StatusUnprocessableEntity)
+		return
+	}
+
+	width, height := outputSize(body.Input.AspectRatio, body.Input.Width, body.Input.Height)
+
+	// Like Replicate, report the seed in the logs, picking one if needed
+	seed := rand.Int63n(maxSeed)
+	if body.Input.Seed != nil {
+		seed = int64(*body.Input.Seed)
+	}
+
+	s.mu.Lock()
+	s.nextID++
+	p := &prediction{
+		id:         "pred-" + strconv.Itoa(s.nextID),
+		status:     "starting",
+		numOutputs: max(body.Input.NumOutputs, 1),
+		width:      width,
+		height:     height,
+		logs:       fmt.Sprintf("Using seed: %d\n", seed),
+	}
+	s.predictions[p.id] = p
+	resp := s.render(p)
+	s.mu.Unlock()
+
+	if s.sync {
+		w.Header().Set("X-Request-Id", p.id)
+		writeJSON(w, http.StatusOK, s.outputURLs(p))
+		return
+	}
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	p, ok := s.predictions[r.PathValue("id")]
+	if !ok {
+		s.mu.Unlock()
+		http.Error(w, `{"detail":"not found"}`, http.StatusNotFound)
+		return
+	}
+	s.advance(p)
+	resp := s.render(p)
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	p, ok := s.predictions[r.PathValue("id")]
+	if !ok {
+		s.mu.Unlock()
+		http.Error(w, `{"detail":"not found"}`, http.StatusNotFound)
+		return
+	}
+	if p.status == "starting" || p.status == "processing" {
+		p.status = "canceled"
+	}
+	resp := s.render(p)
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleImage(w http.ResponseWriter, r *http.Request) {
+	width := clampSide(r.URL.Query().Get("w"))
+	height := clampSide(r.URL.Query().Get("h"))
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, Placeholder(width, height)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(buf.Bytes())
+}
+
+// advance moves a prediction one step along its lifecycle
+func (s *Server) advance(p *prediction) {
+	switch p.status {
+	case "starting":
+		p.status = "processing"
+	case "processing":
+		p.polls++
+		p.logs += fmt.Sprintf("step %d/%d\n", p.polls, s.PollsUntilDone)
+		if p.polls >= s.PollsUntilDone {
+			if s.FailWith != "" {
+				p.status = "failed"
+			} else {
+				p.status = "succeeded"
+			}
+		}
+	}
+}
+
+// render builds the JSON representation of a prediction
+func (s *Server) render(p *prediction) map[string]interface{} {
+	resp := map[string]interface{}{
+		"id":     p.id,
+		"status": p.status,
+		"logs":   p.logs,
+		"urls": map[string]string{
+			"get":    fmt.Sprintf("%s/predictions/%s", s.URL, p.id),
+			"cancel": fmt.Sprintf("%s/predictions/%s/cancel", s.URL, p.id),
+		},
+	}
+
+	switch p.status {
+	case "succeeded":
+		resp["output"] = s.outputURLs(p)
+	case "failed":
+		resp["error"] = s.FailWith
+	}
+
+	return resp
+}
+
+// outputURLs lists the placeholder image URLs of a prediction
+func (s *Server) outputURLs(p *prediction) []string {
+	output := make([]string, p.numOutputs)
+	for i := range output {
+		output[i] = fmt.Sprintf("%s/images/%s-%d.png?w=%d&h=%d", s.URL, p.id, i, p.width, p.height)
+	}
+	return output
+}
+
+// outputSize picks the placeholder size: explicit dimensions if given,
+// otherwise 1024 pixels on the long side of the aspect ratio
+func outputSize(ratio string, width, height int) (int, int) {
+	if width > 0 && height > 0 {
+		return min(width, maxImageSide), min(height, maxImageSide)
+	}
+
+	w, h, ok := strings.Cut(ratio, ":")
+	rw, errW := strconv.ParseFloat(w, 64)
+	rh, errH := strconv.ParseFloat(h, 64)
+	if !ok || errW != nil || errH != nil || rw <= 0 || rh <= 0 {
+		return 1024, 1024
+	}
+	if rw >= rh {
+		return 1024, max(int(1024*rh/rw), 1)
+	}
+	return max(int(1024*rw/rh), 1), 1024
+}
+
+// clampSide parses an image side from a query value, defaulting to 64
+func clampSide(value string) int {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 64
+	}
+	return min(n, maxImageSide)
+}
+
+// Placeholder returns a simple gradient image to stand in for a generated one
+func Placeholder(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{
+				R: uint8(x * 255 / max(width-1, 1)),
+				G: uint8(y * 255 / max(height-1, 1)),
+				B: 128,
+				A: 255,
+			})
+		}
+	}
+	return img
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
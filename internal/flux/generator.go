@@ -0,0 +1,100 @@
+package flux
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Generator is implemented by every image-generation backend
+type Generator interface {
+	// GenerateImagesContext creates images for the prompt and returns them
+	// with the details of the request
+	GenerateImagesContext(ctx context.Context, prompt string, opts GenerateOptions) ([]Image, error)
+}
+
+// ImageFetcher is implemented by backends whose image URLs need the
+// endpoint's auth and extra headers, such as ComfyUI's /view URLs
+type ImageFetcher interface {
+	// ImageClient returns the client to download the generated images with
+	ImageClient() *http.Client
+}
+
+// Factory builds a Generator from the application configuration
+type Factory func(config Config) (Generator, error)
+
+// DefaultBackend is used when no backend is configured
+const DefaultBackend = "flux"
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+func init() {
+	Register(DefaultBackend, func(config Config) (Generator, error) {
+		return NewClient(config), nil
+	})
+	Register("replicate", func(config Config) (Generator, error) {
+		client := NewClient(config)
+		client.mode = ModePrediction
+		return client, nil
+	})
+}
+
+// Register makes a backend available under the given name. Registering the
+// same name twice replaces the earlier factory.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	registry[strings.ToLower(name)] = factory
+}
+
+// Backends returns the names of all registered backends, sorted
+func Backends() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewGenerator creates the backend selected by the configuration
+func NewGenerator(config Config) (Generator, error) {
+	name := strings.ToLower(config.GetBackend())
+	if name == "" {
+		name = DefaultBackend
+	}
+
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q (available: %s)", name, strings.Join(Backends(), ", "))
+	}
+
+	return factory(config)
+}
+
+// sleepContext waits for d or until ctx is done, whichever comes first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
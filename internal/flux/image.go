@@ -0,0 +1,129 @@
+package flux
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"fluxxxer/internal/httpx"
+)
+
+// maxInputImageBytes caps local input images before base64 encoding
+const maxInputImageBytes = 20 * 1024 * 1024
+
+// validateImageOptions checks the image-to-image options
+func validateImageOptions(opts GenerateOptions) error {
+	if opts.PromptStrength != nil && (*opts.PromptStrength < 0 || *opts.PromptStrength > 1) {
+		return fmt.Errorf("prompt strength must be between 0 and 1, got %.2f", *opts.PromptStrength)
+	}
+	if opts.Mask != "" && opts.Image == "" {
+		return errors.New("a mask requires an input image")
+	}
+	return nil
+}
+
+// isRemoteImage reports whether ref is a URL or data URI that can be sent as is
+func isRemoteImage(ref string) bool {
+	return strings.HasPrefix(ref, "http://") ||
+		strings.HasPrefix(ref, "https://") ||
+		strings.HasPrefix(ref, "data:")
+}
+
+// resolveImage turns an input image reference into something the API
+// accepts. URLs and data URIs pass through; anything else is read as a local
+// file and inlined as a base64 data URI.
+func resolveImage(ref string) (string, error) {
+	if ref == "" || isRemoteImage(ref) {
+		return ref, nil
+	}
+
+	path := strings.TrimPrefix(ref, "file://")
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read input image: %w", err)
+	}
+	if info.Size() > maxInputImageBytes {
+		return "", fmt.Errorf("input image is too large (%d MB), maximum is %d MB",
+			info.Size()/(1024*1024), maxInputImageBytes/(1024*1024))
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read input image: %w", err)
+	}
+
+	mimeType := http.DetectContentType(data)
+	if !strings.HasPrefix(mimeType, "image/") {
+		return "", fmt.Errorf("input file %s is not an image (%s)", path, mimeType)
+	}
+
+	return dataURI(mimeType, data), nil
+}
+
+// readInputImage returns the bytes behind an input image reference: a URL,
+// which is downloaded with client, a data URI or a local file
+func readInputImage(ctx context.Context, client *http.Client, retry httpx.RetryPolicy, ref string) ([]byte, error) {
+	ref, err := resolveImage(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(ref, "data:") {
+		data, err := base64.StdEncoding.DecodeString(stripDataURI(ref))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode input image: %w", err)
+		}
+		return data, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ref, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create download request: %w", err)
+	}
+	resp, err := retry.Do(client, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download input image: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download input image: %w", httpx.NewAPIError(resp))
+	}
+	// Read one byte past the limit to tell a large image from a truncated one
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxInputImageBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download input image: %w", err)
+	}
+	if len(data) > maxInputImageBytes {
+		return nil, fmt.Errorf("input image is too large, maximum is %d MB", maxInputImageBytes/(1024*1024))
+	}
+	return data, nil
+}
+
+// extensionFor returns a file extension matching the image data
+func extensionFor(data []byte) string {
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/webp":
+		return ".webp"
+	default:
+		return ".png"
+	}
+}
+
+// stripDataURI returns the base64 payload of a data URI, or ref unchanged
+func stripDataURI(ref string) string {
+	if !strings.HasPrefix(ref, "data:") {
+		return ref
+	}
+	if i := strings.Index(ref, ";base64,"); i >= 0 {
+		return ref[i+len(";base64,"):]
+	}
+	return ref
+}
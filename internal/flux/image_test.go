@@ -0,0 +1,35 @@
+package flux
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"fluxxxer/internal/httpx"
+)
+
+func TestReadInputImageLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size := maxInputImageBytes
+		if r.URL.Path == "/large.png" {
+			size++
+		}
+		w.Write(bytes.Repeat([]byte{1}, size))
+	}))
+	defer server.Close()
+
+	retry := httpx.NewRetryPolicy(1, 0)
+	data, err := readInputImage(context.Background(), http.DefaultClient, retry, server.URL+"/limit.png")
+	if err != nil || len(data) != maxInputImageBytes {
+		t.Errorf("image at the limit: read %d bytes, %v; want all of it", len(data), err)
+	}
+
+	// A larger image fails rather than being cut off
+	_, err = readInputImage(context.Background(), http.DefaultClient, retry, server.URL+"/large.png")
+	if err == nil || !strings.Contains(err.Error(), "input image is too large") {
+		t.Errorf("err = %v, want the image to be too large", err)
+	}
+}
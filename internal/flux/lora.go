@@ -0,0 +1,50 @@
+package flux
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxReplicateLoRAs is how many LoRAs the Replicate-style input can carry:
+// lora_weights plus extra_lora
+const maxReplicateLoRAs = 2
+
+// LoRA applies a set of LoRA weights on top of the base model
+type LoRA struct {
+	// Weights is a URL or an identifier the backend understands, such as
+	// "owner/model" on Replicate, a Hugging Face repo or a ComfyUI file name
+	Weights string
+	// Scale is how strongly the LoRA is applied, typically 0 to 1
+	Scale float64
+}
+
+// validateLoRAs checks that every LoRA names its weights
+func validateLoRAs(loras []LoRA) error {
+	for i, l := range loras {
+		if l.Weights == "" {
+			return fmt.Errorf("LoRA %d has no weights", i+1)
+		}
+	}
+	return nil
+}
+
+// applyLoRAs fills the Replicate LoRA fields of the input: the first LoRA
+// goes to lora_weights and lora_scale, the second to extra_lora
+func applyLoRAs(input *Input, loras []LoRA) error {
+	if len(loras) > maxReplicateLoRAs {
+		return fmt.Errorf("at most %d LoRAs can be combined, got %d", maxReplicateLoRAs, len(loras))
+	}
+
+	if len(loras) > 0 {
+		input.LoRAWeights = loras[0].Weights
+		input.LoRAScale = &loras[0].Scale
+	}
+	if len(loras) > 1 {
+		input.ExtraLoRA = loras[1].Weights
+		input.ExtraLoRAScale = &loras[1].Scale
+	}
+	return nil
+}
+
+// errLoRAsUnsupported is returned by backends that cannot apply LoRAs
+var errLoRAsUnsupported = errors.New("this backend does not support LoRAs")
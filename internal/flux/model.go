@@ -0,0 +1,168 @@
+package flux
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Model describes a Flux model variant and the parameter ranges it accepts
+type Model struct {
+	Name        string
+	DisplayName string
+
+	DefaultSteps int
+	MinSteps     int
+	MaxSteps     int
+
+	// Guidance is not supported when MaxGuidance is zero
+	DefaultGuidance float64
+	MinGuidance     float64
+	MaxGuidance     float64
+
+	SupportsGoFast     bool
+	SupportsMegapixels bool
+}
+
+// SupportsGuidance reports whether the model takes a guidance scale
+func (m Model) SupportsGuidance() bool {
+	return m.MaxGuidance > 0
+}
+
+// Models lists the known Flux variants with their defaults
+var Models = []Model{
+	{
+		Name:               "schnell",
+		DisplayName:        "Flux Schnell",
+		DefaultSteps:       4,
+		MinSteps:           1,
+		MaxSteps:           4,
+		SupportsGoFast:     true,
+		SupportsMegapixels: true,
+	},
+	{
+		Name:               "dev",
+		DisplayName:        "Flux Dev",
+		DefaultSteps:       28,
+		MinSteps:           1,
+		MaxSteps:           50,
+		DefaultGuidance:    3,
+		MinGuidance:        0,
+		MaxGuidance:        10,
+		SupportsGoFast:     true,
+		SupportsMegapixels: true,
+	},
+	{
+		Name:            "pro",
+		DisplayName:     "Flux Pro",
+		DefaultSteps:    25,
+		MinSteps:        1,
+		MaxSteps:        50,
+		DefaultGuidance: 3,
+		MinGuidance:     2,
+		MaxGuidance:     5,
+	},
+}
+
+// genericModel bounds the parameters when no model is selected
+var genericModel = Model{
+	DefaultSteps:       28,
+	MinSteps:           1,
+	MaxSteps:           50,
+	DefaultGuidance:    3,
+	MinGuidance:        0,
+	MaxGuidance:        10,
+	SupportsGoFast:     true,
+	SupportsMegapixels: true,
+}
+
+// MegapixelOptions lists the accepted megapixels values
+var MegapixelOptions = []string{"1", "0.25"}
+
+// LookupModel finds a model by name, case-insensitively
+func LookupModel(name string) (Model, bool) {
+	for _, m := range Models {
+		if strings.EqualFold(m.Name, name) {
+			return m, true
+		}
+	}
+	return Model{}, false
+}
+
+// ModelDefaults returns the model's parameter ranges, or generic ones for an
+// empty name
+func ModelDefaults(name string) (Model, error) {
+	if name == "" {
+		return genericModel, nil
+	}
+	m, ok := LookupModel(name)
+	if !ok {
+		names := make([]string, len(Models))
+		for i, m := range Models {
+			names[i] = m.Name
+		}
+		return Model{}, fmt.Errorf("unknown model %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return m, nil
+}
+
+// Validate checks the options against the selected model's allowed ranges.
+// Every backend calls it before sending a request.
+func (opts GenerateOptions) Validate() error {
+	if err := validateImageOptions(opts); err != nil {
+		return err
+	}
+	if err := validateSize(opts); err != nil {
+		return err
+	}
+	if err := validateLoRAs(opts.LoRAs); err != nil {
+		return err
+	}
+	return validateModelOptions(opts)
+}
+
+// validateModelOptions checks the sampling parameters against the model
+func validateModelOptions(opts GenerateOptions) error {
+	m, err := ModelDefaults(opts.Model)
+	if err != nil {
+		return err
+	}
+
+	label := "the model"
+	if m.Name != "" {
+		label = m.Name
+	}
+
+	if opts.NumInferenceSteps != nil {
+		steps := *opts.NumInferenceSteps
+		if steps < m.MinSteps || steps > m.MaxSteps {
+			return fmt.Errorf("steps for %s must be between %d and %d, got %d", label, m.MinSteps, m.MaxSteps, steps)
+		}
+	}
+
+	if opts.Guidance != nil {
+		if !m.SupportsGuidance() {
+			return fmt.Errorf("%s does not support guidance", label)
+		}
+		guidance := *opts.Guidance
+		if guidance < m.MinGuidance || guidance > m.MaxGuidance {
+			return fmt.Errorf("guidance for %s must be between %g and %g, got %g", label, m.MinGuidance, m.MaxGuidance, guidance)
+		}
+	}
+
+	if opts.GoFast != nil && !m.SupportsGoFast {
+		return fmt.Errorf("%s does not support go fast", label)
+	}
+
+	if opts.Megapixels != "" {
+		if !m.SupportsMegapixels {
+			return fmt.Errorf("%s does not support megapixels", label)
+		}
+		if !slices.Contains(MegapixelOptions, opts.Megapixels) {
+			return errors.New("megapixels must be one of " + strings.Join(MegapixelOptions, ", "))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,197 @@
+package flux
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"fluxxxer/internal/httpx"
+)
+
+// maxOutputDepth bounds how deeply nested objects are searched for images
+const maxOutputDepth = 4
+
+// outputKeys are the object fields searched for images, in order
+var outputKeys = []string{"output", "images", "image", "data", "urls", "url", "b64_json", "base64", "result"}
+
+// decodeResponse normalizes a synchronous response body into image
+// references, each either an http(s) URL or a data URI. It accepts a JSON
+// array, a single JSON string, an object wrapping either of those (such as
+// {"output": [...]} or {"data": [{"b64_json": "..."}]}), a plain-text URL, or
+// the raw image bytes.
+func decodeResponse(contentType string, body []byte) ([]string, error) {
+	// Raw image bytes, checked before trimming so binary data is untouched
+	mimeType := http.DetectContentType(body)
+	if !strings.HasPrefix(mimeType, "image/") && strings.HasPrefix(contentType, "image/") {
+		mimeType, _, _ = strings.Cut(contentType, ";")
+	}
+	if strings.HasPrefix(mimeType, "image/") {
+		return []string{dataURI(mimeType, body)}, nil
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, errors.New("empty response from the API")
+	}
+
+	if !json.Valid(body) {
+		// A bare URL or data URI sent as text
+		if ref := string(body); isRemoteImage(ref) && !strings.ContainsAny(ref, " \n") {
+			return []string{ref}, nil
+		}
+		return nil, fmt.Errorf("unexpected response: %s", truncate(string(body), 200))
+	}
+
+	return decodeOutput(body)
+}
+
+// decodeOutput normalizes a JSON output value into image references
+func decodeOutput(raw json.RawMessage) ([]string, error) {
+	refs, err := collectOutput(raw, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(refs) == 0 {
+		return nil, errors.New("response contained no images")
+	}
+	return refs, nil
+}
+
+// collectOutput walks a JSON value gathering image references
+func collectOutput(raw json.RawMessage, depth int) ([]string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	if depth > maxOutputDepth {
+		return nil, errors.New("response output is nested too deeply")
+	}
+
+	switch raw[0] {
+	case '"':
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, fmt.Errorf("failed to decode output: %w", err)
+		}
+		ref, err := normalizeRef(s)
+		if err != nil {
+			return nil, err
+		}
+		return []string{ref}, nil
+
+	case '[':
+		var items []json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return nil, fmt.Errorf("failed to decode output: %w", err)
+		}
+		var refs []string
+		for _, item := range items {
+			found, err := collectOutput(item, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			refs = append(refs, found...)
+		}
+		return refs, nil
+
+	case '{':
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, fmt.Errorf("failed to decode output: %w", err)
+		}
+		for _, key := range outputKeys {
+			value, ok := fields[key]
+			if !ok {
+				continue
+			}
+			refs, err := collectOutput(value, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if len(refs) > 0 {
+				return refs, nil
+			}
+		}
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("unexpected output: %s", truncate(string(raw), 200))
+}
+
+// normalizeRef accepts a URL or data URI as is and turns bare base64 image
+// data into a data URI
+func normalizeRef(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if isRemoteImage(s) {
+		return s, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", fmt.Errorf("unexpected output %q: not a URL or base64 image", truncate(s, 80))
+	}
+	mimeType := http.DetectContentType(data)
+	if !strings.HasPrefix(mimeType, "image/") {
+		return "", fmt.Errorf("output decodes to %s, not an image", mimeType)
+	}
+	return dataURI(mimeType, data), nil
+}
+
+// dataURI encodes image bytes as a base64 data URI
+func dataURI(mimeType string, data []byte) string {
+	return "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+// truncate shortens s for error messages
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// OpenImage opens an image reference for reading: an http(s) URL, which is
+// downloaded with client, a data URI, or a local path (optionally as a
+// file:// URL)
+func OpenImage(ctx context.Context, client *http.Client, ref string) (io.ReadCloser, error) {
+	switch {
+	case strings.HasPrefix(ref, "data:"):
+		if !strings.Contains(ref, ";base64,") {
+			return nil, errors.New("only base64 data URIs are supported")
+		}
+		data, err := base64.StdEncoding.DecodeString(stripDataURI(ref))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode data URI: %w", err)
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+
+	case strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://"):
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, ref, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create download request: %w", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download image: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			return nil, fmt.Errorf("failed to download image: %w", httpx.NewAPIError(resp))
+		}
+		return resp.Body, nil
+
+	default:
+		file, err := os.Open(strings.TrimPrefix(ref, "file://"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open image: %w", err)
+		}
+		return file, nil
+	}
+}
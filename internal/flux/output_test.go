@@ -0,0 +1,108 @@
+package flux
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testPNG returns a small encoded PNG
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeResponse(t *testing.T) {
+	pngData := testPNG(t)
+	b64 := base64.StdEncoding.EncodeToString(pngData)
+	uri := "data:image/png;base64," + b64
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        []string
+		wantErr     string
+	}{
+		{name: "string", body: `"https://cdn/a.png"`, want: []string{"https://cdn/a.png"}},
+		{name: "list", body: `["https://cdn/a.png", "https://cdn/b.png"]`, want: []string{"https://cdn/a.png", "https://cdn/b.png"}},
+		{name: "output map", body: `{"output": ["https://cdn/a.png"]}`, want: []string{"https://cdn/a.png"}},
+		{name: "url map", body: `{"id": "x", "url": "https://cdn/a.png"}`, want: []string{"https://cdn/a.png"}},
+		{name: "openai style", body: `{"data": [{"b64_json": "` + b64 + `"}]}`, want: []string{uri}},
+		{name: "nested", body: `{"result": {"images": [{"url": "https://cdn/a.png"}, {"url": "https://cdn/b.png"}]}}`, want: []string{"https://cdn/a.png", "https://cdn/b.png"}},
+		{name: "key order", body: `{"url": "https://cdn/second.png", "output": "https://cdn/first.png"}`, want: []string{"https://cdn/first.png"}},
+		{name: "skips empty keys", body: `{"output": null, "images": [], "url": "https://cdn/a.png"}`, want: []string{"https://cdn/a.png"}},
+		{name: "bare base64", body: `["` + b64 + `"]`, want: []string{uri}},
+		{name: "data uri", body: `"` + uri + `"`, want: []string{uri}},
+		{name: "plain text url", body: "https://cdn/a.png\n", want: []string{"https://cdn/a.png"}},
+		{name: "raw image", body: string(pngData), want: []string{uri}},
+		{name: "raw image by content type", contentType: "image/webp; q=1", body: "RIFFxxxx", want: []string{"data:image/webp;base64," + base64.StdEncoding.EncodeToString([]byte("RIFFxxxx"))}},
+		{name: "empty", body: "  ", wantErr: "empty response"},
+		{name: "no images", body: `{"status": "ok"}`, wantErr: "no images"},
+		{name: "null", body: `null`, wantErr: "no images"},
+		{name: "number", body: `42`, wantErr: "unexpected output: 42"},
+		{name: "base64 of text", body: `"` + base64.StdEncoding.EncodeToString([]byte("hello world")) + `"`, wantErr: "not an image"},
+		{name: "not base64", body: `"not a url"`, wantErr: "not a URL or base64 image"},
+		{name: "plain text", body: "Internal Server Error", wantErr: "unexpected response"},
+		{name: "too deep", body: `{"output": {"output": {"output": {"output": {"output": {"output": "https://cdn/a.png"}}}}}}`, wantErr: "nested too deeply"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeResponse(tt.contentType, []byte(tt.body))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeResponse: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("decodeResponse = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenImage(t *testing.T) {
+	pngData := testPNG(t)
+	path := filepath.Join(t.TempDir(), "input.png")
+	if err := os.WriteFile(path, pngData, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ref := range []string{
+		"data:image/png;base64," + base64.StdEncoding.EncodeToString(pngData),
+		path,
+		"file://" + path,
+	} {
+		r, err := OpenImage(context.Background(), http.DefaultClient, ref)
+		if err != nil {
+			t.Fatalf("OpenImage(%.40q): %v", ref, err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(data, pngData) {
+			t.Errorf("OpenImage(%.40q) read %d bytes, %v; want the image", ref, len(data), err)
+		}
+	}
+
+	if _, err := OpenImage(context.Background(), http.DefaultClient, "data:image/png,raw"); err == nil {
+		t.Error("OpenImage accepted a data URI without base64")
+	}
+}
@@ -0,0 +1,189 @@
+package flux
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"fluxxxer/internal/httpx"
+)
+
+// PredictionStatus is the lifecycle state of an asynchronous prediction
+type PredictionStatus string
+
+const (
+	StatusStarting   PredictionStatus = "starting"
+	StatusProcessing PredictionStatus = "processing"
+	StatusSucceeded  PredictionStatus = "succeeded"
+	StatusFailed     PredictionStatus = "failed"
+	StatusCanceled   PredictionStatus = "canceled"
+)
+
+// Prediction is a Replicate-style asynchronous generation job
+type Prediction struct {
+	ID     string           `json:"id"`
+	Status PredictionStatus `json:"status"`
+	Output json.RawMessage  `json:"output,omitempty"`
+	Error  json.RawMessage  `json:"error,omitempty"`
+	Logs   string           `json:"logs,omitempty"`
+	URLs   struct {
+		Get    string `json:"get,omitempty"`
+		Cancel string `json:"cancel,omitempty"`
+	} `json:"urls"`
+
+	// Raw is the response body the prediction was decoded from
+	Raw json.RawMessage `json:"-"`
+}
+
+// Done reports whether the prediction has reached a terminal state
+func (p *Prediction) Done() bool {
+	return p.Status == StatusSucceeded || p.Status == StatusFailed || p.Status == StatusCanceled
+}
+
+// LastLogLine returns the most recent non-empty line of the prediction logs
+func (p *Prediction) LastLogLine() string {
+	lines := strings.Split(strings.TrimSpace(p.Logs), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// OutputURLs returns the images in the prediction output as URLs or data
+// URIs. The output may be a single string, a list, or an object wrapping
+// either; see decodeResponse.
+func (p *Prediction) OutputURLs() ([]string, error) {
+	if len(p.Output) == 0 || string(p.Output) == "null" {
+		return nil, errors.New("prediction has no output")
+	}
+
+	return decodeOutput(p.Output)
+}
+
+// ErrorMessage returns the provider error, which may be a string or an object
+func (p *Prediction) ErrorMessage() string {
+	if len(p.Error) == 0 || string(p.Error) == "null" {
+		return ""
+	}
+
+	var msg string
+	if err := json.Unmarshal(p.Error, &msg); err == nil {
+		return msg
+	}
+
+	return string(p.Error)
+}
+
+// awaitPrediction polls the prediction with exponential backoff until it
+// succeeds, fails or ctx is done, and returns the succeeded prediction
+func (c *Client) awaitPrediction(ctx context.Context, p *Prediction, onProgress func(*Prediction)) (*Prediction, error) {
+	delay := c.pollInterval
+
+	for {
+		slog.Debug("Prediction status", "id", p.ID, "status", p.Status)
+		if onProgress != nil {
+			onProgress(p)
+		}
+
+		switch p.Status {
+		case StatusSucceeded:
+			return p, nil
+		case StatusFailed:
+			msg := p.ErrorMessage()
+			if msg == "" {
+				msg = "unknown error"
+			}
+			return nil, fmt.Errorf("prediction %s failed: %s", p.ID, msg)
+		case StatusCanceled:
+			return nil, fmt.Errorf("prediction %s was canceled", p.ID)
+		}
+
+		if err := sleepContext(ctx, delay); err != nil {
+			c.cancelPrediction(p)
+			return nil, fmt.Errorf("waiting for prediction %s: %w", p.ID, err)
+		}
+
+		delay = min(delay*3/2, c.maxPollInterval)
+
+		next, err := c.getPrediction(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		p = next
+	}
+}
+
+// predictionURL returns the URL used to poll the prediction
+func (c *Client) predictionURL(p *Prediction) string {
+	if p.URLs.Get != "" {
+		return p.URLs.Get
+	}
+	return strings.TrimSuffix(c.apiURL, "/") + "/" + p.ID
+}
+
+// getPrediction fetches the current state of the prediction
+func (c *Client) getPrediction(ctx context.Context, p *Prediction) (*Prediction, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.predictionURL(p), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create poll request: %w", err)
+	}
+
+	resp, err := c.retry.Do(c.httpClient, req)
+	if err != nil {
+		return nil, fmt.Errorf("poll request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Server errors are usually transient, so keep the last known state
+	// and poll again
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return p, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("poll failed: %w", httpx.NewAPIError(resp))
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prediction: %w", err)
+	}
+
+	var next Prediction
+	if err := json.Unmarshal(body, &next); err != nil {
+		return nil, fmt.Errorf("failed to decode prediction: %w", err)
+	}
+	next.Raw = body
+	if next.ID == "" {
+		next.ID = p.ID
+	}
+
+	return &next, nil
+}
+
+// cancelPrediction asks the provider to stop a prediction we no longer need.
+// It is best effort: the caller has already given up on the result.
+func (c *Client) cancelPrediction(p *Prediction) {
+	cancelURL := p.URLs.Cancel
+	if cancelURL == "" {
+		cancelURL = c.predictionURL(p) + "/cancel"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cancelURL, nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
@@ -0,0 +1,70 @@
+package flux
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// maxMetadataBytes caps the raw provider response kept on each image
+const maxMetadataBytes = 64 * 1024
+
+// seedPattern finds a seed in provider logs or JSON, such as "Using seed:
+// 1234" or "seed": 1234
+var seedPattern = regexp.MustCompile(`(?i)\bseed\b["']?\s*[:=]\s*(\d+)`)
+
+// Image is a generated image with the details of the request that made it
+type Image struct {
+	// URL is an http(s) URL or a data URI
+	URL    string
+	Prompt string
+	// Seed is the seed the provider reported, or else the one we sent; nil
+	// when neither is known
+	Seed *int
+	// Options are the options the request was made with, with the size and
+	// model the backend actually used filled in
+	Options GenerateOptions
+	// RequestID identifies the request with the provider: a prediction,
+	// task or prompt ID, or a request ID header
+	RequestID string
+	// Latency is the time from submitting the request to having the result
+	Latency time.Duration
+	// Metadata is the provider's final response, when it is small JSON
+	Metadata json.RawMessage
+}
+
+// newImages builds one Image per URL, copying the shared details from base
+func newImages(urls []string, base Image) []Image {
+	base.Options.OnProgress = nil
+
+	images := make([]Image, len(urls))
+	for i, url := range urls {
+		images[i] = base
+		images[i].URL = url
+	}
+	return images
+}
+
+// metadata keeps raw as image metadata if it is valid JSON of a reasonable
+// size; inline image data would otherwise bloat every result
+func metadata(raw []byte) json.RawMessage {
+	if len(raw) == 0 || len(raw) > maxMetadataBytes || !json.Valid(raw) {
+		return nil
+	}
+	return json.RawMessage(raw)
+}
+
+// findSeed returns the first seed found in the texts, or fallback
+func findSeed(fallback *int, texts ...string) *int {
+	for _, text := range texts {
+		match := seedPattern.FindStringSubmatch(text)
+		if match == nil {
+			continue
+		}
+		if seed, err := strconv.Atoi(match[1]); err == nil {
+			return &seed
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,135 @@
+package flux
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// AspectRatioCustom is sent as the aspect ratio when explicit dimensions are
+// requested
+const AspectRatioCustom = "custom"
+
+// Limits for explicit dimensions
+const (
+	MinDimension  = 256
+	MaxDimension  = 2048
+	DimensionStep = 16
+)
+
+// ParseAspectRatio parses a "W:H" ratio into its two positive terms
+func ParseAspectRatio(ratio string) (w, h float64, err error) {
+	parts := strings.Split(ratio, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid aspect ratio %q, expected W:H", ratio)
+	}
+
+	w, errW := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	h, errH := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if errW != nil || errH != nil || w <= 0 || h <= 0 {
+		return 0, 0, fmt.Errorf("invalid aspect ratio %q, expected W:H", ratio)
+	}
+
+	return w, h, nil
+}
+
+// SizeForAspectRatio returns pixel dimensions close to the given number of
+// megapixels for the ratio, with both sides rounded to a multiple of step
+func SizeForAspectRatio(ratio string, megapixels float64, step int) (width, height int, err error) {
+	w, h, err := ParseAspectRatio(ratio)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	pixels := megapixels * 1024 * 1024
+	fw := math.Sqrt(pixels * w / h)
+	fh := fw * h / w
+
+	return roundTo(fw, step), roundTo(fh, step), nil
+}
+
+// roundTo rounds v to the nearest positive multiple of step
+func roundTo(v float64, step int) int {
+	n := int(math.Round(v/float64(step))) * step
+	if n < step {
+		n = step
+	}
+	return n
+}
+
+// SnapDimension rounds v to the nearest multiple of DimensionStep within the
+// allowed range
+func SnapDimension(v int) int {
+	return min(max(roundTo(float64(v), DimensionStep), MinDimension), MaxDimension)
+}
+
+// validateSize checks the aspect ratio and explicit dimensions
+func validateSize(opts GenerateOptions) error {
+	if opts.Width != 0 || opts.Height != 0 {
+		for _, d := range []struct {
+			name  string
+			value int
+		}{{"width", opts.Width}, {"height", opts.Height}} {
+			if d.value < MinDimension || d.value > MaxDimension {
+				return fmt.Errorf("%s must be between %d and %d, got %d", d.name, MinDimension, MaxDimension, d.value)
+			}
+			if d.value%DimensionStep != 0 {
+				return fmt.Errorf("%s must be a multiple of %d, got %d", d.name, DimensionStep, d.value)
+			}
+		}
+		return nil
+	}
+
+	switch opts.AspectRatio {
+	case "":
+		return nil
+	case AspectRatioCustom:
+		return errors.New("a custom aspect ratio requires a width and height")
+	}
+
+	// Ratios may be sent as a custom size, so they must fit the limits
+	width, height, err := SizeForAspectRatio(opts.AspectRatio, 1, DimensionStep)
+	if err != nil {
+		return err
+	}
+	if width > MaxDimension || height > MaxDimension {
+		return fmt.Errorf("aspect ratio %s is too extreme, the longest side would be %d pixels", opts.AspectRatio, max(width, height))
+	}
+	return nil
+}
+
+// pixelSize returns the output dimensions for backends that take pixels:
+// explicit dimensions, or about one megapixel at the aspect ratio (falling
+// back to defaultRatio). Both are rounded to a multiple of step.
+func pixelSize(opts GenerateOptions, defaultRatio string, step int) (width, height int, err error) {
+	if opts.Width > 0 && opts.Height > 0 {
+		return roundTo(float64(opts.Width), step), roundTo(float64(opts.Height), step), nil
+	}
+
+	ratio := opts.AspectRatio
+	if ratio == "" {
+		ratio = defaultRatio
+	}
+	return SizeForAspectRatio(ratio, 1, step)
+}
+
+// requestSize works out how to ask for the output size. Explicit dimensions
+// and ratios the endpoint does not list natively are both sent as a custom
+// size at about one megapixel; listed ratios are passed through.
+func requestSize(opts GenerateOptions, supported []string) (ratio string, width, height int, err error) {
+	if opts.Width > 0 && opts.Height > 0 {
+		return AspectRatioCustom, opts.Width, opts.Height, nil
+	}
+	if opts.AspectRatio == "" || slices.Contains(supported, opts.AspectRatio) {
+		return opts.AspectRatio, 0, 0, nil
+	}
+
+	width, height, err = SizeForAspectRatio(opts.AspectRatio, 1, DimensionStep)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return AspectRatioCustom, SnapDimension(width), SnapDimension(height), nil
+}
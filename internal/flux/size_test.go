@@ -0,0 +1,120 @@
+package flux
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    GenerateOptions
+		wantErr string
+	}{
+		{name: "no size", opts: GenerateOptions{}},
+		{name: "listed ratio", opts: GenerateOptions{AspectRatio: "16:9"}},
+		{name: "arbitrary ratio", opts: GenerateOptions{AspectRatio: "21:9"}},
+		{name: "smallest size", opts: GenerateOptions{Width: MinDimension, Height: MinDimension}},
+		{name: "largest size", opts: GenerateOptions{Width: MaxDimension, Height: MaxDimension}},
+		{name: "width too small", opts: GenerateOptions{Width: MinDimension - DimensionStep, Height: 512}, wantErr: "width must be between 256 and 2048, got 240"},
+		{name: "height too large", opts: GenerateOptions{Width: 512, Height: MaxDimension + DimensionStep}, wantErr: "height must be between 256 and 2048, got 2064"},
+		{name: "width only", opts: GenerateOptions{Width: 512}, wantErr: "height must be between"},
+		{name: "width not a multiple", opts: GenerateOptions{Width: 1000, Height: 512}, wantErr: "width must be a multiple of 16, got 1000"},
+		{name: "height not a multiple", opts: GenerateOptions{Width: 512, Height: 520}, wantErr: "height must be a multiple of 16, got 520"},
+		{name: "custom without size", opts: GenerateOptions{AspectRatio: AspectRatioCustom}, wantErr: "requires a width and height"},
+		{name: "malformed ratio", opts: GenerateOptions{AspectRatio: "wide"}, wantErr: `invalid aspect ratio "wide"`},
+		{name: "zero ratio", opts: GenerateOptions{AspectRatio: "0:1"}, wantErr: "invalid aspect ratio"},
+		{name: "extreme ratio", opts: GenerateOptions{AspectRatio: "8:1"}, wantErr: "too extreme"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSize(tt.opts)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateSize: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRequestSize(t *testing.T) {
+	supported := []string{"1:1", "4:3", "3:4", "16:9", "9:16"}
+
+	tests := []struct {
+		name       string
+		opts       GenerateOptions
+		wantRatio  string
+		wantWidth  int
+		wantHeight int
+	}{
+		{name: "endpoint default", opts: GenerateOptions{}},
+		{name: "listed ratio passes through", opts: GenerateOptions{AspectRatio: "16:9"}, wantRatio: "16:9"},
+		{name: "explicit size", opts: GenerateOptions{AspectRatio: "16:9", Width: 1024, Height: 768}, wantRatio: AspectRatioCustom, wantWidth: 1024, wantHeight: 768},
+		{name: "unlisted ratio", opts: GenerateOptions{AspectRatio: "2:1"}, wantRatio: AspectRatioCustom, wantWidth: 1456, wantHeight: 720},
+		{name: "unlisted square-ish ratio", opts: GenerateOptions{AspectRatio: "5:4"}, wantRatio: AspectRatioCustom, wantWidth: 1152, wantHeight: 912},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ratio, width, height, err := requestSize(tt.opts, supported)
+			if err != nil {
+				t.Fatalf("requestSize: %v", err)
+			}
+			if ratio != tt.wantRatio || width != tt.wantWidth || height != tt.wantHeight {
+				t.Errorf("requestSize = %q %dx%d, want %q %dx%d", ratio, width, height, tt.wantRatio, tt.wantWidth, tt.wantHeight)
+			}
+			if width%DimensionStep != 0 || height%DimensionStep != 0 {
+				t.Errorf("size %dx%d is not a multiple of %d", width, height, DimensionStep)
+			}
+		})
+	}
+}
+
+func TestPixelSize(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       GenerateOptions
+		step       int
+		wantWidth  int
+		wantHeight int
+	}{
+		{name: "default ratio", opts: GenerateOptions{}, step: 16, wantWidth: 1024, wantHeight: 1024},
+		{name: "ratio", opts: GenerateOptions{AspectRatio: "16:9"}, step: 64, wantWidth: 1344, wantHeight: 768},
+		{name: "explicit size rounded to the step", opts: GenerateOptions{Width: 1000, Height: 600}, step: 64, wantWidth: 1024, wantHeight: 576},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			width, height, err := pixelSize(tt.opts, "1:1", tt.step)
+			if err != nil {
+				t.Fatalf("pixelSize: %v", err)
+			}
+			if width != tt.wantWidth || height != tt.wantHeight {
+				t.Errorf("pixelSize = %dx%d, want %dx%d", width, height, tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
+
+func TestSnapDimension(t *testing.T) {
+	tests := []struct{ in, want int }{
+		{0, MinDimension},
+		{100, MinDimension},
+		{1000, 1008},
+		{1024, 1024},
+		{1031, 1024},
+		{5000, MaxDimension},
+	}
+
+	for _, tt := range tests {
+		if got := SnapDimension(tt.in); got != tt.want {
+			t.Errorf("SnapDimension(%d) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
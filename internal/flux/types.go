@@ -5,7 +5,30 @@ type Input struct {
 	Seed               *int   `json:"seed,omitempty"`
 	NumOutputs         int    `json:"num_outputs"`
 	AspectRatio        string `json:"aspect_ratio"`
+	Width              int    `json:"width,omitempty"`
+	Height             int    `json:"height,omitempty"`
 	OutputFormat       string `json:"output_format"`
 	OutputQuality      int    `json:"output_quality"`
 	DisableSafetyCheck bool   `json:"disable_safety_checker"`
+
+	// Sampling parameters, sent only when set
+	Model             string   `json:"model,omitempty"`
+	NumInferenceSteps *int     `json:"num_inference_steps,omitempty"`
+	Guidance          *float64 `json:"guidance,omitempty"`
+	GoFast            *bool    `json:"go_fast,omitempty"`
+	Megapixels        string   `json:"megapixels,omitempty"`
+	NegativePrompt    string   `json:"negative_prompt,omitempty"`
+
+	// LoRAs
+	LoRAWeights    string   `json:"lora_weights,omitempty"`
+	LoRAScale      *float64 `json:"lora_scale,omitempty"`
+	ExtraLoRA      string   `json:"extra_lora,omitempty"`
+	ExtraLoRAScale *float64 `json:"extra_lora_scale,omitempty"`
+
+	// Image-to-image
+	Image          string   `json:"image,omitempty"`
+	PromptStrength *float64 `json:"prompt_strength,omitempty"`
+
+	// Inpainting
+	Mask string `json:"mask,omitempty"`
 }
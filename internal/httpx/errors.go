@@ -0,0 +1,269 @@
+// Package httpx holds the HTTP plumbing shared by the Flux and upscaler
+// clients.
+package httpx
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxErrorBody caps how much of an error response is kept
+const maxErrorBody = 64 * 1024
+
+// requestIDHeaders are checked in order for a provider request ID
+var requestIDHeaders = []string{
+	"X-Request-Id",
+	"Request-Id",
+	"X-Amzn-Requestid",
+	"Fly-Request-Id",
+	"Cf-Ray",
+}
+
+// APIError describes a non-success response from a remote API
+type APIError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	// Code and Message are the provider's error code and message, when the
+	// body is JSON in one of the common error shapes
+	Code    string
+	Message string
+	// RetryAfter is parsed from the Retry-After header, zero if absent
+	RetryAfter time.Duration
+	RequestID  string
+	// Body is the raw response body, truncated to 64KB
+	Body string
+}
+
+// NewAPIError builds an APIError from resp and consumes its body. The caller
+// still owns closing the body.
+func NewAPIError(resp *http.Response) *APIError {
+	e := &APIError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: ParseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+
+	if resp.Request != nil {
+		e.Method = resp.Request.Method
+		e.URL = resp.Request.URL.Redacted()
+	}
+
+	e.RequestID = RequestID(resp.Header)
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	e.Body = string(body)
+	e.Code, e.Message = parseErrorBody(body)
+
+	return e
+}
+
+// RequestID returns the provider's request ID from the response headers, or
+// "" if there is none
+func RequestID(header http.Header) string {
+	for _, name := range requestIDHeaders {
+		if id := header.Get(name); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// Error implements the error interface
+func (e *APIError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "API returned status %d", e.StatusCode)
+	if e.Message != "" {
+		fmt.Fprintf(&b, ": %s", e.Message)
+	}
+	if e.Code != "" {
+		fmt.Fprintf(&b, " (code %s)", e.Code)
+	}
+	if e.RequestID != "" {
+		fmt.Fprintf(&b, " [request %s]", e.RequestID)
+	}
+	return b.String()
+}
+
+// Temporary reports whether the request may succeed if retried later
+func (e *APIError) Temporary() bool {
+	return temporaryStatus(e.StatusCode)
+}
+
+// UserMessage returns a short explanation suitable for the status bar
+func (e *APIError) UserMessage() string {
+	var hint string
+	switch {
+	case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+		hint = "Authentication failed. Check your API key."
+	case e.StatusCode == http.StatusNotFound:
+		hint = "The API endpoint was not found. Check the configured URL."
+	case e.StatusCode == http.StatusRequestEntityTooLarge:
+		hint = "The request was too large for the server."
+	case e.StatusCode == http.StatusTooManyRequests:
+		hint = "Rate limited by the server."
+		if e.RetryAfter > 0 {
+			hint = fmt.Sprintf("Rate limited by the server. Try again in %v.", e.RetryAfter.Round(time.Second))
+		}
+	case e.StatusCode == http.StatusBadGateway || e.StatusCode == http.StatusServiceUnavailable || e.StatusCode == http.StatusGatewayTimeout:
+		hint = "The service is temporarily unavailable. Please try again later."
+	case e.StatusCode >= http.StatusInternalServerError:
+		hint = "The service reported an internal error."
+	default:
+		hint = fmt.Sprintf("The request was rejected (status %d).", e.StatusCode)
+	}
+
+	if e.Message != "" {
+		return hint + " " + e.Message
+	}
+	return hint
+}
+
+// Details returns every field in a multi-line form for bug reports
+func (e *APIError) Details() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Status: %d %s\n", e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Method != "" || e.URL != "" {
+		fmt.Fprintf(&b, "Request: %s %s\n", e.Method, e.URL)
+	}
+	if e.RequestID != "" {
+		fmt.Fprintf(&b, "Request ID: %s\n", e.RequestID)
+	}
+	if e.Code != "" {
+		fmt.Fprintf(&b, "Error code: %s\n", e.Code)
+	}
+	if e.Message != "" {
+		fmt.Fprintf(&b, "Message: %s\n", e.Message)
+	}
+	if e.RetryAfter > 0 {
+		fmt.Fprintf(&b, "Retry after: %v\n", e.RetryAfter)
+	}
+	if e.Body != "" {
+		fmt.Fprintf(&b, "Body:\n%s\n", e.Body)
+	}
+	return b.String()
+}
+
+// ParseRetryAfter parses a Retry-After header given either as seconds or as
+// an HTTP date. It returns zero when the header is empty or invalid.
+func ParseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if when, err := http.ParseTime(value); err == nil {
+		if d := time.Until(when); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
+
+// parseErrorBody extracts a code and message from the error shapes used by
+// the providers we talk to:
+//
+//	{"error": "message"}
+//	{"error": {"code": "...", "message": "..."}}
+//	{"code": "...", "message": "..."}
+//	{"detail": "message"} or {"detail": [{"msg": "..."}]}
+//	{"errors": [{"message": "..."}]}
+func parseErrorBody(body []byte) (code, message string) {
+	var shape struct {
+		Error   json.RawMessage `json:"error"`
+		Code    json.RawMessage `json:"code"`
+		Name    string          `json:"name"`
+		Message string          `json:"message"`
+		Detail  json.RawMessage `json:"detail"`
+		Errors  []struct {
+			Code    json.RawMessage `json:"code"`
+			Message string          `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &shape); err != nil {
+		return "", ""
+	}
+
+	code = rawString(shape.Code)
+	if code == "" {
+		code = shape.Name
+	}
+	message = shape.Message
+
+	if len(shape.Error) > 0 {
+		var nested struct {
+			Code    json.RawMessage `json:"code"`
+			Type    string          `json:"type"`
+			Message string          `json:"message"`
+		}
+		if msg := rawString(shape.Error); msg != "" {
+			message = msg
+		} else if err := json.Unmarshal(shape.Error, &nested); err == nil {
+			if c := rawString(nested.Code); c != "" {
+				code = c
+			} else if nested.Type != "" {
+				code = nested.Type
+			}
+			if nested.Message != "" {
+				message = nested.Message
+			}
+		}
+	}
+
+	if message == "" && len(shape.Detail) > 0 {
+		var items []struct {
+			Msg string `json:"msg"`
+		}
+		if msg := rawString(shape.Detail); msg != "" {
+			message = msg
+		} else if err := json.Unmarshal(shape.Detail, &items); err == nil {
+			msgs := make([]string, 0, len(items))
+			for _, item := range items {
+				if item.Msg != "" {
+					msgs = append(msgs, item.Msg)
+				}
+			}
+			message = strings.Join(msgs, "; ")
+		}
+	}
+
+	if message == "" && len(shape.Errors) > 0 {
+		message = shape.Errors[0].Message
+		if code == "" {
+			code = rawString(shape.Errors[0].Code)
+		}
+	}
+
+	return code, message
+}
+
+// rawString returns a JSON string or number as text, or "" for anything else
+func rawString(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return n.String()
+	}
+
+	return ""
+}
@@ -0,0 +1,44 @@
+package httpx
+
+import (
+	"net/http"
+	"strings"
+
+	"fluxxxer/internal/logging"
+)
+
+// IsSensitiveHeader reports whether the header likely carries a credential,
+// such as Authorization, X-API-Key, X-App-ID or Cookie
+func IsSensitiveHeader(name string) bool {
+	return logging.IsSensitiveKey(name)
+}
+
+// RedactHeaders returns a copy of header that is safe to log, with the values
+// of sensitive headers replaced. For Authorization the scheme is kept.
+func RedactHeaders(header http.Header) http.Header {
+	clean := make(http.Header, len(header))
+	for name, values := range header {
+		if !IsSensitiveHeader(name) {
+			clean[name] = append([]string(nil), values...)
+			continue
+		}
+		masked := make([]string, len(values))
+		for i, value := range values {
+			masked[i] = redactCredential(value)
+		}
+		clean[name] = masked
+	}
+	return clean
+}
+
+// redactCredential masks a header value, keeping an auth scheme such as
+// "Bearer" so logs still show how the request was authenticated
+func redactCredential(value string) string {
+	if value == "" {
+		return ""
+	}
+	if scheme, _, ok := strings.Cut(value, " "); ok && !strings.ContainsAny(scheme, "=;") {
+		return scheme + " " + logging.Redacted
+	}
+	return logging.Redacted
+}
@@ -0,0 +1,183 @@
+package httpx
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy controls how requests are retried after transient failures:
+// network errors, 408, 429 and 5xx responses. See ForCreate for requests
+// that must not be repeated.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first
+	MaxAttempts int
+	// Budget caps the total time spent across all attempts; zero means no cap
+	Budget time.Duration
+	// BaseDelay is the backoff before the second attempt; it doubles each time
+	BaseDelay time.Duration
+	// MaxDelay caps a single backoff
+	MaxDelay time.Duration
+	// MaxRetryAfter caps the wait a server asks for in Retry-After when
+	// there is no budget; zero means DefaultMaxRetryAfter
+	MaxRetryAfter time.Duration
+
+	// create limits retries to failures the server cannot have acted on
+	create bool
+}
+
+// DefaultMaxRetryAfter is the longest Retry-After honored without a budget
+const DefaultMaxRetryAfter = time.Minute
+
+// NewRetryPolicy returns a policy with the default backoff settings
+func NewRetryPolicy(maxAttempts int, budget time.Duration) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: maxAttempts,
+		Budget:      budget,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    10 * time.Second,
+	}
+}
+
+// ForCreate returns the policy for requests that create something, such as
+// a billed prediction, which a retry could create twice. They are only
+// retried when the server cannot have acted on them: failures to connect,
+// 429 Too Many Requests and 503 Service Unavailable.
+func (p RetryPolicy) ForCreate() RetryPolicy {
+	p.create = true
+	return p
+}
+
+// Do sends req, retrying transient failures according to the policy. The
+// request body is replayed through req.GetBody; requests with a body that
+// cannot be replayed are sent once.
+//
+// When retries are exhausted the last response is returned as is, so the
+// caller can inspect it; intermediate responses are drained and closed.
+func (p RetryPolicy) Do(client *http.Client, req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	start := time.Now()
+
+	attempts := max(p.MaxAttempts, 1)
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+
+		resp, err := client.Do(req)
+		if attempt >= attempts || !p.retryable(ctx, resp, err) {
+			return resp, err
+		}
+
+		delay := p.backoff(attempt)
+		if resp != nil {
+			if retryAfter := ParseRetryAfter(resp.Header.Get("Retry-After")); retryAfter > 0 {
+				delay = p.capRetryAfter(retryAfter)
+			}
+		}
+
+		// Give up rather than sleep past the budget
+		if p.Budget > 0 && time.Since(start)+delay > p.Budget {
+			return resp, err
+		}
+
+		attrs := []any{"method", req.Method, "url", req.URL.Redacted(), "attempt", attempt, "delay", delay}
+		if resp != nil {
+			attrs = append(attrs, "status", resp.StatusCode)
+			io.Copy(io.Discard, io.LimitReader(resp.Body, maxErrorBody))
+			resp.Body.Close()
+		} else {
+			attrs = append(attrs, "error", err)
+		}
+		slog.Warn("Retrying request", attrs...)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// capRetryAfter bounds the wait a server asked for. With a budget the
+// budget decides; without one a single header must not park the request
+// for hours.
+func (p RetryPolicy) capRetryAfter(delay time.Duration) time.Duration {
+	if p.Budget > 0 {
+		return delay
+	}
+	ceiling := p.MaxRetryAfter
+	if ceiling <= 0 {
+		ceiling = DefaultMaxRetryAfter
+	}
+	return min(delay, ceiling)
+}
+
+// backoff returns the delay after the given attempt: exponential growth with
+// jitter over the upper half of the interval
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	base := p.BaseDelay
+	if base <= 0 {
+		base = 500 * time.Millisecond
+	}
+
+	delay := base << (attempt - 1)
+	if p.MaxDelay > 0 && (delay > p.MaxDelay || delay <= 0) {
+		delay = p.MaxDelay
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// retryable reports whether an attempt failed in a way worth retrying
+func (p RetryPolicy) retryable(ctx context.Context, resp *http.Response, err error) bool {
+	if err != nil {
+		// Our own cancellation is final
+		if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+			return false
+		}
+		return !p.create || connectError(err)
+	}
+
+	if p.create {
+		return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable
+	}
+	return temporaryStatus(resp.StatusCode)
+}
+
+// connectError reports whether err means the connection could not be made,
+// so the request never reached the server
+func connectError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+
+	// Through a proxy, failing to reach the proxy is reported as proxyconnect
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "proxyconnect")
+}
+
+// temporaryStatus reports whether a status code signals a transient failure
+func temporaryStatus(code int) bool {
+	return code == http.StatusRequestTimeout ||
+		code == http.StatusTooManyRequests ||
+		code >= http.StatusInternalServerError
+}
@@ -0,0 +1,333 @@
+package httpx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is a test server that answers with a scripted list of statuses,
+// repeating the last, and records the bodies it receives
+type recorder struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	header   http.Header
+	bodies   []string
+}
+
+func newRecorder(t *testing.T, statuses ...int) *recorder {
+	r := &recorder{statuses: statuses, header: http.Header{}}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+
+		r.mu.Lock()
+		status := r.statuses[min(len(r.bodies), len(r.statuses)-1)]
+		r.bodies = append(r.bodies, string(body))
+		for name, values := range r.header {
+			w.Header()[name] = values
+		}
+		r.mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *recorder) attempts() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.bodies)
+}
+
+// testPolicy retries quickly
+func testPolicy(maxAttempts int) RetryPolicy {
+	return RetryPolicy{MaxAttempts: maxAttempts, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+}
+
+func TestRetryReplaysBody(t *testing.T) {
+	server := newRecorder(t, http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK)
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader([]byte(`{"prompt":"a lighthouse"}`)))
+	resp, err := testPolicy(3).Do(http.DefaultClient, req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.bodies) != 3 {
+		t.Fatalf("got %d attempts, want 3", len(server.bodies))
+	}
+	for i, body := range server.bodies {
+		if body != `{"prompt":"a lighthouse"}` {
+			t.Errorf("attempt %d body = %q, want the original", i+1, body)
+		}
+	}
+}
+
+func TestRetryWithoutGetBodySendsOnce(t *testing.T) {
+	server := newRecorder(t, http.StatusServiceUnavailable)
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL, io.NopCloser(strings.NewReader("stream")))
+	if req.GetBody != nil {
+		t.Fatal("GetBody is set for an opaque reader")
+	}
+	resp, err := testPolicy(3).Do(http.DefaultClient, req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	resp.Body.Close()
+
+	if got := server.attempts(); got != 1 {
+		t.Errorf("got %d attempts, want 1", got)
+	}
+}
+
+func TestRetryReturnsLastResponse(t *testing.T) {
+	server := newRecorder(t, http.StatusInternalServerError)
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	resp, err := testPolicy(3).Do(http.DefaultClient, req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", resp.StatusCode)
+	}
+	if got := server.attempts(); got != 3 {
+		t.Errorf("got %d attempts, want 3", got)
+	}
+}
+
+func TestRetryDoesNotRetryClientErrors(t *testing.T) {
+	server := newRecorder(t, http.StatusBadRequest)
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	resp, err := testPolicy(3).Do(http.DefaultClient, req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	resp.Body.Close()
+
+	if got := server.attempts(); got != 1 {
+		t.Errorf("got %d attempts, want 1", got)
+	}
+}
+
+func TestRetryHonorsRetryAfter(t *testing.T) {
+	server := newRecorder(t, http.StatusTooManyRequests, http.StatusOK)
+	server.header.Set("Retry-After", "1")
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	start := time.Now()
+	resp, err := testPolicy(3).Do(http.DefaultClient, req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %v, want the 1s from Retry-After", elapsed)
+	}
+}
+
+func TestRetryCapsRetryAfter(t *testing.T) {
+	server := newRecorder(t, http.StatusServiceUnavailable, http.StatusOK)
+	server.header.Set("Retry-After", "3600")
+
+	policy := testPolicy(2)
+	policy.MaxRetryAfter = 50 * time.Millisecond
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	start := time.Now()
+	resp, err := policy.Do(http.DefaultClient, req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	resp.Body.Close()
+
+	// Without a budget the hour asked for is cut to the ceiling
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("retried after %v, want the 50ms ceiling", elapsed)
+	}
+
+	if got := (RetryPolicy{}).capRetryAfter(time.Hour); got != DefaultMaxRetryAfter {
+		t.Errorf("default ceiling = %v, want %v", got, DefaultMaxRetryAfter)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	server := newRecorder(t, http.StatusTooManyRequests, http.StatusOK)
+	server.header.Set("Retry-After", "30")
+
+	policy := testPolicy(3)
+	policy.Budget = time.Second
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	start := time.Now()
+	resp, err := policy.Do(http.DefaultClient, req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	resp.Body.Close()
+
+	// Waiting 30s would overrun the budget, so the 429 is returned at once
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want 429", resp.StatusCode)
+	}
+	if got := server.attempts(); got != 1 {
+		t.Errorf("got %d attempts, want 1", got)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("gave up after %v, want at once", elapsed)
+	}
+}
+
+func TestRetryStopsOnCancel(t *testing.T) {
+	server := newRecorder(t, http.StatusServiceUnavailable)
+	server.header.Set("Retry-After", "30")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	_, err := testPolicy(3).Do(http.DefaultClient, req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestRetryForCreate(t *testing.T) {
+	tests := []struct {
+		status int
+		want   int
+	}{
+		{http.StatusTooManyRequests, 3},
+		{http.StatusServiceUnavailable, 3},
+		{http.StatusInternalServerError, 1},
+		{http.StatusBadGateway, 1},
+		{http.StatusGatewayTimeout, 1},
+		{http.StatusRequestTimeout, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			server := newRecorder(t, tt.status)
+
+			req, _ := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader([]byte("{}")))
+			resp, err := testPolicy(3).ForCreate().Do(http.DefaultClient, req)
+			if err != nil {
+				t.Fatalf("Do: %v", err)
+			}
+			resp.Body.Close()
+
+			if got := server.attempts(); got != tt.want {
+				t.Errorf("got %d attempts, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryForCreateConnectionErrors(t *testing.T) {
+	// A server that reads the request and drops the connection may have
+	// acted on it
+	var mu sync.Mutex
+	attempts := 0
+	dropped := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		mu.Unlock()
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer dropped.Close()
+
+	for _, tt := range []struct {
+		policy RetryPolicy
+		want   int
+	}{
+		{testPolicy(3), 3},
+		{testPolicy(3).ForCreate(), 1},
+	} {
+		mu.Lock()
+		attempts = 0
+		mu.Unlock()
+
+		req, _ := http.NewRequest(http.MethodPost, dropped.URL, bytes.NewReader([]byte("{}")))
+		if _, err := tt.policy.Do(http.DefaultClient, req); err == nil {
+			t.Fatal("Do succeeded on a dropped connection")
+		}
+		mu.Lock()
+		if attempts != tt.want {
+			t.Errorf("create=%v: got %d attempts, want %d", tt.policy.create, attempts, tt.want)
+		}
+		mu.Unlock()
+	}
+
+	// Nothing listens on a closed port, so the request never left
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, "http://"+addr, bytes.NewReader([]byte("{}")))
+	_, err = testPolicy(2).ForCreate().Do(http.DefaultClient, req)
+	if err == nil {
+		t.Fatal("Do succeeded without a server")
+	}
+	if !connectError(err) {
+		t.Errorf("connectError(%v) = false, want true", err)
+	}
+}
+
+func TestRetryForCreateProxyConnectErrors(t *testing.T) {
+	// Nothing listens on the proxy's port, so the request never left
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &url.URL{Scheme: "http", Host: listener.Addr().String()}
+	listener.Close()
+
+	server := newRecorder(t, http.StatusOK)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy)}}
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader([]byte("{}")))
+	_, err = testPolicy(2).ForCreate().Do(client, req)
+	if err == nil {
+		t.Fatal("Do succeeded without a proxy")
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "proxyconnect" {
+		t.Fatalf("err = %v, want a proxyconnect error", err)
+	}
+	if !connectError(err) {
+		t.Errorf("connectError(%v) = false, want true", err)
+	}
+}
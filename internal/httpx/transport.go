@@ -0,0 +1,147 @@
+package httpx
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// UserAgent is sent with every request that does not set its own. main
+// sets it to include the build version.
+var UserAgent = "fluxxxer/dev"
+
+// maxIdleConnTimeout is how long an unused keep-alive connection is kept
+const maxIdleConnTimeout = 90 * time.Second
+
+// TransportConfig interface to avoid import cycle
+type TransportConfig interface {
+	// GetConnectTimeout bounds dialing and the TLS handshake
+	GetConnectTimeout() time.Duration
+	// GetReadTimeout bounds how long a connection may go without receiving
+	// any data, while waiting for a response or reading its body
+	GetReadTimeout() time.Duration
+	// GetCAFile names a PEM bundle trusted in addition to the system roots
+	GetCAFile() string
+	// GetClientCertFile and GetClientKeyFile name a PEM client certificate
+	// and key for mutual TLS; the key may be in the certificate file
+	GetClientCertFile() string
+	GetClientKeyFile() string
+}
+
+// NewTransport builds the transport shared by all clients. Proxies are
+// taken from HTTPS_PROXY, HTTP_PROXY and NO_PROXY. Zero timeouts disable
+// the corresponding limit.
+func NewTransport(config TransportConfig) (http.RoundTripper, error) {
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.TLSClientConfig = tlsConfig
+
+	connectTimeout := config.GetConnectTimeout()
+	readTimeout := config.GetReadTimeout()
+
+	dialer := &net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil || readTimeout <= 0 {
+			return conn, err
+		}
+		return &deadlineConn{Conn: conn, readTimeout: readTimeout}, nil
+	}
+	transport.TLSHandshakeTimeout = connectTimeout
+
+	// Close idle connections before their read deadline would, so a request
+	// is never handed a connection that is about to time out
+	if readTimeout > 0 {
+		transport.IdleConnTimeout = min(maxIdleConnTimeout, readTimeout/2)
+	}
+
+	return &userAgentTransport{base: transport}, nil
+}
+
+// NewClient returns a client using the shared transport
+func NewClient(config TransportConfig) (*http.Client, error) {
+	transport, err := NewTransport(config)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// newTLSConfig loads the custom CA bundle and client certificate, if any
+func newTLSConfig(config TransportConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if path := config.GetCAFile(); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", path)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	certFile, keyFile := config.GetClientCertFile(), config.GetClientKeyFile()
+	if certFile == "" && keyFile != "" {
+		return nil, errors.New("a client key was given without a client certificate")
+	}
+	if certFile != "" {
+		if keyFile == "" {
+			keyFile = certFile
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// deadlineConn fails a read that waits longer than readTimeout for data
+type deadlineConn struct {
+	net.Conn
+	readTimeout time.Duration
+}
+
+// Read implements net.Conn
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// userAgentTransport sets UserAgent on requests that have none
+type userAgentTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") != "" {
+		return t.base.RoundTrip(req)
+	}
+
+	// A RoundTripper must not modify the caller's request
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", UserAgent)
+	return t.base.RoundTrip(req)
+}
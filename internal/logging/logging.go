@@ -0,0 +1,138 @@
+// Package logging sets up the application's structured logger and masks
+// secrets in everything it writes.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Log formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// FileNone disables the log file
+const FileNone = "none"
+
+// maxLogFileSize is the size at which the log file is rotated at startup
+const maxLogFileSize = 10 * 1024 * 1024
+
+// Config interface to avoid import cycle
+type Config interface {
+	GetLogLevel() string
+	GetLogFormat() string
+	GetLogFile() string
+}
+
+// Setup installs the default slog logger, writing to stderr and to the log
+// file (see DefaultFile). The returned closer flushes and closes the file.
+// If the file cannot be opened, logging continues on stderr alone and the
+// problem is logged as a warning.
+func Setup(config Config) (io.Closer, error) {
+	level, err := ParseLevel(config.GetLogLevel())
+	if err != nil {
+		return nil, err
+	}
+
+	format := strings.ToLower(config.GetLogFormat())
+	if format == "" {
+		format = FormatText
+	}
+	if format != FormatText && format != FormatJSON {
+		return nil, fmt.Errorf("unknown log format %q (expected %s or %s)", format, FormatText, FormatJSON)
+	}
+
+	var (
+		out     io.Writer = os.Stderr
+		closer  io.Closer = io.NopCloser(nil)
+		fileErr error
+	)
+	path := config.GetLogFile()
+	if path == "" {
+		path, fileErr = DefaultFile()
+	}
+	if fileErr == nil && path != FileNone {
+		var file *os.File
+		if file, fileErr = openLogFile(path); fileErr == nil {
+			out = io.MultiWriter(os.Stderr, file)
+			closer = file
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: replaceAttr}
+	var handler slog.Handler
+	if format == FormatJSON {
+		handler = slog.NewJSONHandler(out, opts)
+	} else {
+		handler = slog.NewTextHandler(out, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+
+	if fileErr != nil {
+		slog.Warn("Logging to stderr only", "error", fileErr)
+	}
+	return closer, nil
+}
+
+// ParseLevel parses debug, info, warn or error; empty means info
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level %q (expected debug, info, warn or error)", s)
+}
+
+// StateDir returns the fluxxxer directory under the XDG state directory,
+// $XDG_STATE_HOME/fluxxxer or ~/.local/state/fluxxxer
+func StateDir() (string, error) {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to find the state directory: %w", err)
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "fluxxxer"), nil
+}
+
+// DefaultFile returns the log file under the XDG state directory,
+// $XDG_STATE_HOME/fluxxxer/fluxxxer.log or ~/.local/state/fluxxxer/fluxxxer.log
+func DefaultFile() (string, error) {
+	dir, err := StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "fluxxxer.log"), nil
+}
+
+// openLogFile opens the log file for appending, first moving a large one
+// aside to path.1
+func openLogFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+
+	if info, err := os.Stat(path); err == nil && info.Size() > maxLogFileSize {
+		os.Rename(path, path+".1")
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	return file, nil
+}
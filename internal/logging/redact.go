@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces secrets in logs
+const Redacted = "[REDACTED]"
+
+// minSecretLength keeps short values, which would match too much ordinary
+// text, from being registered as secrets
+const minSecretLength = 6
+
+// sensitiveKeyWords mark attribute and header names whose values are secrets
+var sensitiveKeyWords = []string{"auth", "key", "token", "secret", "cookie", "session", "signature", "password", "app_id", "appid", "app-id"}
+
+// credentialPattern finds credentials given with an auth scheme, such as
+// "Bearer abc123", wherever they appear in text
+var credentialPattern = regexp.MustCompile(`(?i)\b(bearer|token|basic)\s+[A-Za-z0-9._~+/=-]{8,}`)
+
+var (
+	secretsMu sync.RWMutex
+	secrets   []string
+)
+
+// AddSecrets registers values, such as API keys and app IDs, to be masked
+// wherever they appear in log messages and attributes
+func AddSecrets(values ...string) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	for _, value := range values {
+		if len(value) >= minSecretLength {
+			secrets = append(secrets, value)
+		}
+	}
+	// Mask longer secrets first in case one contains another
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+}
+
+// IsSensitiveKey reports whether a log attribute or header name likely holds
+// a credential, such as api_key, Authorization or X-App-ID
+func IsSensitiveKey(name string) bool {
+	name = strings.ToLower(name)
+	for _, word := range sensitiveKeyWords {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact masks registered secrets and scheme-prefixed credentials in s
+func Redact(s string) string {
+	secretsMu.RLock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, Redacted)
+	}
+	secretsMu.RUnlock()
+
+	return credentialPattern.ReplaceAllString(s, "$1 "+Redacted)
+}
+
+// replaceAttr masks sensitive attributes and secrets in every logged value
+func replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	if a.Key != slog.MessageKey && IsSensitiveKey(a.Key) {
+		if a.Value.Kind() == slog.KindString && a.Value.String() == "" {
+			return a
+		}
+		return slog.String(a.Key, Redacted)
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, Redact(err.Error()))
+		}
+	}
+	return a
+}
@@ -0,0 +1,467 @@
+package upscaler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultNameTemplate names the outputs of batch jobs
+const DefaultNameTemplate = "{name}_{type}_x{scale}.{ext}"
+
+// DefaultBatchConcurrency is how many batch jobs run at once by default
+const DefaultBatchConcurrency = 2
+
+// serviceScale is the factor reported for upscales done by the service
+const serviceScale = 4
+
+// JobStatus is the state of a batch job
+type JobStatus string
+
+const (
+	JobQueued  JobStatus = "queued"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+// JobSettings are the options a batch job was queued with
+type JobSettings struct {
+	Type         UpscaleType `json:"type"`
+	Prompt       string      `json:"prompt,omitempty"`
+	OutputFormat string      `json:"output_format,omitempty"`
+	Scale        int         `json:"scale,omitempty"`
+	// OutputDir is where the result is written, the source's directory
+	// when empty
+	OutputDir    string `json:"output_dir,omitempty"`
+	NameTemplate string `json:"name_template,omitempty"`
+}
+
+// BatchJob is one image of a batch
+type BatchJob struct {
+	ID       int         `json:"id"`
+	Source   string      `json:"source"`
+	Settings JobSettings `json:"settings"`
+	Status   JobStatus   `json:"status"`
+	Output   string      `json:"output,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// Batch is a queue of upscale jobs that is saved after every change, so
+// unfinished jobs survive a restart. It is safe for concurrent use.
+type Batch struct {
+	path string
+
+	mu     sync.Mutex
+	jobs   []*BatchJob
+	nextID int
+
+	// saveMu keeps saves from overlapping
+	saveMu sync.Mutex
+	// wake tells Run that jobs were queued
+	wake chan struct{}
+}
+
+// LoadBatch reads the batch saved at path; a missing file means an empty
+// batch, and a batch that cannot be read is returned empty with the error.
+// Jobs that were running when the batch was saved are queued again.
+func LoadBatch(path string) (*Batch, error) {
+	b := &Batch{path: path, nextID: 1, wake: make(chan struct{}, 1)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return b, fmt.Errorf("failed to read upscale batch: %w", err)
+	}
+	if err := json.Unmarshal(data, &b.jobs); err != nil {
+		b.jobs = nil
+		return b, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	for _, job := range b.jobs {
+		if job.Status == JobRunning {
+			job.Status = JobQueued
+		}
+		b.nextID = max(b.nextID, job.ID+1)
+	}
+	return b, nil
+}
+
+// Jobs returns copies of all jobs in the order they were added
+func (b *Batch) Jobs() []BatchJob {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	jobs := make([]BatchJob, len(b.jobs))
+	for i, job := range b.jobs {
+		jobs[i] = *job
+	}
+	return jobs
+}
+
+// Pending reports how many jobs are queued or running
+func (b *Batch) Pending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := 0
+	for _, job := range b.jobs {
+		if job.Status == JobQueued || job.Status == JobRunning {
+			n++
+		}
+	}
+	return n
+}
+
+// Add queues a job for every source with the given settings and returns
+// them
+func (b *Batch) Add(sources []string, settings JobSettings) ([]BatchJob, error) {
+	if settings.NameTemplate == "" {
+		settings.NameTemplate = DefaultNameTemplate
+	}
+	if err := ValidateNameTemplate(settings.NameTemplate); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	added := make([]BatchJob, len(sources))
+	for i, source := range sources {
+		job := &BatchJob{ID: b.nextID, Source: source, Settings: settings, Status: JobQueued}
+		b.nextID++
+		b.jobs = append(b.jobs, job)
+		added[i] = *job
+	}
+	b.mu.Unlock()
+
+	b.notify()
+	return added, b.save()
+}
+
+// Retry queues a failed job again
+func (b *Batch) Retry(id int) error {
+	b.mu.Lock()
+	job := b.find(id)
+	if job == nil || job.Status != JobFailed {
+		b.mu.Unlock()
+		return fmt.Errorf("upscale job %d has not failed", id)
+	}
+	job.Status, job.Error = JobQueued, ""
+	b.mu.Unlock()
+
+	b.notify()
+	return b.save()
+}
+
+// ClearFinished removes the jobs that are done
+func (b *Batch) ClearFinished() error {
+	b.mu.Lock()
+	kept := b.jobs[:0]
+	for _, job := range b.jobs {
+		if job.Status != JobDone {
+			kept = append(kept, job)
+		}
+	}
+	b.jobs = kept
+	b.mu.Unlock()
+
+	return b.save()
+}
+
+// Run upscales the queued jobs, at most concurrency at a time, until none
+// are left, including jobs added or retried while it runs. backend returns
+// the upscaler for a job's type; images for the service are fitted to its
+// limits without asking. onUpdate, if set, is called from the worker
+// goroutines with every change of a job and its progress. Jobs stopped
+// because ctx is done are queued again.
+func (b *Batch) Run(ctx context.Context, concurrency int, backend func(UpscaleType) (Upscaler, error), onUpdate func(BatchJob, Progress)) {
+	if concurrency < 1 {
+		concurrency = DefaultBatchConcurrency
+	}
+	update := func(job BatchJob, p Progress) {
+		if onUpdate != nil {
+			onUpdate(job, p)
+		}
+	}
+
+	running := 0
+	finished := make(chan struct{})
+	for ctx.Err() == nil {
+		if running < concurrency {
+			if job, ok := b.next(); ok {
+				running++
+				if err := b.save(); err != nil {
+					slog.Error("Failed to save upscale batch", "error", err)
+				}
+				update(job, Progress{})
+
+				go func() {
+					output, err := runBatchJob(ctx, job, backend, func(p Progress) {
+						update(job, p)
+					})
+					update(b.finish(job.ID, output, err, ctx.Err() != nil), Progress{})
+					finished <- struct{}{}
+				}()
+				continue
+			}
+			if running == 0 {
+				return
+			}
+		}
+
+		// Wait for a free slot or for jobs to be added or retried
+		select {
+		case <-finished:
+			running--
+		case <-b.wake:
+		case <-ctx.Done():
+		}
+	}
+
+	for ; running > 0; running-- {
+		<-finished
+	}
+}
+
+// next marks the first queued job as running and returns it, or false when
+// none is queued
+func (b *Batch) next() (BatchJob, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, job := range b.jobs {
+		if job.Status == JobQueued {
+			job.Status, job.Error = JobRunning, ""
+			return *job, true
+		}
+	}
+	return BatchJob{}, false
+}
+
+// finish records the outcome of a job and saves the batch. A job
+// interrupted by cancellation is queued again.
+func (b *Batch) finish(id int, output string, err error, cancelled bool) BatchJob {
+	b.mu.Lock()
+	job := b.find(id)
+	switch {
+	case err == nil:
+		job.Status, job.Output = JobDone, output
+	case cancelled:
+		job.Status = JobQueued
+	default:
+		job.Status, job.Error = JobFailed, err.Error()
+	}
+	result := *job
+	b.mu.Unlock()
+
+	if err != nil && !cancelled {
+		slog.Error("Batch upscale failed", "source", result.Source, "error", err)
+	}
+	if err := b.save(); err != nil {
+		slog.Error("Failed to save upscale batch", "error", err)
+	}
+	return result
+}
+
+// notify wakes Run, if it is waiting
+func (b *Batch) notify() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// find returns the job with the given ID; b.mu must be held
+func (b *Batch) find(id int) *BatchJob {
+	for _, job := range b.jobs {
+		if job.ID == id {
+			return job
+		}
+	}
+	return nil
+}
+
+// save writes the batch to its file, through a temporary file so a crash
+// cannot truncate it
+func (b *Batch) save() error {
+	if b.path == "" {
+		return nil
+	}
+
+	b.saveMu.Lock()
+	defer b.saveMu.Unlock()
+
+	b.mu.Lock()
+	data, err := json.MarshalIndent(b.jobs, "", "  ")
+	b.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode upscale batch: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(b.path), 0o700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to save upscale batch: %w", err)
+	}
+	if err := os.Rename(tmp, b.path); err != nil {
+		return fmt.Errorf("failed to save upscale batch: %w", err)
+	}
+	return nil
+}
+
+// runBatchJob upscales the source of a job and writes the result to its
+// output directory, returning the output path
+func runBatchJob(ctx context.Context, job BatchJob, backend func(UpscaleType) (Upscaler, error), onProgress func(Progress)) (string, error) {
+	settings := job.Settings
+	u, err := backend(settings.Type)
+	if err != nil {
+		return "", err
+	}
+
+	opts := UpscaleOptions{
+		Type:         settings.Type,
+		Prompt:       settings.Prompt,
+		OutputFormat: settings.OutputFormat,
+		Scale:        settings.Scale,
+		OnProgress:   onProgress,
+	}
+	if (opts.Type == UpscaleConservative || opts.Type == UpscaleCreative) && opts.Prompt == "" {
+		return "", fmt.Errorf("prompt is required for %s upscaling", opts.Type)
+	}
+
+	source := job.Source
+	if !settings.Type.IsLocal() {
+		prepared, err := PrepareImage(source, settings.Type)
+		if err != nil {
+			return "", err
+		}
+		defer prepared.Cleanup()
+		if prepared.Changed() {
+			slog.Info("Adjusted batch image for the upscaler", "source", source, "changes", strings.Join(prepared.Changes, ", "))
+		}
+		source = prepared.Path
+	}
+
+	result, err := u.UpscaleImageContext(ctx, source, opts)
+	if err != nil {
+		return "", err
+	}
+	tmpPath, err := u.Download(ctx, result, onProgress)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpPath)
+
+	scale := settings.Scale
+	switch {
+	case !settings.Type.IsLocal():
+		scale = serviceScale
+	case scale == 0:
+		scale = DefaultLocalScale
+	}
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(tmpPath)), ".")
+	name, err := OutputName(settings.NameTemplate, job.Source, settings.Type, scale, ext)
+	if err != nil {
+		return "", err
+	}
+
+	dir := settings.OutputDir
+	if dir == "" {
+		dir = filepath.Dir(job.Source)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create output folder: %w", err)
+	}
+
+	return writeUnique(filepath.Join(dir, name), tmpPath)
+}
+
+// writeUnique copies src to path, adding " (2)", " (3)" and so on before
+// the extension while the name is taken, and returns the path written
+func writeUnique(path, src string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", fmt.Errorf("failed to open upscaled image: %w", err)
+	}
+	defer in.Close()
+
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for n := 1; ; n++ {
+		candidate := path
+		if n > 1 {
+			candidate = fmt.Sprintf("%s (%d)%s", base, n, ext)
+		}
+
+		out, err := os.OpenFile(candidate, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to create output file: %w", err)
+		}
+
+		_, err = io.Copy(out, in)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(candidate)
+			return "", fmt.Errorf("failed to write upscaled image: %w", err)
+		}
+		return candidate, nil
+	}
+}
+
+// namePlaceholder matches the placeholders of a name template
+var namePlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+// ValidateNameTemplate checks that a name template uses only {name},
+// {type}, {scale} and {ext}, includes {name} so outputs do not collide, and
+// stays within the output folder
+func ValidateNameTemplate(template string) error {
+	for _, placeholder := range namePlaceholder.FindAllString(template, -1) {
+		switch placeholder {
+		case "{name}", "{type}", "{scale}", "{ext}":
+		default:
+			return fmt.Errorf("unknown placeholder %s in name template (use {name}, {type}, {scale} and {ext})", placeholder)
+		}
+	}
+	if !strings.Contains(template, "{name}") {
+		return errors.New("name template must contain {name}")
+	}
+	if strings.ContainsAny(template, `/\`) {
+		return errors.New("name template cannot contain folders")
+	}
+	return nil
+}
+
+// OutputName fills in a name template for an upscaled copy of source: the
+// file name without extension, the upscale type, the scale factor and the
+// extension of the upscaled image
+func OutputName(template, source string, t UpscaleType, scale int, ext string) (string, error) {
+	if err := ValidateNameTemplate(template); err != nil {
+		return "", err
+	}
+
+	base := filepath.Base(source)
+	name := strings.TrimSuffix(base, filepath.Ext(base))
+	return strings.NewReplacer(
+		"{name}", name,
+		"{type}", string(t),
+		"{scale}", strconv.Itoa(scale),
+		"{ext}", ext,
+	).Replace(template), nil
+}
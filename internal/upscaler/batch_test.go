@@ -0,0 +1,242 @@
+package upscaler
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// jobStatuses returns the source name and status of every job in the batch
+func jobStatuses(b *Batch) []string {
+	var statuses []string
+	for _, job := range b.Jobs() {
+		statuses = append(statuses, strings.Join([]string{filepath.Base(job.Source), string(job.Status)}, ":"))
+	}
+	return statuses
+}
+
+func TestLoadBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "batch.json")
+	saved := `[
+		{"id": 3, "source": "/a.png", "settings": {"type": "fast"}, "status": "done", "output": "/a_fast_x4.png"},
+		{"id": 7, "source": "/b.png", "settings": {"type": "fast"}, "status": "running"},
+		{"id": 5, "source": "/c.png", "settings": {"type": "fast"}, "status": "failed", "error": "quota exceeded"}
+	]`
+	if err := os.WriteFile(path, []byte(saved), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := LoadBatch(path)
+	if err != nil {
+		t.Fatalf("LoadBatch: %v", err)
+	}
+	// The job that was running when the batch was saved is queued again
+	want := []string{"a.png:done", "b.png:queued", "c.png:failed"}
+	if got := jobStatuses(b); !slices.Equal(got, want) {
+		t.Errorf("jobs = %v, want %v", got, want)
+	}
+	if b.Pending() != 1 {
+		t.Errorf("Pending = %d, want 1", b.Pending())
+	}
+
+	// New jobs are numbered after the highest saved ID
+	added, err := b.Add([]string{"/d.png"}, JobSettings{Type: UpscaleFast})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if added[0].ID != 8 || added[0].Settings.NameTemplate != DefaultNameTemplate {
+		t.Errorf("added job = %+v, want ID 8 with the default name template", added[0])
+	}
+
+	// The batch is saved on every change
+	reloaded, err := LoadBatch(path)
+	if err != nil {
+		t.Fatalf("reloading: %v", err)
+	}
+	if got := jobStatuses(reloaded); !slices.Equal(got, append(want, "d.png:queued")) {
+		t.Errorf("reloaded jobs = %v", got)
+	}
+}
+
+func TestLoadBatchErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	b, err := LoadBatch(filepath.Join(dir, "missing.json"))
+	if err != nil || len(b.Jobs()) != 0 {
+		t.Errorf("LoadBatch of a missing file = %v, %v, want an empty batch", b.Jobs(), err)
+	}
+
+	path := filepath.Join(dir, "broken.json")
+	if err := os.WriteFile(path, []byte(`[{"id": 1, "source": `), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	b, err = LoadBatch(path)
+	if err == nil || !strings.Contains(err.Error(), "failed to parse") {
+		t.Errorf("err = %v, want a parse error", err)
+	}
+	if b == nil || len(b.Jobs()) != 0 {
+		t.Fatal("a broken batch is not returned empty")
+	}
+	if _, err := b.Add([]string{"/a.png"}, JobSettings{Type: UpscaleFast}); err != nil {
+		t.Errorf("Add to the empty batch: %v", err)
+	}
+}
+
+func TestBatchRetry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "batch.json")
+	b, _ := LoadBatch(path)
+	if _, err := b.Add([]string{"/a.png", "/b.png"}, JobSettings{Type: UpscaleFast}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	a, _ := b.next()
+	b.finish(a.ID, "", os.ErrPermission, false)
+
+	if job := b.Jobs()[0]; job.Status != JobFailed || job.Error == "" {
+		t.Fatalf("job = %+v, want it failed with the error", job)
+	}
+	// Only failed jobs can be retried
+	if err := b.Retry(b.Jobs()[1].ID); err == nil {
+		t.Error("Retry of a queued job succeeded")
+	}
+	if err := b.Retry(99); err == nil {
+		t.Error("Retry of a missing job succeeded")
+	}
+
+	if err := b.Retry(a.ID); err != nil {
+		t.Fatalf("Retry: %v", err)
+	}
+	if job := b.Jobs()[0]; job.Status != JobQueued || job.Error != "" {
+		t.Errorf("retried job = %+v, want it queued without the error", job)
+	}
+	if b.Pending() != 2 {
+		t.Errorf("Pending = %d, want 2", b.Pending())
+	}
+
+	reloaded, _ := LoadBatch(path)
+	if job := reloaded.Jobs()[0]; job.Status != JobQueued {
+		t.Errorf("saved job = %+v, want it queued", job)
+	}
+}
+
+func TestBatchClearFinished(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "batch.json")
+	b, _ := LoadBatch(path)
+	if _, err := b.Add([]string{"/a.png", "/b.png", "/c.png", "/d.png"}, JobSettings{Type: UpscaleFast}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	done, _ := b.next()
+	b.finish(done.ID, "/a_fast_x4.png", nil, false)
+	failed, _ := b.next()
+	b.finish(failed.ID, "", os.ErrNotExist, false)
+	b.next()
+
+	if err := b.ClearFinished(); err != nil {
+		t.Fatalf("ClearFinished: %v", err)
+	}
+	// Failed, running and queued jobs stay
+	want := []string{"b.png:failed", "c.png:running", "d.png:queued"}
+	if got := jobStatuses(b); !slices.Equal(got, want) {
+		t.Errorf("jobs = %v, want %v", got, want)
+	}
+
+	reloaded, _ := LoadBatch(path)
+	if got := jobStatuses(reloaded); !slices.Equal(got, []string{"b.png:failed", "c.png:queued", "d.png:queued"}) {
+		t.Errorf("saved jobs = %v", got)
+	}
+}
+
+func TestValidateNameTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		wantErr  string
+	}{
+		{template: DefaultNameTemplate},
+		{template: "{name}"},
+		{template: "upscaled-{name}-{scale}x.{ext}"},
+		{template: "{name}.{ext}.{ext}"},
+		{template: "{type}_x{scale}.{ext}", wantErr: "must contain {name}"},
+		{template: "{name}_{model}.{ext}", wantErr: "unknown placeholder {model}"},
+		{template: "{Name}.{ext}", wantErr: "unknown placeholder {Name}"},
+		{template: "{}{name}", wantErr: "unknown placeholder {}"},
+		{template: "out/{name}.{ext}", wantErr: "cannot contain folders"},
+		{template: `..\{name}.{ext}`, wantErr: "cannot contain folders"},
+		{template: "", wantErr: "must contain {name}"},
+	}
+
+	for _, tt := range tests {
+		err := ValidateNameTemplate(tt.template)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("ValidateNameTemplate(%q) = %v", tt.template, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("ValidateNameTemplate(%q) = %v, want %q", tt.template, err, tt.wantErr)
+		}
+	}
+}
+
+func TestOutputName(t *testing.T) {
+	tests := []struct {
+		template string
+		source   string
+		typ      UpscaleType
+		scale    int
+		ext      string
+		want     string
+	}{
+		{DefaultNameTemplate, "/photos/cat.jpg", UpscaleFast, 4, "png", "cat_fast_x4.png"},
+		{DefaultNameTemplate, "/photos/my.cat.webp", UpscaleLocal, 2, "webp", "my.cat_local_x2.webp"},
+		{"{name}", "/photos/noext", UpscaleFast, 4, "png", "noext"},
+		{"{scale}x-{name}-{name}.{ext}", "cat.png", UpscaleCreative, 4, "jpeg", "4x-cat-cat.jpeg"},
+	}
+
+	for _, tt := range tests {
+		got, err := OutputName(tt.template, tt.source, tt.typ, tt.scale, tt.ext)
+		if err != nil || got != tt.want {
+			t.Errorf("OutputName(%q, %q) = %q, %v, want %q", tt.template, tt.source, got, err, tt.want)
+		}
+	}
+
+	if _, err := OutputName("../{name}", "cat.png", UpscaleFast, 4, "png"); err == nil {
+		t.Error("OutputName accepted a template with a folder")
+	}
+}
+
+func TestWriteUnique(t *testing.T) {
+	dir := t.TempDir()
+	src := writeFile(t, "upscaled.png", []byte("upscaled"))
+	path := filepath.Join(dir, "cat_fast_x4.png")
+
+	// Taken names get a counter before the extension
+	want := []string{"cat_fast_x4.png", "cat_fast_x4 (2).png", "cat_fast_x4 (3).png"}
+	for _, name := range want {
+		got, err := writeUnique(path, src)
+		if err != nil {
+			t.Fatalf("writeUnique: %v", err)
+		}
+		if got != filepath.Join(dir, name) {
+			t.Errorf("writeUnique = %s, want %s", got, name)
+		}
+		if data, _ := os.ReadFile(got); string(data) != "upscaled" {
+			t.Errorf("%s = %q, want the source", name, data)
+		}
+	}
+
+	// Files without an extension get the counter at the end
+	noext := filepath.Join(dir, "cat")
+	writeUnique(noext, src)
+	if got, err := writeUnique(noext, src); err != nil || got != noext+" (2)" {
+		t.Errorf("writeUnique = %s, %v, want %s (2)", got, err, noext)
+	}
+
+	if _, err := writeUnique(filepath.Join(dir, "missing", "cat.png"), src); err == nil {
+		t.Error("writeUnique into a missing folder succeeded")
+	}
+	if _, err := writeUnique(filepath.Join(dir, "other.png"), filepath.Join(dir, "no-source.png")); err == nil {
+		t.Error("writeUnique of a missing source succeeded")
+	}
+}
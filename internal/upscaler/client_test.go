@@ -0,0 +1,171 @@
+package upscaler
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"fluxxxer/internal/config"
+	"fluxxxer/internal/flux/fluxtest"
+	"fluxxxer/internal/httpx"
+	"fluxxxer/internal/upscaler/upscalertest"
+)
+
+// newTestClient returns a client for the fake upscaler that polls quickly.
+// Results are written to a temporary directory removed with the test.
+func newTestClient(t *testing.T, server *upscalertest.Server, apiKey string) *Client {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	c := NewClient(&config.Config{
+		UpscalerAPIURL:   server.Endpoint(),
+		UpscalerAPIKey:   apiKey,
+		UpscalerDecoder:  "auto",
+		RetryMaxAttempts: 1,
+	})
+	c.pollInterval = time.Millisecond
+	return c
+}
+
+// writeTestImage writes a PNG of the given size and returns its path
+func writeTestImage(t *testing.T, width, height int) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "input.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, fluxtest.Placeholder(width, height)); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// imageSize returns the dimensions of the image file at path
+func imageSize(t *testing.T, path string) (int, int) {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", path, err)
+	}
+	return cfg.Width, cfg.Height
+}
+
+func TestUpscaleModes(t *testing.T) {
+	tests := []struct {
+		mode       upscalertest.Mode
+		upscale    UpscaleType
+		wantRemote bool
+	}{
+		{mode: upscalertest.ModeBinary, upscale: UpscaleFast},
+		{mode: upscalertest.ModeBase64, upscale: UpscaleFast},
+		{mode: upscalertest.ModeURL, upscale: UpscaleFast, wantRemote: true},
+		{mode: upscalertest.ModeAsync, upscale: UpscaleConservative, wantRemote: true},
+		{mode: upscalertest.ModeAuto, upscale: UpscaleCreative, wantRemote: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			server := upscalertest.NewServer()
+			defer server.Close()
+			server.Mode = tt.mode
+			server.APIKey = "secret"
+
+			c := newTestClient(t, server, "secret")
+			input := writeTestImage(t, 64, 48)
+
+			var phases []Phase
+			result, err := c.UpscaleImageContext(context.Background(), input, UpscaleOptions{
+				Type: tt.upscale,
+				OnProgress: func(p Progress) {
+					phases = append(phases, p.Phase)
+				},
+			})
+			if err != nil {
+				t.Fatalf("UpscaleImageContext: %v", err)
+			}
+			if result.IsRemote() != tt.wantRemote {
+				t.Errorf("IsRemote = %v, want %v (URL %q)", result.IsRemote(), tt.wantRemote, result.URL)
+			}
+
+			path, err := c.Download(context.Background(), result, nil)
+			if err != nil {
+				t.Fatalf("Download: %v", err)
+			}
+			if width, height := imageSize(t, path); width != 256 || height != 192 {
+				t.Errorf("result is %dx%d, want 256x192", width, height)
+			}
+
+			if tt.mode == upscalertest.ModeAsync && !slices.Contains(phases, PhaseQueued) {
+				t.Errorf("phases = %v, want the job to be queued", phases)
+			}
+		})
+	}
+}
+
+func TestUpscaleAsyncJobFailed(t *testing.T) {
+	server := upscalertest.NewServer()
+	defer server.Close()
+	server.Mode = upscalertest.ModeAsync
+	server.FailWith = "content moderation"
+
+	c := newTestClient(t, server, "")
+	_, err := c.UpscaleImageContext(context.Background(), writeTestImage(t, 32, 32), UpscaleOptions{Type: UpscaleConservative})
+	if err == nil || !strings.Contains(err.Error(), "upscaling job failed: content moderation") {
+		t.Fatalf("err = %v, want the job error", err)
+	}
+}
+
+func TestUpscaleInvalidAPIKey(t *testing.T) {
+	server := upscalertest.NewServer()
+	defer server.Close()
+	server.APIKey = "secret"
+
+	c := newTestClient(t, server, "wrong")
+	_, err := c.UpscaleImageContext(context.Background(), writeTestImage(t, 32, 32), UpscaleOptions{Type: UpscaleFast})
+
+	var apiErr *httpx.APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want an *httpx.APIError", err)
+	}
+	if apiErr.StatusCode != 401 || apiErr.Message != "invalid API key" {
+		t.Errorf("error = %d %q, want 401 %q", apiErr.StatusCode, apiErr.Message, "invalid API key")
+	}
+}
+
+func TestUpscaleCanceledWhilePolling(t *testing.T) {
+	server := upscalertest.NewServer()
+	defer server.Close()
+	server.Mode = upscalertest.ModeAsync
+	server.PollsUntilDone = 1000
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := newTestClient(t, server, "")
+	_, err := c.UpscaleImageContext(ctx, writeTestImage(t, 32, 32), UpscaleOptions{
+		Type: UpscaleConservative,
+		OnProgress: func(p Progress) {
+			if p.Polls == 2 {
+				cancel()
+			}
+		},
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,368 @@
+package upscaler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Placeholders of an upscaler command template
+const (
+	PlaceholderInput  = "{in}"
+	PlaceholderOutput = "{out}"
+	PlaceholderScale  = "{scale}"
+)
+
+// DefaultCommandTimeout bounds a command run when no timeout is configured
+const DefaultCommandTimeout = 10 * time.Minute
+
+// commandWaitDelay is how long a killed command may keep its output open
+const commandWaitDelay = 5 * time.Second
+
+// stderrTail is the number of stderr lines kept for error messages
+const stderrTail = 10
+
+var (
+	placeholderPattern = regexp.MustCompile(`\{[^{}\s]*\}`)
+	// percentPattern matches the progress lines printed by tools such as
+	// realesrgan-ncnn-vulkan
+	percentPattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)%$`)
+)
+
+// CommandConfig interface to avoid import cycle
+type CommandConfig interface {
+	GetUpscalerCommand() string
+	GetUpscalerCommandTimeout() time.Duration
+}
+
+// CommandUpscaler runs an upscaling program installed on this machine, such
+// as Real-ESRGAN or waifu2x, from a template like
+// "realesrgan -i {in} -o {out} -s {scale}"
+type CommandUpscaler struct {
+	args    []string
+	timeout time.Duration
+
+	// templateErr reports an invalid template on the first upscale
+	templateErr error
+}
+
+// NewCommandUpscaler creates an upscaler for the configured command template
+func NewCommandUpscaler(config CommandConfig) *CommandUpscaler {
+	u := &CommandUpscaler{timeout: config.GetUpscalerCommandTimeout()}
+	if u.timeout <= 0 {
+		u.timeout = DefaultCommandTimeout
+	}
+	u.args, u.templateErr = ParseCommandTemplate(config.GetUpscalerCommand())
+	return u
+}
+
+// ParseCommandTemplate splits a command template into the program and its
+// arguments. Arguments are separated by spaces and may be quoted with ' or
+// "; placeholders are filled in after splitting, so paths with spaces need
+// no quotes. The template must use {in} and {out}, may use {scale}, and its
+// program must be installed.
+func ParseCommandTemplate(template string) ([]string, error) {
+	args, err := splitCommand(template)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New("upscaler command is empty")
+	}
+
+	for _, placeholder := range placeholderPattern.FindAllString(template, -1) {
+		switch placeholder {
+		case PlaceholderInput, PlaceholderOutput, PlaceholderScale:
+		default:
+			return nil, fmt.Errorf("unknown placeholder %s in upscaler command (use %s, %s and %s)",
+				placeholder, PlaceholderInput, PlaceholderOutput, PlaceholderScale)
+		}
+	}
+	for _, placeholder := range []string{PlaceholderInput, PlaceholderOutput} {
+		if !strings.Contains(template, placeholder) {
+			return nil, fmt.Errorf("upscaler command must contain %s", placeholder)
+		}
+	}
+	if placeholderPattern.MatchString(args[0]) {
+		return nil, errors.New("upscaler command must start with the program to run")
+	}
+
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return nil, fmt.Errorf("upscaler command program not found: %w", err)
+	}
+
+	return args, nil
+}
+
+// splitCommand splits s at unquoted spaces, removing the quotes
+func splitCommand(s string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		inArg   bool
+		quote   rune
+	)
+
+	for _, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("upscaler command has an unterminated %c quote", quote)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// UpscaleImageContext runs the command on an image file and returns the
+// result
+func (u *CommandUpscaler) UpscaleImageContext(ctx context.Context, imagePath string, opts UpscaleOptions) (*UpscaleResult, error) {
+	if u.templateErr != nil {
+		return nil, u.templateErr
+	}
+	if imagePath == "" {
+		return nil, errors.New("image path cannot be empty")
+	}
+
+	return u.run(ctx, imagePath, opts)
+}
+
+// UpscaleReader saves the image read from r to a temporary file, keeping
+// the extension of name for the program, and runs the command on it. r is
+// not closed.
+func (u *CommandUpscaler) UpscaleReader(ctx context.Context, r io.Reader, name string, opts UpscaleOptions) (*UpscaleResult, error) {
+	if u.templateErr != nil {
+		return nil, u.templateErr
+	}
+
+	ext := filepath.Ext(name)
+	if ext == "" {
+		ext = ".png"
+	}
+	tmpFile, err := os.CreateTemp("", "upscale-input-*"+ext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+
+	_, err = io.Copy(tmpFile, r)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write image for the upscaler command: %w", err)
+	}
+
+	return u.run(ctx, tmpPath, opts)
+}
+
+// Download returns the path of the command's result
+func (u *CommandUpscaler) Download(ctx context.Context, result *UpscaleResult, onProgress func(Progress)) (string, error) {
+	if result == nil || result.URL == "" {
+		return "", errors.New("no upscaled image returned")
+	}
+	return result.URL, nil
+}
+
+// run fills in the template for inputPath and runs it under the timeout,
+// logging its output, and moves the image it wrote to a temporary file
+func (u *CommandUpscaler) run(ctx context.Context, inputPath string, opts UpscaleOptions) (*UpscaleResult, error) {
+	scale, err := localScale(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// The program writes into a directory of its own, so nothing is left
+	// behind when it fails halfway
+	dir, err := os.MkdirTemp("", "upscale-command-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ext := outputExt(opts.OutputFormat)
+	outputPath := filepath.Join(dir, "upscaled"+ext)
+
+	replacer := strings.NewReplacer(
+		PlaceholderInput, inputPath,
+		PlaceholderOutput, outputPath,
+		PlaceholderScale, strconv.Itoa(scale),
+	)
+	args := make([]string, len(u.args))
+	for i, arg := range u.args {
+		args[i] = replacer.Replace(arg)
+	}
+	program := filepath.Base(args[0])
+
+	report := func(status string) {
+		if opts.OnProgress != nil {
+			opts.OnProgress(Progress{Phase: PhaseProcessing, Status: status})
+		}
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	stderr := &lineWriter{keep: stderrTail, onLine: func(line string) {
+		if m := percentPattern.FindStringSubmatch(line); m != nil {
+			slog.Debug("Upscaler command progress", "program", program, "percent", m[1])
+			report(fmt.Sprintf("running %s, %s%%", program, m[1]))
+			return
+		}
+		slog.Info("Upscaler command output", "program", program, "stderr", line)
+	}}
+	stdout := &lineWriter{onLine: func(line string) {
+		slog.Debug("Upscaler command output", "program", program, "stdout", line)
+	}}
+
+	cmd := exec.CommandContext(runCtx, args[0], args[1:]...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = commandWaitDelay
+	killProcessGroup(cmd)
+
+	slog.Info("Running upscaler command", "args", args, "timeout", u.timeout)
+	report("running " + program)
+	start := time.Now()
+
+	err = cmd.Run()
+	stdout.flush()
+	stderr.flush()
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("upscaler command timed out after %s%s", u.timeout, stderr.tail())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("upscaler command failed: %w%s", err, stderr.tail())
+	}
+
+	info, err := os.Stat(outputPath)
+	if err != nil || info.Size() == 0 {
+		return nil, fmt.Errorf("upscaler command did not write the image to %s%s", PlaceholderOutput, stderr.tail())
+	}
+
+	// Move the image out of the directory removed on return
+	tmpFile, err := os.CreateTemp("", "upscaled-*"+ext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+	if err := os.Rename(outputPath, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to move upscaled image: %w", err)
+	}
+
+	slog.Info("Upscaler command finished", "program", program, "path", tmpPath, "bytes", info.Size(), "took", time.Since(start))
+	return &UpscaleResult{URL: tmpPath, Status: "succeeded", IsCompleted: true}, nil
+}
+
+// outputExt returns the file extension that asks the program for the
+// output format
+func outputExt(format string) string {
+	switch format {
+	case "jpeg":
+		return ".jpg"
+	case "webp":
+		return ".webp"
+	}
+	return ".png"
+}
+
+// lineWriter passes every line written to it to onLine, splitting at
+// newlines and at the carriage returns of progress bars, and keeps the
+// last keep lines
+type lineWriter struct {
+	keep   int
+	onLine func(string)
+
+	mu    sync.Mutex
+	buf   []byte
+	lines []string
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := strings.IndexAny(string(w.buf), "\r\n")
+		if i < 0 {
+			break
+		}
+		w.line(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush passes on a last line that did not end in a newline
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.line(string(w.buf))
+	w.buf = nil
+}
+
+func (w *lineWriter) line(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	w.onLine(line)
+	if w.keep > 0 && !percentPattern.MatchString(line) {
+		w.lines = append(w.lines, line)
+		if len(w.lines) > w.keep {
+			w.lines = w.lines[1:]
+		}
+	}
+}
+
+// tail returns the kept lines for an error message, empty when there are
+// none
+func (w *lineWriter) tail() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.lines) == 0 {
+		return ""
+	}
+	return ": " + strings.Join(w.lines, "; ")
+}
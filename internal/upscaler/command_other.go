@@ -0,0 +1,9 @@
+//go:build !unix
+
+package upscaler
+
+import "os/exec"
+
+// killProcessGroup leaves cmd as it is; without process groups only the
+// command itself is killed when it is cancelled
+func killProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,254 @@
+//go:build unix
+
+package upscaler
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"fluxxxer/internal/config"
+)
+
+// writeScript writes an executable shell script with the given body and
+// returns its path. The script's arguments are saved to "args" next to it.
+func writeScript(t *testing.T, body string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "stub-upscaler")
+	script := "#!/bin/sh\nprintf '%s\\n' \"$@\" > \"$(dirname \"$0\")/args\"\n" + body + "\n"
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// scriptArgs returns the arguments the script at path was run with
+func scriptArgs(t *testing.T, path string) []string {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(path), "args"))
+	if err != nil {
+		t.Fatalf("the script did not run: %v", err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// newCommandUpscaler returns an upscaler running template, which has its
+// temporary files removed with the test
+func newCommandUpscaler(t *testing.T, template string, timeout time.Duration) *CommandUpscaler {
+	t.Helper()
+	t.Setenv("TMPDIR", t.TempDir())
+
+	u := NewCommandUpscaler(&config.Config{UpscalerCommand: template, CommandTimeout: timeout})
+	if u.templateErr != nil {
+		t.Fatalf("template %q: %v", template, u.templateErr)
+	}
+	return u
+}
+
+func TestCommandUpscalerSubstitutesPlaceholders(t *testing.T) {
+	// The stub "upscales" by copying its input, reporting progress
+	script := writeScript(t, `echo "50%" >&2; cp "$2" "$4"`)
+	u := newCommandUpscaler(t, script+" -i {in} -o {out} -s {scale}", 0)
+
+	input := writeFile(t, "my photo.png", []byte("input image"))
+	var statuses []string
+	result, err := u.UpscaleImageContext(context.Background(), input, UpscaleOptions{
+		Type:         UpscaleCommand,
+		Scale:        2,
+		OutputFormat: "jpeg",
+		OnProgress: func(p Progress) {
+			statuses = append(statuses, p.Status)
+		},
+	})
+	if err != nil {
+		t.Fatalf("UpscaleImageContext: %v", err)
+	}
+
+	args := scriptArgs(t, script)
+	if len(args) != 6 || args[0] != "-i" || args[1] != input || args[2] != "-o" || args[4] != "-s" || args[5] != "2" {
+		t.Fatalf("args = %q, want the input, an output path and the scale", args)
+	}
+	if filepath.Ext(args[3]) != ".jpg" {
+		t.Errorf("output path = %s, want a .jpg for the jpeg format", args[3])
+	}
+	if _, err := os.Stat(filepath.Dir(args[3])); !os.IsNotExist(err) {
+		t.Errorf("the command's directory is left behind: %v", err)
+	}
+
+	path, err := u.Download(context.Background(), result, nil)
+	if err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "input image" {
+		t.Errorf("result = %q, %v, want the file the command wrote", data, err)
+	}
+	if filepath.Ext(path) != ".jpg" {
+		t.Errorf("result path = %s, want a .jpg", path)
+	}
+
+	want := []string{"running stub-upscaler", "running stub-upscaler, 50%"}
+	if !slices.Equal(statuses, want) {
+		t.Errorf("statuses = %q, want %q", statuses, want)
+	}
+}
+
+func TestCommandUpscalerReader(t *testing.T) {
+	script := writeScript(t, `cp "$1" "$2"`)
+	u := newCommandUpscaler(t, script+" {in} {out}", 0)
+
+	result, err := u.UpscaleReader(context.Background(), strings.NewReader("streamed image"), "input.webp", UpscaleOptions{Type: UpscaleCommand})
+	if err != nil {
+		t.Fatalf("UpscaleReader: %v", err)
+	}
+
+	input := scriptArgs(t, script)[0]
+	if filepath.Ext(input) != ".webp" {
+		t.Errorf("input = %s, want the extension of the name", input)
+	}
+	if _, err := os.Stat(input); !os.IsNotExist(err) {
+		t.Errorf("the input file is left behind: %v", err)
+	}
+	if data, _ := os.ReadFile(result.URL); string(data) != "streamed image" {
+		t.Errorf("result = %q, want the streamed image", data)
+	}
+}
+
+func TestCommandUpscalerFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantErr  []string
+		rejected []string
+	}{
+		{
+			name: "exit status with stderr tail",
+			body: `i=1; while [ $i -le 12 ]; do echo "line $i" >&2; echo "$((i * 8))%" >&2; i=$((i + 1)); done; exit 3`,
+			// Only the last ten lines are kept, without progress
+			wantErr:  []string{"upscaler command failed: exit status 3", ": line 3; line 4;", "line 12"},
+			rejected: []string{"line 2;", "%"},
+		},
+		{
+			name:    "no output",
+			body:    `echo "model not found" >&2`,
+			wantErr: []string{"did not write the image to {out}: model not found"},
+		},
+		{
+			name:    "empty output",
+			body:    `: > "$2"`,
+			wantErr: []string{"did not write the image"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newCommandUpscaler(t, writeScript(t, tt.body)+" {in} {out}", 0)
+
+			_, err := u.UpscaleImageContext(context.Background(), writeFile(t, "input.png", []byte("image")), UpscaleOptions{})
+			if err == nil {
+				t.Fatal("UpscaleImageContext succeeded, want an error")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("err = %v, want it to contain %q", err, want)
+				}
+			}
+			for _, reject := range tt.rejected {
+				if strings.Contains(err.Error(), reject) {
+					t.Errorf("err = %v, want it without %q", err, reject)
+				}
+			}
+		})
+	}
+}
+
+func TestCommandUpscalerTimeout(t *testing.T) {
+	// The child keeps stderr open; only killing the process group ends the
+	// run before the wait delay
+	u := newCommandUpscaler(t, writeScript(t, `echo "warming up" >&2; sleep 30 & wait`)+" {in} {out}", 200*time.Millisecond)
+
+	start := time.Now()
+	_, err := u.UpscaleImageContext(context.Background(), writeFile(t, "input.png", []byte("image")), UpscaleOptions{})
+	if err == nil || !strings.Contains(err.Error(), "upscaler command timed out after 200ms: warming up") {
+		t.Fatalf("err = %v, want a timeout with the stderr tail", err)
+	}
+	if elapsed := time.Since(start); elapsed > commandWaitDelay/2 {
+		t.Errorf("the command ran for %v after the timeout", elapsed)
+	}
+}
+
+func TestCommandUpscalerCanceled(t *testing.T) {
+	u := newCommandUpscaler(t, writeScript(t, `sleep 30 & wait`)+" {in} {out}", time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := u.UpscaleImageContext(ctx, writeFile(t, "input.png", []byte("image")), UpscaleOptions{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want the context's error", err)
+	}
+	if elapsed := time.Since(start); elapsed > commandWaitDelay/2 {
+		t.Errorf("the command ran for %v after cancel", elapsed)
+	}
+}
+
+func TestCommandUpscalerScale(t *testing.T) {
+	u := newCommandUpscaler(t, writeScript(t, `cp "$1" "$2"`)+" {in} {out}", 0)
+
+	for _, scale := range []int{1, maxLocalScale + 1} {
+		_, err := u.UpscaleImageContext(context.Background(), writeFile(t, "input.png", []byte("image")), UpscaleOptions{Scale: scale})
+		if err == nil || !strings.Contains(err.Error(), "scale factors from 2") {
+			t.Errorf("scale %d: err = %v, want a scale error", scale, err)
+		}
+	}
+}
+
+func TestParseCommandTemplate(t *testing.T) {
+	script := writeScript(t, "")
+
+	tests := []struct {
+		name     string
+		template string
+		want     []string
+		wantErr  string
+	}{
+		{name: "plain", template: script + " -i {in} -o {out} -s {scale}", want: []string{script, "-i", "{in}", "-o", "{out}", "-s", "{scale}"}},
+		{name: "quoted", template: `'` + script + `' --name "a b" -i {in} -o {out}x`, want: []string{script, "--name", "a b", "-i", "{in}", "-o", "{out}x"}},
+		{name: "extra spaces", template: "  " + script + "\t{in}   {out}  ", want: []string{script, "{in}", "{out}"}},
+		{name: "empty quotes", template: script + ` "" {in} {out}`, want: []string{script, "", "{in}", "{out}"}},
+		{name: "missing input", template: script + " -o {out}", wantErr: "must contain {in}"},
+		{name: "missing output", template: script + " -i {in}", wantErr: "must contain {out}"},
+		{name: "unknown placeholder", template: script + " {in} {out} -m {model}", wantErr: "unknown placeholder {model}"},
+		{name: "unterminated quote", template: script + ` "{in} {out}`, wantErr: `unterminated " quote`},
+		{name: "unterminated single quote", template: script + ` {in} {out} '`, wantErr: "unterminated ' quote"},
+		{name: "empty", template: "", wantErr: "upscaler command is empty"},
+		{name: "blank", template: "   ", wantErr: "upscaler command is empty"},
+		{name: "no program", template: "{in} {out}", wantErr: "must start with the program"},
+		{name: "program not installed", template: "/nonexistent/upscaler {in} {out}", wantErr: "program not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := ParseCommandTemplate(tt.template)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseCommandTemplate: %v", err)
+			}
+			if !slices.Equal(args, tt.want) {
+				t.Errorf("args = %q, want %q", args, tt.want)
+			}
+		})
+	}
+}
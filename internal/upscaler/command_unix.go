@@ -0,0 +1,18 @@
+//go:build unix
+
+package upscaler
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// killProcessGroup runs cmd in a process group of its own and makes
+// cancelling it kill the whole group, so wrapper scripts do not leave
+// their children running
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,247 @@
+package upscaler
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Response is an upscaler reply as seen by decoders
+type Response struct {
+	Header http.Header
+	Body   []byte
+}
+
+// Decoded is what every decoder extracts from a response: the upscaled
+// image bytes, or the URL of the image along with the async job that
+// produces it, if any
+type Decoded struct {
+	Data   []byte
+	URL    string
+	JobID  string
+	Status string
+}
+
+// Decoder understands one upscaler response format
+type Decoder interface {
+	// Detect reports whether the response looks like this format
+	Detect(resp *Response) bool
+	// Decode extracts the image or its location from the response
+	Decode(resp *Response) (*Decoded, error)
+}
+
+// AutoDecoder selects the decoder by detecting the response format
+const AutoDecoder = "auto"
+
+var (
+	decoderMu sync.RWMutex
+	decoders  = make(map[string]Decoder)
+	// decoderOrder holds the names in registration order
+	decoderOrder []string
+)
+
+func init() {
+	// Auto-detection tries the most recent registration first, so the
+	// broadest format goes first
+	RegisterDecoder("json", JSONDecoder{})
+	RegisterDecoder("base64", Base64Decoder{})
+	RegisterDecoder("binary", BinaryDecoder{})
+}
+
+// RegisterDecoder makes a decoder available under the given name, for
+// example for a deployment's own upscaler gateway. Auto-detection tries
+// decoders from the most recently registered, so added decoders take
+// precedence over the built-in ones. Registering the same name twice
+// replaces the earlier decoder.
+func RegisterDecoder(name string, decoder Decoder) {
+	decoderMu.Lock()
+	defer decoderMu.Unlock()
+
+	name = strings.ToLower(name)
+	for i, n := range decoderOrder {
+		if n == name {
+			decoderOrder = append(decoderOrder[:i], decoderOrder[i+1:]...)
+			break
+		}
+	}
+	decoders[name] = decoder
+	decoderOrder = append(decoderOrder, name)
+}
+
+// Decoders returns the names of all registered decoders, sorted
+func Decoders() []string {
+	decoderMu.RLock()
+	defer decoderMu.RUnlock()
+
+	names := append([]string(nil), decoderOrder...)
+	sort.Strings(names)
+	return names
+}
+
+// Decode decodes resp with the named decoder, or with the first one that
+// detects it when name is empty or AutoDecoder
+func Decode(name string, resp *Response) (*Decoded, error) {
+	name = strings.ToLower(name)
+	if name != "" && name != AutoDecoder {
+		decoderMu.RLock()
+		decoder, ok := decoders[name]
+		decoderMu.RUnlock()
+
+		if !ok {
+			return nil, fmt.Errorf("unknown upscaler response format %q (available: %s, %s)", name, AutoDecoder, strings.Join(Decoders(), ", "))
+		}
+		return decoder.Decode(resp)
+	}
+
+	decoderMu.RLock()
+	names := append([]string(nil), decoderOrder...)
+	candidates := make([]Decoder, len(names))
+	for i, n := range names {
+		candidates[i] = decoders[n]
+	}
+	decoderMu.RUnlock()
+
+	for i := len(candidates) - 1; i >= 0; i-- {
+		if candidates[i].Detect(resp) {
+			slog.Debug("Detected upscaler response format", "format", names[i])
+			return candidates[i].Decode(resp)
+		}
+	}
+	return nil, fmt.Errorf("unrecognized upscaler response: %s", previewBody(resp.Body))
+}
+
+// BinaryDecoder handles responses that are the image bytes themselves
+type BinaryDecoder struct{}
+
+// Detect accepts image signatures, image content types and anything that is
+// not JSON
+func (BinaryDecoder) Detect(resp *Response) bool {
+	if len(resp.Body) == 0 {
+		return false
+	}
+	return hasPNGSignature(resp.Body) || hasJPEGSignature(resp.Body) ||
+		strings.HasPrefix(resp.Header.Get("Content-Type"), "image/") || !isJSONResponse(resp.Body)
+}
+
+// Decode returns the body as the image
+func (BinaryDecoder) Decode(resp *Response) (*Decoded, error) {
+	if len(resp.Body) == 0 {
+		return nil, errors.New("empty response from the upscaler")
+	}
+	return &Decoded{Data: resp.Body}, nil
+}
+
+// Base64Decoder handles {"success": true, "data": {"image": "data:...;base64,..."}}
+// where the data URI holds either the image or JSON wrapping it in an
+// "image" field
+type Base64Decoder struct{}
+
+// Detect accepts successful JSON responses with data.image set
+func (Base64Decoder) Detect(resp *Response) bool {
+	var base64Response Base64Response
+	return json.Unmarshal(resp.Body, &base64Response) == nil && base64Response.Success && base64Response.Data.Image != ""
+}
+
+// Decode unwraps the data URI and any nested JSON
+func (Base64Decoder) Decode(resp *Response) (*Decoded, error) {
+	var base64Response Base64Response
+	if err := json.Unmarshal(resp.Body, &base64Response); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	// Extract the base64 part after the "data:type;base64," prefix
+	base64Data := base64Response.Data.Image
+	if !strings.HasPrefix(base64Data, "data:") || !strings.Contains(base64Data, ";base64,") {
+		return nil, fmt.Errorf("unexpected data format, missing data:type;base64, prefix")
+	}
+	mimeType, outerBase64, _ := strings.Cut(strings.TrimPrefix(base64Data, "data:"), ";base64,")
+	slog.Debug("Upscaler returned a base64 data URL", "mime_type", mimeType, "chars", len(outerBase64))
+
+	// Decode the outer base64 layer
+	outer, err := base64.StdEncoding.DecodeString(outerBase64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode outer base64 data: %w", err)
+	}
+	if strings.HasPrefix(mimeType, "image/") || hasPNGSignature(outer) || hasJPEGSignature(outer) {
+		return &Decoded{Data: outer}, nil
+	}
+
+	// Otherwise the decoded data is JSON holding the base64 image
+	var nestedJSON NestedImageJSON
+	if err := json.Unmarshal(outer, &nestedJSON); err != nil {
+		slog.Debug("Nested upscaler JSON could not be parsed", "preview", hex.EncodeToString(outer[:min(32, len(outer))]))
+		return nil, fmt.Errorf("failed to parse nested JSON: %w", err)
+	}
+	if nestedJSON.Image == "" {
+		return nil, errors.New("nested upscaler JSON has an empty image field")
+	}
+
+	imgData, err := base64.StdEncoding.DecodeString(nestedJSON.Image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode inner image data: %w", err)
+	}
+	return &Decoded{Data: imgData}, nil
+}
+
+// JSONDecoder handles JSON objects carrying the image URL and, for async
+// jobs, the job ID
+type JSONDecoder struct{}
+
+// Detect accepts any JSON body
+func (JSONDecoder) Detect(resp *Response) bool {
+	return isJSONResponse(resp.Body)
+}
+
+// Decode reads the URL from whichever field carries it
+func (JSONDecoder) Decode(resp *Response) (*Decoded, error) {
+	var result UpscaleResult
+	if err := json.Unmarshal(resp.Body, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w, body: %s", err, previewBody(resp.Body))
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("upscaler error: %s", result.Error)
+	}
+
+	url := result.imageURL()
+	if url == "" {
+		return nil, fmt.Errorf("no upscaled image URL in response: %s", previewBody(resp.Body))
+	}
+	return &Decoded{URL: url, JobID: result.ID, Status: result.Status}, nil
+}
+
+// imageURL returns the image URL from whichever field the service used
+func (r *UpscaleResult) imageURL() string {
+	switch {
+	case r.URL != "":
+		return r.URL
+	case r.ImageURL != "":
+		return r.ImageURL
+	case r.OutputURL != "":
+		return r.OutputURL
+	case strings.HasPrefix(r.Result, "http://") || strings.HasPrefix(r.Result, "https://"):
+		// Sometimes the URL might be in the Result field
+		return r.Result
+	}
+	return ""
+}
+
+// previewBody shortens a response body for error messages, showing binary
+// data as hex
+func previewBody(body []byte) string {
+	const maxPreview = 200
+	if !utf8.Valid(body) {
+		return "binary data " + hex.EncodeToString(body[:min(len(body), 16)])
+	}
+	if len(body) <= maxPreview {
+		return string(body)
+	}
+	return string(body[:maxPreview]) + "..."
+}
@@ -0,0 +1,266 @@
+package upscaler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var (
+	testPNGData  = append(append([]byte(nil), pngSignature...), "png pixels"...)
+	testJPEGData = append(append([]byte(nil), jpegSignature...), "jpeg pixels"...)
+)
+
+// response returns a response with the given body and content type
+func response(contentType, body string) *Response {
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	return &Response{Header: header, Body: []byte(body)}
+}
+
+// base64Body returns a Base64Decoder body whose data URI has the given type
+// and content
+func base64Body(mimeType string, content []byte) string {
+	body, _ := json.Marshal(map[string]interface{}{
+		"success": true,
+		"data":    map[string]string{"image": "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(content)},
+	})
+	return string(body)
+}
+
+// nestedBody returns a Base64Decoder body whose data URI holds JSON wrapping
+// the image
+func nestedBody(image []byte) string {
+	inner, _ := json.Marshal(map[string]string{"image": base64.StdEncoding.EncodeToString(image)})
+	return base64Body("application/json", inner)
+}
+
+// restoreDecoders puts the registered decoders back when the test ends
+func restoreDecoders(t *testing.T) {
+	decoderMu.RLock()
+	saved := make(map[string]Decoder, len(decoders))
+	for name, decoder := range decoders {
+		saved[name] = decoder
+	}
+	order := append([]string(nil), decoderOrder...)
+	decoderMu.RUnlock()
+
+	t.Cleanup(func() {
+		decoderMu.Lock()
+		defer decoderMu.Unlock()
+		decoders, decoderOrder = saved, order
+	})
+}
+
+func TestBinaryDecoder(t *testing.T) {
+	tests := []struct {
+		name       string
+		resp       *Response
+		wantDetect bool
+	}{
+		{name: "png", resp: response("", string(testPNGData)), wantDetect: true},
+		{name: "jpeg", resp: response("", string(testJPEGData)), wantDetect: true},
+		{name: "image content type", resp: response("image/webp", `{"looks":"like json"}`), wantDetect: true},
+		{name: "not json", resp: response("application/octet-stream", "RIFF....WEBP"), wantDetect: true},
+		{name: "json", resp: response("application/json", `{"url":"https://cdn/a.png"}`)},
+		{name: "json array", resp: response("", ` [1, 2]`)},
+		{name: "empty", resp: response("image/png", "")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (BinaryDecoder{}).Detect(tt.resp); got != tt.wantDetect {
+				t.Errorf("Detect = %v, want %v", got, tt.wantDetect)
+			}
+		})
+	}
+
+	decoded, err := BinaryDecoder{}.Decode(response("", string(testPNGData)))
+	if err != nil || !bytes.Equal(decoded.Data, testPNGData) {
+		t.Errorf("Decode = %v, %v, want the body as the image", decoded, err)
+	}
+	if _, err := (BinaryDecoder{}).Decode(response("", "")); err == nil {
+		t.Error("Decode accepted an empty body")
+	}
+}
+
+func TestBase64Decoder(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantDetect bool
+		wantData   []byte
+		wantErr    string
+	}{
+		{name: "image data uri", body: base64Body("image/png", testPNGData), wantDetect: true, wantData: testPNGData},
+		{name: "untyped image", body: base64Body("application/octet-stream", testJPEGData), wantDetect: true, wantData: testJPEGData},
+		{name: "nested json", body: nestedBody(testPNGData), wantDetect: true, wantData: testPNGData},
+		{name: "nested json without image", body: base64Body("application/json", []byte(`{"image":""}`)), wantDetect: true, wantErr: "empty image field"},
+		{name: "nested garbage", body: base64Body("text/plain", []byte("not json")), wantDetect: true, wantErr: "failed to parse nested JSON"},
+		{name: "missing data uri prefix", body: `{"success":true,"data":{"image":"iVBORw0KGgo="}}`, wantDetect: true, wantErr: "missing data:type;base64, prefix"},
+		{name: "bad base64", body: `{"success":true,"data":{"image":"data:image/png;base64,!!!"}}`, wantDetect: true, wantErr: "failed to decode outer base64 data"},
+		{name: "unsuccessful", body: `{"success":false,"data":{"image":"data:image/png;base64,AA=="}}`},
+		{name: "url response", body: `{"success":true,"url":"https://cdn/a.png"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := response("application/json", tt.body)
+			if got := (Base64Decoder{}).Detect(resp); got != tt.wantDetect {
+				t.Errorf("Detect = %v, want %v", got, tt.wantDetect)
+			}
+			if !tt.wantDetect {
+				return
+			}
+
+			decoded, err := Base64Decoder{}.Decode(resp)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if !bytes.Equal(decoded.Data, tt.wantData) {
+				t.Errorf("Data = %q, want %q", decoded.Data, tt.wantData)
+			}
+		})
+	}
+}
+
+func TestJSONDecoder(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    Decoded
+		wantErr string
+	}{
+		{name: "url", body: `{"url":"https://cdn/a.png"}`, want: Decoded{URL: "https://cdn/a.png"}},
+		{name: "image_url", body: `{"image_url":"https://cdn/b.png"}`, want: Decoded{URL: "https://cdn/b.png"}},
+		{name: "output_url", body: `{"output_url":"https://cdn/c.png"}`, want: Decoded{URL: "https://cdn/c.png"}},
+		{name: "result", body: `{"result":"https://cdn/d.png"}`, want: Decoded{URL: "https://cdn/d.png"}},
+		{name: "url wins", body: `{"url":"https://cdn/a.png","image_url":"https://cdn/b.png"}`, want: Decoded{URL: "https://cdn/a.png"}},
+		{
+			name: "async job",
+			body: `{"id":"job-1","status":"in-progress","is_completed":false,"url":"https://cdn/job-1.png"}`,
+			want: Decoded{URL: "https://cdn/job-1.png", JobID: "job-1", Status: "in-progress"},
+		},
+		{name: "error", body: `{"error":"quota exceeded"}`, wantErr: "upscaler error: quota exceeded"},
+		{name: "result without url", body: `{"result":"queued"}`, wantErr: "no upscaled image URL"},
+		{name: "invalid", body: `{"url":`, wantErr: "failed to decode response"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := JSONDecoder{}.Decode(response("application/json", tt.body))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if decoded.URL != tt.want.URL || decoded.JobID != tt.want.JobID || decoded.Status != tt.want.Status {
+				t.Errorf("Decode = %+v, want %+v", *decoded, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeAutoDetect(t *testing.T) {
+	tests := []struct {
+		name     string
+		decoder  string
+		resp     *Response
+		wantData []byte
+		wantURL  string
+		wantErr  string
+	}{
+		{name: "binary", resp: response("image/png", string(testPNGData)), wantData: testPNGData},
+		// The base64 shape is JSON too, but base64 is tried before json
+		{name: "base64", resp: response("application/json", nestedBody(testPNGData)), wantData: testPNGData},
+		{name: "json", resp: response("application/json", `{"url":"https://cdn/a.png"}`), wantURL: "https://cdn/a.png"},
+		{name: "explicit auto", decoder: "AUTO", resp: response("", string(testJPEGData)), wantData: testJPEGData},
+		// A named decoder is used without detection
+		{name: "named", decoder: "JSON", resp: response("image/png", `{"url":"https://cdn/a.png"}`), wantURL: "https://cdn/a.png"},
+		{name: "named mismatch", decoder: "base64", resp: response("", string(testPNGData)), wantErr: "failed to decode response"},
+		{name: "unknown", decoder: "xml", resp: response("", "<a/>"), wantErr: `unknown upscaler response format "xml" (available: auto, base64, binary, json)`},
+		{name: "nothing detected", resp: response("", ""), wantErr: "unrecognized upscaler response"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := Decode(tt.decoder, tt.resp)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if !bytes.Equal(decoded.Data, tt.wantData) || decoded.URL != tt.wantURL {
+				t.Errorf("Decode = %q %q, want %q %q", decoded.Data, decoded.URL, tt.wantData, tt.wantURL)
+			}
+		})
+	}
+}
+
+// gatewayDecoder is a deployment's own format: a text body holding the URL
+type gatewayDecoder struct{}
+
+func (gatewayDecoder) Detect(resp *Response) bool {
+	return bytes.HasPrefix(resp.Body, []byte("url="))
+}
+
+func (gatewayDecoder) Decode(resp *Response) (*Decoded, error) {
+	return &Decoded{URL: strings.TrimPrefix(string(resp.Body), "url=")}, nil
+}
+
+// urlDecoder answers every JSON body with a fixed URL
+type urlDecoder struct{ url string }
+
+func (d urlDecoder) Detect(resp *Response) bool {
+	return isJSONResponse(resp.Body)
+}
+
+func (d urlDecoder) Decode(resp *Response) (*Decoded, error) {
+	return &Decoded{URL: d.url}, nil
+}
+
+func TestRegisterDecoder(t *testing.T) {
+	restoreDecoders(t)
+
+	// The binary decoder also accepts this text body, but the newer
+	// registration is tried first
+	RegisterDecoder("Gateway", gatewayDecoder{})
+	decoded, err := Decode(AutoDecoder, response("text/plain", "url=https://gw/a.png"))
+	if err != nil || decoded.URL != "https://gw/a.png" {
+		t.Fatalf("Decode = %+v, %v, want the gateway URL", decoded, err)
+	}
+	if decoded, err := Decode("gateway", response("", "url=https://gw/b.png")); err != nil || decoded.URL != "https://gw/b.png" {
+		t.Errorf("Decode by name = %+v, %v, want the gateway URL", decoded, err)
+	}
+
+	// Replacing a decoder keeps one entry under its name and moves it to
+	// the front of auto-detection, ahead of base64
+	RegisterDecoder("json", urlDecoder{url: "https://replaced/"})
+	if got, want := Decoders(), []string{"base64", "binary", "gateway", "json"}; !slices.Equal(got, want) {
+		t.Errorf("Decoders = %v, want %v", got, want)
+	}
+	decoded, err = Decode(AutoDecoder, response("application/json", nestedBody(testPNGData)))
+	if err != nil || decoded.URL != "https://replaced/" {
+		t.Errorf("Decode = %+v, %v, want the replacement json decoder", decoded, err)
+	}
+}
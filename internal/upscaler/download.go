@@ -0,0 +1,90 @@
+package upscaler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"fluxxxer/internal/httpx"
+)
+
+// IsRemote reports whether the result points at an image still on the
+// service rather than a local file
+func (r *UpscaleResult) IsRemote() bool {
+	return strings.HasPrefix(r.URL, "http://") || strings.HasPrefix(r.URL, "https://")
+}
+
+// Download saves a remote result to a temporary file and returns its path,
+// reporting PhaseDownloading to onProgress. A local result is returned as is.
+func (c *Client) Download(ctx context.Context, result *UpscaleResult, onProgress func(Progress)) (string, error) {
+	if result == nil || result.URL == "" {
+		return "", errors.New("no upscaled image URL returned from server")
+	}
+	if !result.IsRemote() {
+		return result.URL, nil
+	}
+	if c.clientErr != nil {
+		return "", c.clientErr
+	}
+
+	slog.Debug("Downloading upscaled image", "url", result.URL)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, result.URL, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create download request: %w", err)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to download upscaled image: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download upscaled image: %w", httpx.NewAPIError(resp))
+	}
+
+	tmpFile, err := os.CreateTemp("", "upscaled-*"+downloadExt(result.URL, resp.Header.Get("Content-Type")))
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+
+	_, err = io.Copy(tmpFile, withProgress(resp.Body, PhaseDownloading, resp.ContentLength, onProgress))
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to save upscaled image: %w", err)
+	}
+
+	slog.Info("Upscaled image stored temporarily", "path", tmpPath)
+	return tmpPath, nil
+}
+
+// downloadExt picks the file extension for a downloaded image from its
+// content type, falling back to the URL path and then PNG
+func downloadExt(rawURL, contentType string) string {
+	switch {
+	case strings.HasPrefix(contentType, "image/jpeg"):
+		return ".jpg"
+	case strings.HasPrefix(contentType, "image/webp"):
+		return ".webp"
+	case strings.HasPrefix(contentType, "image/png"):
+		return ".png"
+	}
+	if u, err := url.Parse(rawURL); err == nil {
+		switch ext := strings.ToLower(filepath.Ext(u.Path)); ext {
+		case ".png", ".jpg", ".jpeg", ".webp":
+			return ext
+		}
+	}
+	return ".png"
+}
@@ -0,0 +1,225 @@
+package upscaler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"strings"
+)
+
+// errBodyReplaced stops the writer of a body that a retry replaced
+var errBodyReplaced = errors.New("upload body replaced by a retry")
+
+// formBody streams the multipart form of an upscale request through a pipe,
+// so the image is never held in memory as a whole
+type formBody struct {
+	src  io.Reader
+	name string
+	opts UpscaleOptions
+
+	// seeker rewinds src to start for a retry; nil when src can only be
+	// read once
+	seeker io.Seeker
+	start  int64
+
+	boundary string
+	// length is the size of the whole form, -1 when the image size is
+	// unknown
+	length int64
+
+	reader *io.PipeReader
+	done   chan struct{}
+}
+
+// newFormBody prepares the form for src, working out its length when the
+// size of src can be determined
+func newFormBody(src io.Reader, name string, opts UpscaleOptions) (*formBody, error) {
+	f := &formBody{
+		src:      src,
+		name:     name,
+		opts:     opts,
+		boundary: multipart.NewWriter(io.Discard).Boundary(),
+		length:   -1,
+	}
+
+	size := int64(-1)
+	if r, ok := src.(io.Seeker); ok {
+		// Pipes implement Seek but fail, leaving the size unknown
+		if start, err := r.Seek(0, io.SeekCurrent); err == nil {
+			end, err := r.Seek(0, io.SeekEnd)
+			if err != nil {
+				return nil, fmt.Errorf("failed to seek image: %w", err)
+			}
+			if _, err := r.Seek(start, io.SeekStart); err != nil {
+				return nil, fmt.Errorf("failed to seek image: %w", err)
+			}
+			f.seeker, f.start = r, start
+			size = end - start
+		}
+	} else if r, ok := src.(interface{ Len() int }); ok {
+		size = int64(r.Len())
+	}
+
+	if size == 0 {
+		return nil, errors.New("image is empty")
+	}
+	if size > MaxUploadBytes {
+		return nil, fmt.Errorf("image is too large (%d MB). Maximum size is 5MB. Use PrepareImage to shrink it before upscaling",
+			size/(1024*1024))
+	}
+
+	if size < 0 {
+		// The size is only known once read, so stop a stream at the limit
+		f.src = &limitReader{r: src, left: MaxUploadBytes}
+	}
+
+	if size > 0 {
+		overhead, err := f.overhead()
+		if err != nil {
+			return nil, err
+		}
+		f.length = overhead + size
+	}
+
+	return f, nil
+}
+
+// overhead returns the size of the form without the image data
+func (f *formBody) overhead() (int64, error) {
+	var counter countingWriter
+	mw := multipart.NewWriter(&counter)
+	if err := mw.SetBoundary(f.boundary); err != nil {
+		return 0, fmt.Errorf("failed to set multipart boundary: %w", err)
+	}
+	if err := writeForm(mw, f.name, strings.NewReader(""), f.opts); err != nil {
+		return 0, err
+	}
+	return counter.n, nil
+}
+
+// contentType returns the Content-Type header of the form
+func (f *formBody) contentType() string {
+	return "multipart/form-data; boundary=" + f.boundary
+}
+
+// open starts streaming the form from the beginning, stopping the stream of
+// a previous attempt first. It serves as the request's GetBody.
+func (f *formBody) open() (io.ReadCloser, error) {
+	if f.reader != nil {
+		if f.seeker == nil {
+			return nil, errors.New("upload cannot be retried: the image can only be read once")
+		}
+		f.close()
+		if _, err := f.seeker.Seek(f.start, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to rewind image: %w", err)
+		}
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mw := multipart.NewWriter(pw)
+		if err := mw.SetBoundary(f.boundary); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(writeForm(mw, f.name, f.src, f.opts))
+	}()
+	f.reader, f.done = pr, done
+
+	total := max(f.length, 0)
+	return struct {
+		io.Reader
+		io.Closer
+	}{withProgress(pr, PhaseUploading, total, f.opts.OnProgress), pr}, nil
+}
+
+// close stops the current stream and waits until src is no longer read
+func (f *formBody) close() {
+	if f.reader == nil {
+		return
+	}
+	f.reader.CloseWithError(errBodyReplaced)
+	<-f.done
+}
+
+// writeForm writes the fields of an upscale request and the image read from
+// src to mw, then closes it
+func writeForm(mw *multipart.Writer, name string, src io.Reader, opts UpscaleOptions) error {
+	// Add the image file - IMPORTANT: field name must be "image"
+	part, err := mw.CreateFormFile("image", name)
+	if err != nil {
+		return fmt.Errorf("failed to create form file: %w", err)
+	}
+	if _, err := io.Copy(part, src); err != nil {
+		return fmt.Errorf("failed to read image data: %w", err)
+	}
+
+	// Simplify - just add the minimal required fields as your curl example does
+	fields := [][2]string{{"type", string(opts.Type)}}
+
+	// Only add the other fields if they're explicitly set
+	if opts.Type == UpscaleConservative || opts.Type == UpscaleCreative {
+		if opts.Prompt != "" {
+			fields = append(fields, [2]string{"prompt", opts.Prompt})
+		}
+	}
+	if opts.NegativePrompt != "" {
+		fields = append(fields, [2]string{"negative_prompt", opts.NegativePrompt})
+	}
+	if opts.Seed != nil {
+		fields = append(fields, [2]string{"seed", fmt.Sprintf("%d", *opts.Seed)})
+	}
+	if opts.Creativity != nil {
+		fields = append(fields, [2]string{"creativity", fmt.Sprintf("%.2f", *opts.Creativity)})
+	}
+	if opts.OutputFormat != "" {
+		fields = append(fields, [2]string{"output_format", opts.OutputFormat})
+	}
+	if opts.StylePreset != "" {
+		fields = append(fields, [2]string{"style_preset", opts.StylePreset})
+	}
+
+	for _, field := range fields {
+		if err := mw.WriteField(field[0], field[1]); err != nil {
+			return fmt.Errorf("failed to write form field %s: %w", field[0], err)
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return fmt.Errorf("failed to close multipart writer: %w", err)
+	}
+	return nil
+}
+
+// limitReader fails once more than left bytes are read from r
+type limitReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	// Read one byte past the limit to tell a stream at the limit from one
+	// over it
+	if int64(len(p)) > l.left+1 {
+		p = p[:l.left+1]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	if l.left < 0 {
+		return n, fmt.Errorf("image is too large. Maximum size is %dMB", MaxUploadBytes/(1024*1024))
+	}
+	return n, err
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,248 @@
+package upscaler
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"fluxxxer/internal/config"
+)
+
+// readForm returns the image and the fields of a multipart form
+func readForm(t *testing.T, contentType string, body []byte) (string, map[string]string) {
+	t.Helper()
+
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", contentType, err)
+	}
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+
+	var image string
+	fields := make(map[string]string)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading form: %v", err)
+		}
+		data, _ := io.ReadAll(part)
+		if part.FormName() == "image" {
+			image = string(data)
+		} else {
+			fields[part.FormName()] = string(data)
+		}
+	}
+	return image, fields
+}
+
+func TestFormBodyLength(t *testing.T) {
+	seed := 7
+	opts := UpscaleOptions{Type: UpscaleCreative, Prompt: "a lighthouse", Seed: &seed, OutputFormat: "webp"}
+
+	tests := []struct {
+		name       string
+		src        io.Reader
+		wantLength bool
+	}{
+		{name: "seeker", src: strings.NewReader("image data"), wantLength: true},
+		{name: "buffer", src: bytes.NewBufferString("image data"), wantLength: true},
+		{name: "stream", src: io.MultiReader(strings.NewReader("image data")), wantLength: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form, err := newFormBody(tt.src, "input.png", opts)
+			if err != nil {
+				t.Fatalf("newFormBody: %v", err)
+			}
+			defer form.close()
+
+			body, err := form.open()
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			data, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatalf("reading body: %v", err)
+			}
+
+			if tt.wantLength && form.length != int64(len(data)) {
+				t.Errorf("length = %d, want the %d bytes sent", form.length, len(data))
+			}
+			if !tt.wantLength && form.length != -1 {
+				t.Errorf("length = %d, want -1 for a stream", form.length)
+			}
+
+			image, fields := readForm(t, form.contentType(), data)
+			if image != "image data" {
+				t.Errorf("image = %q, want the source", image)
+			}
+			want := map[string]string{"type": "creative", "prompt": "a lighthouse", "seed": "7", "output_format": "webp"}
+			for name, value := range want {
+				if fields[name] != value {
+					t.Errorf("field %s = %q, want %q", name, fields[name], value)
+				}
+			}
+		})
+	}
+}
+
+func TestFormBodyRejectsSizes(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		src     io.Reader
+		wantErr string
+	}{
+		{name: "empty", src: strings.NewReader(""), wantErr: "image is empty"},
+		{name: "too large", src: bytes.NewReader(make([]byte, MaxUploadBytes+1)), wantErr: "image is too large"},
+	} {
+		if _, err := newFormBody(tt.src, "input.png", UpscaleOptions{}); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestFormBodyLimitsStreams(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		size    int
+		wantErr bool
+	}{
+		{name: "at the limit", size: MaxUploadBytes},
+		{name: "over the limit", size: MaxUploadBytes + 1, wantErr: true},
+	} {
+		// The size of a stream is unknown until it has been read
+		src := io.MultiReader(bytes.NewReader(make([]byte, tt.size)))
+		form, err := newFormBody(src, "input.png", UpscaleOptions{Type: UpscaleFast})
+		if err != nil {
+			t.Fatalf("%s: newFormBody: %v", tt.name, err)
+		}
+
+		body, err := form.open()
+		if err != nil {
+			t.Fatalf("%s: open: %v", tt.name, err)
+		}
+		_, err = io.Copy(io.Discard, body)
+		form.close()
+
+		if tt.wantErr && (err == nil || !strings.Contains(err.Error(), "image is too large")) {
+			t.Errorf("%s: err = %v, want the upload to fail", tt.name, err)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestFormBodyRewindsOnReopen(t *testing.T) {
+	// The image starts part way into the reader, where it must be rewound to
+	src := strings.NewReader("skipped|image data")
+	src.Seek(int64(len("skipped|")), io.SeekStart)
+
+	form, err := newFormBody(src, "input.png", UpscaleOptions{Type: UpscaleFast})
+	if err != nil {
+		t.Fatalf("newFormBody: %v", err)
+	}
+	defer form.close()
+
+	// A retry reopens the body after the first attempt read part of it
+	first, _ := form.open()
+	io.ReadFull(first, make([]byte, 10))
+
+	second, err := form.open()
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	data, _ := io.ReadAll(second)
+	if int64(len(data)) != form.length {
+		t.Errorf("reopened body has %d bytes, want %d", len(data), form.length)
+	}
+	if image, _ := readForm(t, form.contentType(), data); image != "image data" {
+		t.Errorf("image = %q, want it from the start", image)
+	}
+}
+
+func TestFormBodyStreamCannotReopen(t *testing.T) {
+	form, err := newFormBody(io.MultiReader(strings.NewReader("image data")), "input.png", UpscaleOptions{})
+	if err != nil {
+		t.Fatalf("newFormBody: %v", err)
+	}
+	defer form.close()
+
+	if _, err := form.open(); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := form.open(); err == nil {
+		t.Error("reopening a stream succeeded, want an error")
+	}
+}
+
+func TestUpscaleReaderRetriesWithFullBody(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	png := writeTestImage(t, 16, 16)
+
+	var (
+		mu       sync.Mutex
+		attempts []int64
+		images   []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		image, _ := readForm(t, r.Header.Get("Content-Type"), body)
+
+		mu.Lock()
+		attempts = append(attempts, r.ContentLength)
+		images = append(images, image)
+		first := len(attempts) == 1
+		mu.Unlock()
+
+		if int64(len(body)) != r.ContentLength {
+			t.Errorf("got %d bytes, want the Content-Length of %d", len(body), r.ContentLength)
+		}
+		// Only 429 and 503 are retried for uploads
+		if first {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte(image))
+	}))
+	defer server.Close()
+
+	c := NewClient(&config.Config{UpscalerAPIURL: server.URL, UpscalerDecoder: "auto", RetryMaxAttempts: 2})
+	data, err := os.ReadFile(png)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := c.UpscaleReader(context.Background(), bytes.NewReader(data), "input.png", UpscaleOptions{Type: UpscaleFast})
+	if err != nil {
+		t.Fatalf("UpscaleReader: %v", err)
+	}
+	if width, height := imageSize(t, result.URL); width != 16 || height != 16 {
+		t.Errorf("result is %dx%d, want the echoed 16x16 image", width, height)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(attempts) != 2 {
+		t.Fatalf("got %d attempts, want 2", len(attempts))
+	}
+	if attempts[0] <= 0 || attempts[0] != attempts[1] {
+		t.Errorf("Content-Length = %v, want the same known length on both attempts", attempts)
+	}
+	if images[0] != string(data) || images[1] != string(data) {
+		t.Error("an attempt did not send the whole image")
+	}
+}
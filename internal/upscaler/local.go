@@ -0,0 +1,437 @@
+package upscaler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Resampling filters of the local upscaler
+const (
+	FilterLanczos3 = "lanczos3"
+	FilterBicubic  = "bicubic"
+)
+
+// DefaultLocalScale is the factor used by upscale types that run on this
+// machine when the options leave it unset
+const DefaultLocalScale = 4
+
+// maxLocalScale bounds the factor of upscales that run on this machine
+const maxLocalScale = 8
+
+// maxLocalPixels bounds the size of a locally upscaled image, whose
+// buffers take about 24 bytes a pixel
+const maxLocalPixels = 1 << 26
+
+// Edge strengths, as Sobel gradients of the luminance, between which the
+// sharpen pass fades in
+const (
+	sharpenEdgeLow  = 16.0
+	sharpenEdgeHigh = 128.0
+)
+
+// LocalConfig interface to avoid import cycle
+type LocalConfig interface {
+	GetLocalUpscaleFilter() string
+	GetLocalSharpen() float64
+}
+
+// filter is a resampling kernel and the distance it reaches
+type filter struct {
+	name    string
+	support float64
+	kernel  func(x float64) float64
+}
+
+var localFilters = map[string]filter{
+	FilterLanczos3: {name: FilterLanczos3, support: 3, kernel: lanczos3},
+	FilterBicubic:  {name: FilterBicubic, support: 2, kernel: catmullRom},
+}
+
+// LocalUpscaler resamples images on this machine, for when the upscaling
+// service is down or not configured. It needs no API key.
+type LocalUpscaler struct {
+	filter  filter
+	sharpen float64
+
+	// filterErr reports an unknown filter on the first upscale
+	filterErr error
+}
+
+// NewLocalUpscaler creates a local upscaler with the configured filter and
+// sharpen amount
+func NewLocalUpscaler(config LocalConfig) *LocalUpscaler {
+	u := &LocalUpscaler{sharpen: config.GetLocalSharpen()}
+
+	name := strings.ToLower(config.GetLocalUpscaleFilter())
+	if name == "" {
+		name = FilterLanczos3
+	}
+	f, ok := localFilters[name]
+	if !ok {
+		u.filterErr = fmt.Errorf("unknown local upscaling filter %q (available: %s, %s)", name, FilterLanczos3, FilterBicubic)
+	}
+	u.filter = f
+
+	return u
+}
+
+// UpscaleImageContext upscales an image file and returns the result
+func (u *LocalUpscaler) UpscaleImageContext(ctx context.Context, imagePath string, opts UpscaleOptions) (*UpscaleResult, error) {
+	if imagePath == "" {
+		return nil, errors.New("image path cannot be empty")
+	}
+
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image file: %w", err)
+	}
+	defer file.Close()
+
+	return u.UpscaleReader(ctx, file, filepath.Base(imagePath), opts)
+}
+
+// UpscaleReader resamples the image read from r by opts.Scale, sharpens its
+// edges and returns the result, saved to a temporary file. Progress is
+// reported as PhaseProcessing with the current step as the status. r is
+// not closed.
+func (u *LocalUpscaler) UpscaleReader(ctx context.Context, r io.Reader, name string, opts UpscaleOptions) (*UpscaleResult, error) {
+	if u.filterErr != nil {
+		return nil, u.filterErr
+	}
+
+	scale, err := localScale(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the size from the header before decoding the pixels, keeping
+	// the header bytes to decode the image from
+	var header bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image (local upscaling reads PNG and JPEG): %w", err)
+	}
+	width, height := cfg.Width*scale, cfg.Height*scale
+	if width*height > maxLocalPixels {
+		return nil, fmt.Errorf("image is too large to upscale locally: %dx%d at %dx would be %dx%d", cfg.Width, cfg.Height, scale, width, height)
+	}
+
+	img, _, err := image.Decode(io.MultiReader(&header, r))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image (local upscaling reads PNG and JPEG): %w", err)
+	}
+	bounds := img.Bounds()
+
+	slog.Debug("Upscaling image locally", "name", name, "filter", u.filter.name, "scale", scale,
+		"from", fmt.Sprintf("%dx%d", bounds.Dx(), bounds.Dy()), "to", fmt.Sprintf("%dx%d", width, height))
+
+	report := func(status string) {
+		if opts.OnProgress != nil {
+			opts.OnProgress(Progress{Phase: PhaseProcessing, Status: status})
+		}
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	report("resampling with " + u.filter.name)
+	dst, err := resample(ctx, src, width, height, u.filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.sharpen > 0 {
+		report("sharpening edges")
+		if dst, err = sharpenEdges(ctx, dst, u.sharpen); err != nil {
+			return nil, err
+		}
+	}
+
+	format := opts.OutputFormat
+	if format != "" && format != "png" && format != "jpeg" {
+		slog.Warn("Local upscaling cannot write this format, saving PNG instead", "format", format)
+		format = "png"
+	}
+	path, err := saveImage(dst, format)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("Upscaled image locally", "path", path, "size", fmt.Sprintf("%dx%d", width, height))
+	return &UpscaleResult{URL: path, Status: "succeeded", IsCompleted: true}, nil
+}
+
+// localScale returns the scale factor of an upscale that runs on this
+// machine
+func localScale(opts UpscaleOptions) (int, error) {
+	scale := opts.Scale
+	if scale == 0 {
+		scale = DefaultLocalScale
+	}
+	if scale < 2 || scale > maxLocalScale {
+		return 0, fmt.Errorf("upscaling on this machine supports scale factors from 2 to %d, got %d", maxLocalScale, scale)
+	}
+	return scale, nil
+}
+
+// Download returns the path of the local result
+func (u *LocalUpscaler) Download(ctx context.Context, result *UpscaleResult, onProgress func(Progress)) (string, error) {
+	if result == nil || result.URL == "" {
+		return "", errors.New("no upscaled image returned")
+	}
+	return result.URL, nil
+}
+
+// lanczos3 is the Lanczos kernel with three lobes
+func lanczos3(x float64) float64 {
+	x = math.Abs(x)
+	switch {
+	case x == 0:
+		return 1
+	case x >= 3:
+		return 0
+	}
+	px := math.Pi * x
+	return 3 * math.Sin(px) * math.Sin(px/3) / (px * px)
+}
+
+// catmullRom is the bicubic kernel with a = -0.5
+func catmullRom(x float64) float64 {
+	x = math.Abs(x)
+	switch {
+	case x < 1:
+		return 1.5*x*x*x - 2.5*x*x + 1
+	case x < 2:
+		return -0.5*x*x*x + 2.5*x*x - 4*x + 2
+	}
+	return 0
+}
+
+// contribution lists the weights of consecutive source pixels, from start,
+// that make up one destination pixel
+type contribution struct {
+	start   int
+	weights []float32
+}
+
+// contributions works out the source pixels and weights of every pixel
+// along one axis resized from srcLen to dstLen
+func contributions(srcLen, dstLen int, f filter) []contribution {
+	scale := float64(dstLen) / float64(srcLen)
+
+	// Widen the kernel when shrinking so every source pixel counts
+	stretch := math.Max(1/scale, 1)
+	support := f.support * stretch
+
+	out := make([]contribution, dstLen)
+	for i := range out {
+		center := (float64(i)+0.5)/scale - 0.5
+		lo := int(math.Ceil(center - support))
+		if lo < 0 {
+			lo = 0
+		}
+		hi := int(math.Floor(center + support))
+		if hi > srcLen-1 {
+			hi = srcLen - 1
+		}
+
+		// Renormalize so the weights clipped at the borders still sum to one
+		weights := make([]float64, hi-lo+1)
+		var sum float64
+		for j := range weights {
+			weights[j] = f.kernel((float64(lo+j) - center) / stretch)
+			sum += weights[j]
+		}
+
+		c := contribution{start: lo, weights: make([]float32, len(weights))}
+		for j, w := range weights {
+			if sum != 0 {
+				c.weights[j] = float32(w / sum)
+			}
+		}
+		out[i] = c
+	}
+	return out
+}
+
+// resample resizes src to width x height with f, resizing horizontally and
+// then vertically
+func resample(ctx context.Context, src *image.RGBA, width, height int, f filter) (*image.RGBA, error) {
+	srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+	cols := contributions(srcW, width, f)
+	rows := contributions(srcH, height, f)
+
+	// Horizontal pass, kept as floats so the ringing of the kernel survives
+	// until the final clamp
+	tmp := make([]float32, srcH*width*4)
+	err := parallelRows(ctx, srcH, func(y int) {
+		in := src.Pix[y*src.Stride:]
+		out := tmp[y*width*4:]
+		for x, c := range cols {
+			var r, g, b, a float32
+			for k, w := range c.weights {
+				p := in[(c.start+k)*4:]
+				r += float32(p[0]) * w
+				g += float32(p[1]) * w
+				b += float32(p[2]) * w
+				a += float32(p[3]) * w
+			}
+			out[x*4], out[x*4+1], out[x*4+2], out[x*4+3] = r, g, b, a
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Vertical pass
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	err = parallelRows(ctx, height, func(y int) {
+		c := rows[y]
+		out := dst.Pix[y*dst.Stride:]
+		for x := 0; x < width; x++ {
+			var r, g, b, a float32
+			for k, w := range c.weights {
+				p := tmp[(c.start+k)*width*4+x*4:]
+				r += p[0] * w
+				g += p[1] * w
+				b += p[2] * w
+				a += p[3] * w
+			}
+			storePremultiplied(out[x*4:], r, g, b, a)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return dst, nil
+}
+
+// storePremultiplied clamps a premultiplied pixel into p, keeping every
+// color within its alpha
+func storePremultiplied(p []uint8, r, g, b, a float32) {
+	alpha := clampChannel(a, 255)
+	p[3] = alpha
+	p[0] = clampChannel(r, float32(alpha))
+	p[1] = clampChannel(g, float32(alpha))
+	p[2] = clampChannel(b, float32(alpha))
+}
+
+// clampChannel rounds v into [0, limit]
+func clampChannel(v, limit float32) uint8 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= limit:
+		return uint8(limit)
+	}
+	return uint8(v + 0.5)
+}
+
+// sharpenEdges applies an unsharp mask weighted by the strength of the edge
+// under each pixel, so edges get crisper while flat areas and their noise
+// are left alone. Every result is clamped to its 3x3 neighbourhood, which
+// keeps the mask from drawing halos.
+func sharpenEdges(ctx context.Context, img *image.RGBA, amount float64) (*image.RGBA, error) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+
+	luma := make([]float32, width*height)
+	for y := 0; y < height; y++ {
+		row := img.Pix[y*img.Stride:]
+		for x := 0; x < width; x++ {
+			p := row[x*4:]
+			luma[y*width+x] = 0.299*float32(p[0]) + 0.587*float32(p[1]) + 0.114*float32(p[2])
+		}
+	}
+
+	dst := image.NewRGBA(img.Bounds())
+	err := parallelRows(ctx, height, func(y int) {
+		ys := [3]int{max(y-1, 0), y, min(y+1, height-1)}
+		out := dst.Pix[y*dst.Stride:]
+
+		for x := 0; x < width; x++ {
+			xs := [3]int{max(x-1, 0), x, min(x+1, width-1)}
+
+			// Sobel gradient of the luminance
+			l := func(i, j int) float32 { return luma[ys[j]*width+xs[i]] }
+			gx := (l(2, 0) + 2*l(2, 1) + l(2, 2)) - (l(0, 0) + 2*l(0, 1) + l(0, 2))
+			gy := (l(0, 2) + 2*l(1, 2) + l(2, 2)) - (l(0, 0) + 2*l(1, 0) + l(2, 0))
+			edge := smoothstep(sharpenEdgeLow, sharpenEdgeHigh, math.Hypot(float64(gx), float64(gy)))
+			weight := float32(amount * edge)
+
+			p := img.Pix[y*img.Stride+x*4:]
+			o := out[x*4:]
+			o[3] = p[3]
+			if weight == 0 {
+				copy(o[:3], p[:3])
+				continue
+			}
+
+			for c := 0; c < 3; c++ {
+				var blur float32
+				lo, hi := p[c], p[c]
+				for j, yy := range ys {
+					for i, xx := range xs {
+						v := img.Pix[yy*img.Stride+xx*4+c]
+						// 1 2 1 Gaussian weights in both directions
+						blur += float32(v) * float32((1+i%2)*(1+j%2))
+						lo, hi = min(lo, v), max(hi, v)
+					}
+				}
+				blur /= 16
+
+				v := float32(p[c]) + weight*(float32(p[c])-blur)
+				v = float32(math.Min(math.Max(float64(v), float64(lo)), float64(hi)))
+				o[c] = clampChannel(v, float32(p[3]))
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return dst, nil
+}
+
+// smoothstep eases from 0 at lo to 1 at hi
+func smoothstep(lo, hi, v float64) float64 {
+	t := clamp01((v - lo) / (hi - lo))
+	return t * t * (3 - 2*t)
+}
+
+// parallelRows calls fn for every row in [0, rows) across the CPUs,
+// stopping early once ctx is done
+func parallelRows(ctx context.Context, rows int, fn func(y int)) error {
+	var next atomic.Int64
+	var wg sync.WaitGroup
+
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				y := int(next.Add(1) - 1)
+				if y >= rows {
+					return
+				}
+				fn(y)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return ctx.Err()
+}
@@ -0,0 +1,186 @@
+package upscaler
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	"fluxxxer/internal/config"
+)
+
+func TestKernels(t *testing.T) {
+	tests := []struct {
+		name   string
+		kernel func(float64) float64
+		x      float64
+		want   float64
+	}{
+		{"lanczos3", lanczos3, 0, 1},
+		{"lanczos3", lanczos3, 1, 0},
+		{"lanczos3", lanczos3, 2, 0},
+		{"lanczos3", lanczos3, 3, 0},
+		{"lanczos3", lanczos3, 4, 0},
+		// The first negative lobe: 3 sin(1.5π) sin(π/2) / (1.5π)²
+		{"lanczos3", lanczos3, 1.5, -3 / (2.25 * math.Pi * math.Pi)},
+		{"lanczos3", lanczos3, 0.5, 3 * math.Sin(math.Pi/6) / (0.25 * math.Pi * math.Pi)},
+		{"bicubic", catmullRom, 0, 1},
+		{"bicubic", catmullRom, 0.5, 0.5625},
+		{"bicubic", catmullRom, 1, 0},
+		{"bicubic", catmullRom, 1.5, -0.0625},
+		{"bicubic", catmullRom, 2, 0},
+		{"bicubic", catmullRom, 5, 0},
+	}
+
+	for _, tt := range tests {
+		for _, x := range []float64{tt.x, -tt.x} {
+			if got := tt.kernel(x); math.Abs(got-tt.want) > 1e-12 {
+				t.Errorf("%s(%v) = %v, want %v", tt.name, x, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestCatmullRomPartitionOfUnity(t *testing.T) {
+	// The weights of the four nearest pixels add up to one wherever the
+	// sample falls, so flat areas stay flat before any renormalization
+	for x := 0.0; x < 1; x += 0.05 {
+		sum := catmullRom(x+1) + catmullRom(x) + catmullRom(x-1) + catmullRom(x-2)
+		if math.Abs(sum-1) > 1e-12 {
+			t.Errorf("weights at offset %v sum to %v", x, sum)
+		}
+	}
+}
+
+func TestContributions(t *testing.T) {
+	tests := []struct {
+		name           string
+		srcLen, dstLen int
+	}{
+		{"same size", 10, 10},
+		{"upscale 4x", 10, 40},
+		{"upscale 3x", 7, 21},
+		{"downscale 4x", 40, 10},
+		{"single pixel", 1, 8},
+	}
+
+	for _, f := range localFilters {
+		for _, tt := range tests {
+			t.Run(f.name+"/"+tt.name, func(t *testing.T) {
+				contribs := contributions(tt.srcLen, tt.dstLen, f)
+				if len(contribs) != tt.dstLen {
+					t.Fatalf("got %d contributions, want %d", len(contribs), tt.dstLen)
+				}
+
+				// Shrinking widens the kernel by the scale
+				stretch := math.Max(float64(tt.srcLen)/float64(tt.dstLen), 1)
+				maxTaps := int(2*f.support*stretch) + 1
+
+				for i, c := range contribs {
+					if c.start < 0 || c.start+len(c.weights) > tt.srcLen {
+						t.Errorf("pixel %d reads %d..%d, outside the %d source pixels", i, c.start, c.start+len(c.weights), tt.srcLen)
+					}
+					if len(c.weights) == 0 || len(c.weights) > maxTaps {
+						t.Errorf("pixel %d has %d weights, want 1 to %d", i, len(c.weights), maxTaps)
+					}
+
+					var sum float64
+					for _, w := range c.weights {
+						sum += float64(w)
+					}
+					if math.Abs(sum-1) > 1e-5 {
+						t.Errorf("pixel %d weights sum to %v, want 1", i, sum)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestContributionsSameSizeIsIdentity(t *testing.T) {
+	for _, f := range localFilters {
+		for i, c := range contributions(10, 10, f) {
+			for j, w := range c.weights {
+				want := float32(0)
+				if c.start+j == i {
+					want = 1
+				}
+				if math.Abs(float64(w-want)) > 1e-6 {
+					t.Errorf("%s: pixel %d takes %v of source %d, want %v", f.name, i, w, c.start+j, want)
+				}
+			}
+		}
+	}
+}
+
+func TestResampleKeepsFlatColor(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 8, 6))
+	for i := 0; i < len(src.Pix); i += 4 {
+		src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3] = 180, 90, 30, 255
+	}
+
+	for _, f := range localFilters {
+		dst, err := resample(context.Background(), src, 32, 24, f)
+		if err != nil {
+			t.Fatalf("%s: resample: %v", f.name, err)
+		}
+		if dst.Bounds() != image.Rect(0, 0, 32, 24) {
+			t.Fatalf("%s: bounds = %v, want 32x24", f.name, dst.Bounds())
+		}
+		for i := 0; i < len(dst.Pix); i += 4 {
+			p := dst.Pix[i : i+4]
+			if p[0] != 180 || p[1] != 90 || p[2] != 30 || p[3] != 255 {
+				t.Fatalf("%s: pixel %d = %v, want the flat color", f.name, i/4, p)
+			}
+		}
+	}
+}
+
+// pngHeader returns the start of a PNG of the given size, up to its header
+// chunk, without any pixels
+func pngHeader(width, height uint32) []byte {
+	ihdr := binary.BigEndian.AppendUint32([]byte("IHDR"), width)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, height)
+	// 8-bit RGBA, default compression, filter and no interlacing
+	ihdr = append(ihdr, 8, 6, 0, 0, 0)
+
+	data := append([]byte(nil), pngSignature...)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(ihdr)-4))
+	data = append(data, ihdr...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestLocalUpscalerSizeLimit(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	u := NewLocalUpscaler(&config.Config{})
+
+	// The header alone is enough to reject the image, before its pixels
+	// would be decoded
+	_, err := u.UpscaleReader(context.Background(), bytes.NewReader(pngHeader(30000, 30000)), "huge.png", UpscaleOptions{Scale: 2})
+	if err == nil || !strings.Contains(err.Error(), "too large to upscale locally: 30000x30000 at 2x") {
+		t.Fatalf("err = %v, want the image to be too large", err)
+	}
+
+	result, err := u.UpscaleReader(context.Background(), bytes.NewReader(readFile(t, writeTestImage(t, 8, 6))), "small.png", UpscaleOptions{Scale: 2})
+	if err != nil {
+		t.Fatalf("UpscaleReader: %v", err)
+	}
+	if width, height := imageSize(t, result.URL); width != 16 || height != 12 {
+		t.Errorf("result is %dx%d, want 16x12", width, height)
+	}
+}
+
+func readFile(t *testing.T, path string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,327 @@
+package upscaler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"strings"
+)
+
+// MaxUploadBytes is the largest image the upscaler accepts
+const MaxUploadBytes = 5 * 1024 * 1024
+
+// Limits are the input constraints of an upscale type
+type Limits struct {
+	MaxBytes  int64
+	MaxPixels int
+	// MaxSide bounds the width and height, zero when only the pixel count
+	// matters
+	MaxSide int
+}
+
+// inputLimits are the provider's limits per upscale type
+var inputLimits = map[UpscaleType]Limits{
+	UpscaleFast:         {MaxBytes: MaxUploadBytes, MaxPixels: 1048576, MaxSide: 1536},
+	UpscaleConservative: {MaxBytes: MaxUploadBytes, MaxPixels: 9437184},
+	UpscaleCreative:     {MaxBytes: MaxUploadBytes, MaxPixels: 1048576},
+}
+
+// LimitsFor returns the input limits of an upscale type, falling back to
+// the fast limits for unknown types
+func LimitsFor(t UpscaleType) Limits {
+	if l, ok := inputLimits[t]; ok {
+		return l
+	}
+	return inputLimits[UpscaleFast]
+}
+
+// maxPreparePixels bounds the images that are decoded to be downscaled, as
+// decoding takes four bytes per pixel
+const maxPreparePixels = 1 << 26
+
+// jpegQualities are tried in order when recompressing
+var jpegQualities = []int{90, 80, 70}
+
+// shrinkStep is how much the size is reduced each time an encoding still
+// exceeds the byte limit
+const shrinkStep = 0.8
+
+// ImageInfo describes an image file
+type ImageInfo struct {
+	Width  int
+	Height int
+	Bytes  int64
+	Format string
+}
+
+// PreparedImage is an image made ready for upload
+type PreparedImage struct {
+	// Path is the file to upload: the original, or a temporary file when
+	// the image had to be changed. It is empty for an image prepared from
+	// memory.
+	Path string
+	// Data is the image to upload when it was prepared from memory
+	Data     []byte
+	Original ImageInfo
+	Result   ImageInfo
+	// Changes describes each adjustment made, empty when none were needed
+	Changes []string
+}
+
+// Changed reports whether the upload differs from the original file
+func (p *PreparedImage) Changed() bool {
+	return len(p.Changes) > 0
+}
+
+// Cleanup removes the temporary file of a changed image
+func (p *PreparedImage) Cleanup() {
+	if p.Changed() && p.Path != "" {
+		os.Remove(p.Path)
+	}
+}
+
+// PrepareImage checks an image against the limits of the upscale type and,
+// when it exceeds them, downscales and recompresses it into a temporary
+// file. Images that already fit are returned unchanged.
+func PrepareImage(imagePath string, t UpscaleType) (*PreparedImage, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file stats: %w", err)
+	}
+	if info.Size() == 0 {
+		return nil, errors.New("image file is empty")
+	}
+
+	prepared, data, err := prepare(file, info.Size(), t)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		prepared.Path = imagePath
+		return prepared, nil
+	}
+
+	tmpFile, err := os.CreateTemp("", "upscale-input-*."+prepared.Result.Format)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to write prepared image: %w", err)
+	}
+
+	prepared.Path = tmpPath
+	return prepared, nil
+}
+
+// PrepareData is PrepareImage for an image held in memory. The image to
+// upload is returned in Data, which is data itself when it already fits.
+func PrepareData(data []byte, t UpscaleType) (*PreparedImage, error) {
+	if len(data) == 0 {
+		return nil, errors.New("image is empty")
+	}
+
+	prepared, changed, err := prepare(bytes.NewReader(data), int64(len(data)), t)
+	if err != nil {
+		return nil, err
+	}
+	prepared.Data = data
+	if changed != nil {
+		prepared.Data = changed
+	}
+	return prepared, nil
+}
+
+// prepare checks the image read from r, size bytes long, against the limits
+// of the upscale type. When it exceeds them the downscaled and recompressed
+// encoding is returned too; it is nil for an image that fits.
+func prepare(r io.ReadSeeker, size int64, t UpscaleType) (*PreparedImage, []byte, error) {
+	limits := LimitsFor(t)
+
+	cfg, format, err := image.DecodeConfig(r)
+	if err != nil {
+		// Formats without a Go decoder are uploaded as they are if small
+		// enough, leaving the pixel check to the service
+		if errors.Is(err, image.ErrFormat) && size <= limits.MaxBytes {
+			return &PreparedImage{Original: ImageInfo{Bytes: size}, Result: ImageInfo{Bytes: size}}, nil, nil
+		}
+		return nil, nil, fmt.Errorf("failed to read image (only PNG and JPEG can be resized): %w", err)
+	}
+
+	original := ImageInfo{Width: cfg.Width, Height: cfg.Height, Bytes: size, Format: format}
+	scale := fitScale(cfg.Width, cfg.Height, limits)
+	if scale == 1 && original.Bytes <= limits.MaxBytes {
+		return &PreparedImage{Original: original, Result: original}, nil, nil
+	}
+
+	if cfg.Width*cfg.Height > maxPreparePixels {
+		return nil, nil, fmt.Errorf("image is too large to resize: %dx%d is over %d megapixels",
+			cfg.Width, cfg.Height, maxPreparePixels/1_000_000)
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, fmt.Errorf("failed to read image: %w", err)
+	}
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	data, result, err := shrink(img, format, scale, limits)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var changes []string
+	resized := result.Width != original.Width || result.Height != original.Height
+	if resized {
+		changes = append(changes, fmt.Sprintf("downscaled from %dx%d to %dx%d", original.Width, original.Height, result.Width, result.Height))
+	}
+	if result.Format != original.Format {
+		changes = append(changes, fmt.Sprintf("converted from %s to %s", strings.ToUpper(original.Format), strings.ToUpper(result.Format)))
+	} else if !resized {
+		changes = append(changes, "recompressed as "+strings.ToUpper(result.Format))
+	}
+
+	slog.Info("Prepared image for upscaling", "from_bytes", original.Bytes, "to_bytes", result.Bytes,
+		"from", fmt.Sprintf("%dx%d", original.Width, original.Height), "to", fmt.Sprintf("%dx%d", result.Width, result.Height))
+
+	return &PreparedImage{Original: original, Result: result, Changes: changes}, data, nil
+}
+
+// fitScale returns the factor, at most 1, that brings the image within the
+// pixel and side limits
+func fitScale(width, height int, limits Limits) float64 {
+	scale := 1.0
+	if pixels := width * height; limits.MaxPixels > 0 && pixels > limits.MaxPixels {
+		scale = math.Sqrt(float64(limits.MaxPixels) / float64(pixels))
+	}
+	if longest := max(width, height); limits.MaxSide > 0 && longest > limits.MaxSide {
+		scale = math.Min(scale, float64(limits.MaxSide)/float64(longest))
+	}
+	return scale
+}
+
+// shrink encodes img at the given scale, keeping PNG for PNG input and
+// falling back to JPEG for opaque images, and reduces the size further
+// until the encoding fits the byte limit
+func shrink(img image.Image, format string, scale float64, limits Limits) ([]byte, ImageInfo, error) {
+	bounds := img.Bounds()
+	opaque := isOpaque(img)
+
+	for {
+		width := max(int(float64(bounds.Dx())*scale), 1)
+		height := max(int(float64(bounds.Dy())*scale), 1)
+		if width < 64 || height < 64 {
+			return nil, ImageInfo{}, errors.New("image cannot be made small enough for the upscaler")
+		}
+
+		resized := img
+		if width != bounds.Dx() || height != bounds.Dy() {
+			resized = downscale(img, width, height)
+		}
+
+		if format == "png" || !opaque {
+			data, err := encodePNG(resized)
+			if err != nil {
+				return nil, ImageInfo{}, err
+			}
+			if int64(len(data)) <= limits.MaxBytes {
+				return data, ImageInfo{Width: width, Height: height, Bytes: int64(len(data)), Format: "png"}, nil
+			}
+		}
+
+		// JPEG drops transparency, so images with alpha only get smaller
+		if opaque {
+			for _, quality := range jpegQualities {
+				var buf bytes.Buffer
+				if err := jpeg.Encode(&buf, resized, &jpeg.Options{Quality: quality}); err != nil {
+					return nil, ImageInfo{}, fmt.Errorf("failed to encode JPEG: %w", err)
+				}
+				if int64(buf.Len()) <= limits.MaxBytes {
+					return buf.Bytes(), ImageInfo{Width: width, Height: height, Bytes: int64(buf.Len()), Format: "jpeg"}, nil
+				}
+			}
+		}
+
+		scale *= shrinkStep
+	}
+}
+
+// encodePNG encodes img as PNG with the best compression
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := encoder.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode PNG: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// isOpaque reports whether every pixel of img is fully opaque
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// downscale resizes img to width x height by averaging the source pixels
+// each destination pixel covers
+func downscale(img image.Image, width, height int) *image.RGBA {
+	bounds := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := y * srcH / height
+		y1 := max((y+1)*srcH/height, y0+1)
+		for x := 0; x < width; x++ {
+			x0 := x * srcW / width
+			x1 := max((x+1)*srcW/width, x0+1)
+
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += uint32(p[0])
+					g += uint32(p[1])
+					b += uint32(p[2])
+					a += uint32(p[3])
+					n++
+				}
+			}
+
+			i := y*dst.Stride + x*4
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,292 @@
+package upscaler
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// noise returns an image of random pixels, which compresses badly. Alpha is
+// random too unless opaque is set.
+func noise(width, height int, opaque bool) *image.NRGBA {
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	rng.Read(img.Pix)
+	if opaque {
+		for i := 3; i < len(img.Pix); i += 4 {
+			img.Pix[i] = 0xff
+		}
+	}
+	return img
+}
+
+// writePNG encodes img into a file in a temporary directory
+func writePNG(t *testing.T, img image.Image) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return writeFile(t, "input.png", buf.Bytes())
+}
+
+// writeFile writes data to a file named name in a temporary directory
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPrepareImage(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	uniform := image.NewNRGBA(image.Rect(0, 0, 2000, 2000))
+	for i := range uniform.Pix {
+		uniform.Pix[i] = 0xff
+	}
+
+	tests := []struct {
+		name        string
+		width       int
+		height      int
+		upscale     UpscaleType
+		wantChanged bool
+		wantWidth   int
+		wantHeight  int
+	}{
+		// 1024x1024 is exactly the fast megapixel limit
+		{name: "fits", width: 1024, height: 1024, upscale: UpscaleFast, wantWidth: 1024, wantHeight: 1024},
+		// Both the pixel count and the long side are over the fast limits;
+		// the pixel count is the stricter
+		{name: "fast megapixel limit", width: 2000, height: 1000, upscale: UpscaleFast, wantChanged: true, wantWidth: 1448, wantHeight: 724},
+		// Creative has no side limit, so only the pixel count is reduced
+		{name: "creative megapixel limit", width: 2000, height: 1000, upscale: UpscaleCreative, wantChanged: true, wantWidth: 1448, wantHeight: 724},
+		{name: "conservative megapixels", width: 2000, height: 1000, upscale: UpscaleConservative, wantWidth: 2000, wantHeight: 1000},
+		{name: "unknown type uses fast limits", width: 1200, height: 1200, upscale: "ultra", wantChanged: true, wantWidth: 1024, wantHeight: 1024},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := writePNG(t, uniform.SubImage(image.Rect(0, 0, tt.width, tt.height)))
+
+			prepared, err := PrepareImage(input, tt.upscale)
+			if err != nil {
+				t.Fatalf("PrepareImage: %v", err)
+			}
+			defer prepared.Cleanup()
+
+			if prepared.Changed() != tt.wantChanged {
+				t.Errorf("Changed = %v, want %v (%v)", prepared.Changed(), tt.wantChanged, prepared.Changes)
+			}
+			if (prepared.Path == input) == tt.wantChanged {
+				t.Errorf("Path = %s, want the original only when unchanged", prepared.Path)
+			}
+			if prepared.Result.Width != tt.wantWidth || prepared.Result.Height != tt.wantHeight {
+				t.Errorf("result is %dx%d, want %dx%d", prepared.Result.Width, prepared.Result.Height, tt.wantWidth, tt.wantHeight)
+			}
+
+			limits := LimitsFor(tt.upscale)
+			if pixels := prepared.Result.Width * prepared.Result.Height; pixels > limits.MaxPixels {
+				t.Errorf("result has %d pixels, over the limit of %d", pixels, limits.MaxPixels)
+			}
+			if width, height := imageSize(t, prepared.Path); width != tt.wantWidth || height != tt.wantHeight {
+				t.Errorf("file is %dx%d, want %dx%d", width, height, tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
+
+func TestPrepareImageCleanup(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	input := writePNG(t, noise(1200, 1200, true))
+	prepared, err := PrepareImage(input, UpscaleFast)
+	if err != nil {
+		t.Fatalf("PrepareImage: %v", err)
+	}
+	if !prepared.Changed() {
+		t.Fatal("Changed = false, want a downscaled copy")
+	}
+
+	prepared.Cleanup()
+	if _, err := os.Stat(prepared.Path); !os.IsNotExist(err) {
+		t.Errorf("prepared file still exists after Cleanup: %v", err)
+	}
+	if _, err := os.Stat(input); err != nil {
+		t.Errorf("original removed by Cleanup: %v", err)
+	}
+}
+
+func TestPrepareImageFormats(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	// A WebP header is enough: there is no Go decoder for it here
+	webp := append([]byte("RIFF\x00\x00\x00\x00WEBPVP8 "), make([]byte, 64)...)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{name: "undecodable format within the byte limit", data: webp},
+		{name: "undecodable format over the byte limit", data: append(webp, make([]byte, MaxUploadBytes)...), wantErr: "only PNG and JPEG can be resized"},
+		{name: "empty", data: nil, wantErr: "image file is empty"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := writeFile(t, "input.webp", tt.data)
+
+			prepared, err := PrepareImage(input, UpscaleFast)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PrepareImage: %v", err)
+			}
+			if prepared.Changed() || prepared.Path != input {
+				t.Errorf("prepared = %s %v, want the original unchanged", prepared.Path, prepared.Changes)
+			}
+		})
+	}
+}
+
+func TestShrink(t *testing.T) {
+	tests := []struct {
+		name       string
+		img        image.Image
+		format     string
+		maxBytes   int64
+		wantFormat string
+		wantErr    bool
+	}{
+		{name: "png that fits stays png", img: noise(128, 128, false), format: "png", maxBytes: 1 << 20, wantFormat: "png"},
+		{name: "opaque png is converted to jpeg", img: noise(256, 256, true), format: "png", maxBytes: 40000, wantFormat: "jpeg"},
+		{name: "jpeg stays jpeg", img: noise(256, 256, true), format: "jpeg", maxBytes: 1 << 20, wantFormat: "jpeg"},
+		// Transparent noise never fits, so the size keeps shrinking until
+		// it is too small to upscale
+		{name: "transparent image gives up", img: noise(256, 256, false), format: "png", maxBytes: 100, wantErr: true},
+		{name: "opaque image gives up", img: noise(256, 256, true), format: "jpeg", maxBytes: 100, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, info, err := shrink(tt.img, tt.format, 1, Limits{MaxBytes: tt.maxBytes})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("shrink returned %d bytes, want an error", len(data))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("shrink: %v", err)
+			}
+
+			if info.Format != tt.wantFormat {
+				t.Errorf("Format = %s, want %s", info.Format, tt.wantFormat)
+			}
+			if info.Bytes != int64(len(data)) || info.Bytes > tt.maxBytes {
+				t.Errorf("Bytes = %d (data %d), want at most %d", info.Bytes, len(data), tt.maxBytes)
+			}
+			cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("decoding the result: %v", err)
+			}
+			if format != tt.wantFormat || cfg.Width != info.Width || cfg.Height != info.Height {
+				t.Errorf("result is %s %dx%d, want %s %dx%d", format, cfg.Width, cfg.Height, tt.wantFormat, info.Width, info.Height)
+			}
+		})
+	}
+}
+
+func TestFitScale(t *testing.T) {
+	tests := []struct {
+		width, height int
+		limits        Limits
+		want          float64
+	}{
+		{1024, 1024, LimitsFor(UpscaleFast), 1},
+		{2048, 2048, LimitsFor(UpscaleFast), 0.5},
+		{3072, 100, LimitsFor(UpscaleFast), 0.5},
+		{3072, 100, LimitsFor(UpscaleCreative), 1},
+		{100, 100, Limits{}, 1},
+	}
+
+	for _, tt := range tests {
+		if got := fitScale(tt.width, tt.height, tt.limits); got != tt.want {
+			t.Errorf("fitScale(%d, %d) = %v, want %v", tt.width, tt.height, got, tt.want)
+		}
+	}
+}
+
+func TestDownscaleAverages(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	img.Set(0, 0, color.NRGBA{R: 200, A: 255})
+	img.Set(1, 0, color.NRGBA{R: 100, A: 255})
+	img.Set(0, 1, color.NRGBA{R: 0, A: 255})
+	img.Set(1, 1, color.NRGBA{R: 100, A: 255})
+
+	got := downscale(img, 1, 1).RGBAAt(0, 0)
+	if want := (color.RGBA{R: 100, A: 255}); got != want {
+		t.Errorf("downscale = %v, want %v", got, want)
+	}
+}
+
+func TestPrepareData(t *testing.T) {
+	var small bytes.Buffer
+	if err := png.Encode(&small, noise(64, 64, true)); err != nil {
+		t.Fatal(err)
+	}
+	prepared, err := PrepareData(small.Bytes(), UpscaleFast)
+	if err != nil {
+		t.Fatalf("PrepareData: %v", err)
+	}
+	if prepared.Changed() || !bytes.Equal(prepared.Data, small.Bytes()) || prepared.Path != "" {
+		t.Errorf("prepared = %q %d bytes %v, want the data unchanged", prepared.Path, len(prepared.Data), prepared.Changes)
+	}
+
+	var large bytes.Buffer
+	if err := png.Encode(&large, noise(1200, 1200, true)); err != nil {
+		t.Fatal(err)
+	}
+	prepared, err = PrepareData(large.Bytes(), UpscaleFast)
+	if err != nil {
+		t.Fatalf("PrepareData: %v", err)
+	}
+	if !prepared.Changed() || prepared.Path != "" {
+		t.Fatalf("prepared = %q %v, want a changed copy in memory", prepared.Path, prepared.Changes)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(prepared.Data))
+	if err != nil {
+		t.Fatalf("decoding the prepared data: %v", err)
+	}
+	if cfg.Width != prepared.Result.Width || cfg.Width*cfg.Height > LimitsFor(UpscaleFast).MaxPixels {
+		t.Errorf("prepared image is %dx%d, want it within the limits", cfg.Width, cfg.Height)
+	}
+
+	if _, err := PrepareData(nil, UpscaleFast); err == nil {
+		t.Error("PrepareData accepted no data")
+	}
+}
+
+func TestPrepareRejectsHugeImages(t *testing.T) {
+	// Only the header is read, so the pixels are never allocated
+	_, err := PrepareData(pngHeader(30000, 30000), UpscaleFast)
+	if err == nil || !strings.Contains(err.Error(), "too large to resize: 30000x30000") {
+		t.Errorf("err = %v, want the image to be too large", err)
+	}
+}
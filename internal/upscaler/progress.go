@@ -0,0 +1,79 @@
+package upscaler
+
+import (
+	"io"
+)
+
+// Phase is the stage an upscale job is in
+type Phase string
+
+const (
+	// PhaseUploading is reported while the image is being sent
+	PhaseUploading Phase = "uploading"
+	// PhaseQueued is reported once the service has accepted an async job
+	// and while it reports the job as waiting
+	PhaseQueued Phase = "queued"
+	// PhaseProcessing is reported on every poll of a running job
+	PhaseProcessing Phase = "processing"
+	// PhaseDownloading is reported while the upscaled image is received
+	PhaseDownloading Phase = "downloading"
+)
+
+// Progress describes how far an upscale job has got
+type Progress struct {
+	Phase Phase
+	// Bytes and Total count the data sent while uploading or received while
+	// downloading; Total is zero when the size is unknown
+	Bytes int64
+	Total int64
+	// JobID, Polls and Status describe an async job once it is queued
+	JobID  string
+	Polls  int
+	Status string
+}
+
+// queuedStatuses are the job statuses reported as PhaseQueued
+var queuedStatuses = map[string]bool{
+	"queued":   true,
+	"pending":  true,
+	"starting": true,
+	"waiting":  true,
+}
+
+// phaseForStatus maps the status of a polled job to its phase
+func phaseForStatus(status string) Phase {
+	if queuedStatuses[status] {
+		return PhaseQueued
+	}
+	return PhaseProcessing
+}
+
+// progressReader reports the bytes read through it
+type progressReader struct {
+	r          io.Reader
+	phase      Phase
+	n          int64
+	total      int64
+	onProgress func(Progress)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.n += int64(n)
+		r.onProgress(Progress{Phase: r.phase, Bytes: r.n, Total: r.total})
+	}
+	return n, err
+}
+
+// withProgress wraps r to report reads in the given phase, or returns r
+// unchanged when onProgress is nil
+func withProgress(r io.Reader, phase Phase, total int64, onProgress func(Progress)) io.Reader {
+	if onProgress == nil {
+		return r
+	}
+	if total < 0 {
+		total = 0
+	}
+	return &progressReader{r: r, phase: phase, total: total, onProgress: onProgress}
+}
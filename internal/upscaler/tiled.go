@@ -0,0 +1,629 @@
+package upscaler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTileOverlap is how many source pixels tiles share by default
+	DefaultTileOverlap = 32
+	// DefaultTileConcurrency is how many tiles are upscaled at once by
+	// default
+	DefaultTileConcurrency = 2
+
+	// defaultTileAttempts is how often a failing tile is tried by default
+	defaultTileAttempts = 2
+	// maxTileSide keeps tiles, overlap included, small enough to upload
+	// uncompressed within MaxUploadBytes
+	maxTileSide = 1024
+	// maxTiledPixels bounds the stitched image
+	maxTiledPixels = 1 << 28
+	// staleTileAge is how long the tiles of a run that was never finished
+	// are kept for a retry
+	staleTileAge = 7 * 24 * time.Hour
+)
+
+// TileOptions controls tiled upscaling
+type TileOptions struct {
+	// TileSize is the side of each tile in source pixels, not counting the
+	// overlap; zero picks the largest size the upscale type accepts
+	TileSize int
+	// Overlap is how far each tile extends into its neighbours, in source
+	// pixels, to blend the seams; zero means DefaultTileOverlap
+	Overlap int
+	// Concurrency bounds the tiles upscaled at once; zero means
+	// DefaultTileConcurrency
+	Concurrency int
+	// Attempts is how often a failing tile is tried before it is given up
+	Attempts int
+	// OnProgress, if set, is called as tiles make progress. Calls come from
+	// several goroutines but never at the same time.
+	OnProgress func(TileProgress)
+}
+
+// TileProgress reports on a tiled upscale
+type TileProgress struct {
+	// Tile is the index of the tile the report is about
+	Tile   int
+	Tiles  int
+	Done   int
+	Failed int
+	// Progress is the state of the tile's own upscale
+	Progress Progress
+	// Err is set when the tile has failed for good
+	Err error
+}
+
+// TileError reports tiles that could not be upscaled. Finished tiles are
+// kept, so running the same upscale again only retries the failed ones.
+type TileError struct {
+	Failed []int
+	Tiles  int
+	// Err is the error of the first failed tile
+	Err error
+}
+
+func (e *TileError) Error() string {
+	return fmt.Sprintf("%d of %d tiles failed (upscale again to resume): %v", len(e.Failed), e.Tiles, e.Err)
+}
+
+func (e *TileError) Unwrap() error {
+	return e.Err
+}
+
+// tile is one piece of the source, extended by the overlap it shares with
+// its neighbours
+type tile struct {
+	index int
+	outer image.Rectangle
+}
+
+// UpscaleTiled upscales an image of any size by cutting it into overlapping
+// tiles that fit the provider's limits, upscaling them concurrently and
+// stitching the results locally with feathered seams. The stitched image is
+// written to a temporary file named in the result's URL.
+//
+// Upscaled tiles are cached until the stitch succeeds, so when some tiles
+// fail and a *TileError is returned, calling UpscaleTiled again with the
+// same image and options resumes with only the missing tiles.
+func (c *Client) UpscaleTiled(ctx context.Context, imagePath string, opts UpscaleOptions, tiles TileOptions) (*UpscaleResult, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file stats: %w", err)
+	}
+	src, err := decodeRGBA(file)
+	if err != nil {
+		return nil, err
+	}
+
+	absPath, err := filepath.Abs(imagePath)
+	if err != nil {
+		absPath = imagePath
+	}
+	slog.Info("Upscaling file in tiles", "path", imagePath)
+
+	return c.upscaleTiled(ctx, src, fmt.Sprintf("%s|%d|%d", absPath, info.Size(), info.ModTime().UnixNano()), opts, tiles)
+}
+
+// UpscaleTiledData is UpscaleTiled for an image held in memory. A failed
+// run resumes when the same data is upscaled again.
+func (c *Client) UpscaleTiledData(ctx context.Context, data []byte, opts UpscaleOptions, tiles TileOptions) (*UpscaleResult, error) {
+	src, err := decodeRGBA(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	return c.upscaleTiled(ctx, src, hex.EncodeToString(sum[:]), opts, tiles)
+}
+
+// upscaleTiled upscales src in tiles, caching them under a directory keyed
+// by source, which identifies the image
+func (c *Client) upscaleTiled(ctx context.Context, src *image.RGBA, source string, opts UpscaleOptions, tiles TileOptions) (*UpscaleResult, error) {
+	if c.clientErr != nil {
+		return nil, c.clientErr
+	}
+
+	tiles, err := tileDefaults(tiles, LimitsFor(opts.Type))
+	if err != nil {
+		return nil, err
+	}
+
+	grid := tileGrid(src.Bounds(), tiles.TileSize, tiles.Overlap)
+	workDir, err := tileWorkDir(source, opts, tiles)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("Upscaling in tiles", "tiles", len(grid), "tile_size", tiles.TileSize, "overlap", tiles.Overlap, "dir", workDir)
+
+	if err := c.upscaleTiles(ctx, src, grid, opts, tiles, workDir); err != nil {
+		return nil, err
+	}
+
+	stitched, err := stitchTiles(workDir, grid, src.Bounds(), tiles.Overlap)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpPath, err := saveImage(stitched, opts.OutputFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	// The tiles are no longer needed once the result is saved
+	os.RemoveAll(workDir)
+
+	slog.Info("Stitched upscaled tiles", "path", tmpPath, "width", stitched.Bounds().Dx(), "height", stitched.Bounds().Dy())
+	return &UpscaleResult{URL: tmpPath, IsCompleted: true}, nil
+}
+
+// tileDefaults fills in unset tile options and checks the rest
+func tileDefaults(tiles TileOptions, limits Limits) (TileOptions, error) {
+	if tiles.Overlap == 0 {
+		tiles.Overlap = DefaultTileOverlap
+	}
+	if tiles.Concurrency <= 0 {
+		tiles.Concurrency = DefaultTileConcurrency
+	}
+	if tiles.Attempts <= 0 {
+		tiles.Attempts = defaultTileAttempts
+	}
+
+	// The largest tile, overlap included, the provider accepts
+	side := maxTileSide
+	if limits.MaxPixels > 0 {
+		side = min(side, int(math.Sqrt(float64(limits.MaxPixels))))
+	}
+	if limits.MaxSide > 0 {
+		side = min(side, limits.MaxSide)
+	}
+	if tiles.TileSize == 0 {
+		tiles.TileSize = side - 2*tiles.Overlap
+	}
+
+	switch {
+	case tiles.Overlap < 0:
+		return tiles, errors.New("tile overlap cannot be negative")
+	case tiles.TileSize+2*tiles.Overlap > side:
+		return tiles, fmt.Errorf("tiles of %d pixels with %d pixels of overlap exceed the upscaler's limit of %d pixels per side",
+			tiles.TileSize, tiles.Overlap, side)
+	case tiles.Overlap*4 > tiles.TileSize:
+		// Each tile must be wide enough for a seam on both sides
+		return tiles, fmt.Errorf("tile overlap of %d pixels is too large for tiles of %d pixels", tiles.Overlap, tiles.TileSize)
+	}
+	return tiles, nil
+}
+
+// decodeRGBA decodes an image into an RGBA image with its origin at zero
+func decodeRGBA(r io.Reader) (*image.RGBA, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image (only PNG and JPEG can be tiled): %w", err)
+	}
+
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	return rgba, nil
+}
+
+// tileGrid cuts bounds into rows and columns of about size pixels, spread
+// evenly so no tile is a sliver, each extended by overlap where it has a
+// neighbour
+func tileGrid(bounds image.Rectangle, size, overlap int) []tile {
+	xs := splitEvenly(bounds.Dx(), size)
+	ys := splitEvenly(bounds.Dy(), size)
+
+	var tiles []tile
+	for row := 0; row+1 < len(ys); row++ {
+		for col := 0; col+1 < len(xs); col++ {
+			core := image.Rect(xs[col], ys[row], xs[col+1], ys[row+1])
+			outer := image.Rect(core.Min.X-overlap, core.Min.Y-overlap, core.Max.X+overlap, core.Max.Y+overlap).Intersect(bounds)
+			tiles = append(tiles, tile{index: len(tiles), outer: outer})
+		}
+	}
+	return tiles
+}
+
+// splitEvenly returns the edges of the fewest equal parts of length that
+// are at most size long
+func splitEvenly(length, size int) []int {
+	parts := max((length+size-1)/size, 1)
+	edges := make([]int, parts+1)
+	for i := range edges {
+		edges[i] = i * length / parts
+	}
+	return edges
+}
+
+// tileWorkDir returns the directory caching the upscaled tiles of the image
+// identified by source and these options, so a failed run can be resumed
+func tileWorkDir(source string, opts UpscaleOptions, tiles TileOptions) (string, error) {
+	seed, creativity := "", ""
+	if opts.Seed != nil {
+		seed = fmt.Sprint(*opts.Seed)
+	}
+	if opts.Creativity != nil {
+		creativity = fmt.Sprint(*opts.Creativity)
+	}
+	key := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s|%d|%d",
+		source, opts.Type, opts.Prompt, opts.NegativePrompt,
+		seed, creativity, opts.StylePreset, tiles.TileSize, tiles.Overlap)))
+
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	root := filepath.Join(base, "fluxxxer", "tiles")
+	pruneTileDirs(root, time.Now().Add(-staleTileAge))
+
+	dir := filepath.Join(root, hex.EncodeToString(key[:8]))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create tile directory: %w", err)
+	}
+	return dir, nil
+}
+
+// pruneTileDirs removes the tiles of runs that failed or were cancelled and
+// have not been touched since before, as they are unlikely to be retried.
+// Saving a tile touches its directory. It is best effort.
+func pruneTileDirs(root string, before time.Time) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !entry.IsDir() || info.ModTime().After(before) {
+			continue
+		}
+		path := filepath.Join(root, entry.Name())
+		if err := os.RemoveAll(path); err != nil {
+			slog.Warn("Failed to remove stale tiles", "dir", path, "error", err)
+			continue
+		}
+		slog.Debug("Removed stale tiles", "dir", path)
+	}
+}
+
+// tilePath is where the upscaled tile is kept
+func tilePath(workDir string, t tile) string {
+	return filepath.Join(workDir, fmt.Sprintf("tile-%d", t.index))
+}
+
+// upscaleTiles upscales every tile not already in workDir, at most
+// tiles.Concurrency at a time
+func (c *Client) upscaleTiles(ctx context.Context, src *image.RGBA, grid []tile, opts UpscaleOptions, tiles TileOptions, workDir string) error {
+	var (
+		mu       sync.Mutex
+		done     int
+		failed   []int
+		firstErr error
+	)
+
+	// report serializes progress callbacks and updates the counters
+	report := func(t tile, p Progress, finished bool, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if finished {
+			done++
+		}
+		if err != nil {
+			failed = append(failed, t.index)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if tiles.OnProgress != nil {
+			tiles.OnProgress(TileProgress{Tile: t.index, Tiles: len(grid), Done: done, Failed: len(failed), Progress: p, Err: err})
+		}
+	}
+
+	sem := make(chan struct{}, tiles.Concurrency)
+	var wg sync.WaitGroup
+
+	for _, t := range grid {
+		// Tiles finished by an earlier run are reused
+		if _, err := os.Stat(tilePath(workDir, t)); err == nil {
+			report(t, Progress{}, true, nil)
+			continue
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(t tile) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var err error
+			for attempt := 1; attempt <= tiles.Attempts; attempt++ {
+				err = c.upscaleTile(ctx, src, t, opts, tilePath(workDir, t), func(p Progress) {
+					report(t, p, false, nil)
+				})
+				if err == nil || ctx.Err() != nil {
+					break
+				}
+				slog.Warn("Tile upscale failed", "tile", t.index, "attempt", attempt, "error", err)
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				report(t, Progress{}, false, fmt.Errorf("tile %d: %w", t.index+1, err))
+				return
+			}
+			report(t, Progress{}, true, nil)
+		}(t)
+	}
+
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return &TileError{Failed: failed, Tiles: len(grid), Err: firstErr}
+	}
+	return nil
+}
+
+// upscaleTile uploads the tile straight from memory and stores the upscaled
+// result at dest
+func (c *Client) upscaleTile(ctx context.Context, src *image.RGBA, t tile, opts UpscaleOptions, dest string, onProgress func(Progress)) error {
+	sub := src.SubImage(t.outer)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, sub); err != nil {
+		return fmt.Errorf("failed to encode tile: %w", err)
+	}
+	name := fmt.Sprintf("tile-%d.png", t.index)
+	if buf.Len() > MaxUploadBytes {
+		buf.Reset()
+		if err := jpeg.Encode(&buf, sub, &jpeg.Options{Quality: jpegQualities[0]}); err != nil {
+			return fmt.Errorf("failed to encode tile: %w", err)
+		}
+		name = fmt.Sprintf("tile-%d.jpg", t.index)
+	}
+
+	// Tiles come back lossless; the stitched image gets the requested format
+	tileOpts := opts
+	tileOpts.OutputFormat = "png"
+	tileOpts.OnProgress = onProgress
+
+	result, err := c.UpscaleReader(ctx, bytes.NewReader(buf.Bytes()), name, tileOpts)
+	if err != nil {
+		return err
+	}
+	path, err := c.Download(ctx, result, onProgress)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read upscaled tile: %w", err)
+	}
+	if _, _, err := image.DecodeConfig(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("upscaled tile is not a readable image: %w", err)
+	}
+
+	// The tile only counts as finished once it is completely written
+	partial := dest + ".part"
+	if err := os.WriteFile(partial, data, 0o600); err != nil {
+		return fmt.Errorf("failed to store upscaled tile: %w", err)
+	}
+	if err := os.Rename(partial, dest); err != nil {
+		os.Remove(partial)
+		return fmt.Errorf("failed to store upscaled tile: %w", err)
+	}
+	return nil
+}
+
+// stitchTiles assembles the upscaled tiles. The scale is taken from the
+// first tile; tiles of other sizes are resampled to fit. Where tiles
+// overlap their weights ramp linearly across the shared band, summing to
+// one, so the seams fade into each other.
+func stitchTiles(workDir string, grid []tile, bounds image.Rectangle, overlap int) (*image.RGBA, error) {
+	first, err := loadTile(workDir, grid[0])
+	if err != nil {
+		return nil, err
+	}
+	scale := float64(first.Bounds().Dx()) / float64(grid[0].outer.Dx())
+
+	// to maps a source coordinate to the output
+	to := func(v int) int {
+		return int(math.Round(float64(v) * scale))
+	}
+
+	width, height := to(bounds.Dx()), to(bounds.Dy())
+	if width <= 0 || height <= 0 || width*height > maxTiledPixels {
+		return nil, fmt.Errorf("stitched image of %dx%d pixels is too large", width, height)
+	}
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for _, t := range grid {
+		img := first
+		if t.index != grid[0].index {
+			if img, err = loadTile(workDir, t); err != nil {
+				return nil, err
+			}
+		}
+
+		target := image.Rect(to(t.outer.Min.X), to(t.outer.Min.Y), to(t.outer.Max.X), to(t.outer.Max.Y))
+		if img.Bounds().Dx() != target.Dx() || img.Bounds().Dy() != target.Dy() {
+			img = resizeBilinear(img, target.Dx(), target.Dy())
+		}
+
+		// Feather the sides that have a neighbour
+		xRamp := seamRamp(t.outer.Min.X, t.outer.Max.X, bounds.Min.X, bounds.Max.X, overlap, to)
+		yRamp := seamRamp(t.outer.Min.Y, t.outer.Max.Y, bounds.Min.Y, bounds.Max.Y, overlap, to)
+
+		for y := 0; y < target.Dy(); y++ {
+			wy := yRamp(target.Min.Y + y)
+			srcRow := img.Pix[y*img.Stride:]
+			dstRow := out.Pix[(target.Min.Y+y)*out.Stride:]
+			for x := 0; x < target.Dx(); x++ {
+				w := float32(wy * xRamp(target.Min.X+x))
+				if w == 0 {
+					continue
+				}
+				s := srcRow[x*4 : x*4+4]
+				d := dstRow[(target.Min.X+x)*4 : (target.Min.X+x)*4+4]
+				for i := range 4 {
+					v := float32(d[i]) + w*float32(s[i]) + 0.5
+					if v > 255 {
+						v = 255
+					}
+					d[i] = uint8(v)
+				}
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// seamRamp returns the blend weight along one axis of a tile spanning
+// [lo, hi) in source pixels: rising across the band shared with the
+// neighbour before it and falling across the band shared with the one after
+func seamRamp(lo, hi, boundsLo, boundsHi, overlap int, to func(int) int) func(int) float64 {
+	band := func(start, end int) (float64, float64) {
+		return float64(to(start)), float64(to(end) - to(start))
+	}
+	hasBefore, hasAfter := lo > boundsLo, hi < boundsHi
+	beforeStart, beforeLen := band(lo, lo+2*overlap)
+	afterStart, afterLen := band(hi-2*overlap, hi)
+
+	return func(v int) float64 {
+		w := 1.0
+		pos := float64(v) + 0.5
+		if hasBefore && beforeLen > 0 {
+			w *= clamp01((pos - beforeStart) / beforeLen)
+		}
+		if hasAfter && afterLen > 0 {
+			w *= clamp01(1 - (pos-afterStart)/afterLen)
+		}
+		return w
+	}
+}
+
+// clamp01 limits v to [0, 1]
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+// loadTile decodes a cached upscaled tile
+func loadTile(workDir string, t tile) (*image.RGBA, error) {
+	file, err := os.Open(tilePath(workDir, t))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tile %d: %w", t.index+1, err)
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode tile %d: %w", t.index+1, err)
+	}
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Bounds().Min == (image.Point{}) {
+		return rgba, nil
+	}
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	return rgba, nil
+}
+
+// resizeBilinear resamples src to width x height
+func resizeBilinear(src *image.RGBA, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+	scaleX := float64(srcW) / float64(width)
+	scaleY := float64(srcH) / float64(height)
+
+	for y := 0; y < height; y++ {
+		fy := math.Max((float64(y)+0.5)*scaleY-0.5, 0)
+		y0 := min(int(fy), srcH-1)
+		y1 := min(y0+1, srcH-1)
+		ty := fy - float64(y0)
+
+		for x := 0; x < width; x++ {
+			fx := math.Max((float64(x)+0.5)*scaleX-0.5, 0)
+			x0 := min(int(fx), srcW-1)
+			x1 := min(x0+1, srcW-1)
+			tx := fx - float64(x0)
+
+			for i := 0; i < 4; i++ {
+				p00 := float64(src.Pix[y0*src.Stride+x0*4+i])
+				p10 := float64(src.Pix[y0*src.Stride+x1*4+i])
+				p01 := float64(src.Pix[y1*src.Stride+x0*4+i])
+				p11 := float64(src.Pix[y1*src.Stride+x1*4+i])
+				top := p00 + (p10-p00)*tx
+				bottom := p01 + (p11-p01)*tx
+				dst.Pix[y*dst.Stride+x*4+i] = uint8(top + (bottom-top)*ty + 0.5)
+			}
+		}
+	}
+	return dst
+}
+
+// saveImage encodes an upscaled image as JPEG when that was requested and as
+// PNG otherwise, into a temporary file
+func saveImage(img *image.RGBA, format string) (string, error) {
+	ext := ".png"
+	if format == "jpeg" {
+		ext = ".jpg"
+	}
+
+	tmpFile, err := os.CreateTemp("", "upscaled-*"+ext)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+
+	if ext == ".jpg" {
+		err = jpeg.Encode(tmpFile, img, &jpeg.Options{Quality: 95})
+	} else {
+		err = png.Encode(tmpFile, img)
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to save upscaled image: %w", err)
+	}
+	return tmpPath, nil
+}
@@ -0,0 +1,318 @@
+package upscaler
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"fluxxxer/internal/upscaler/upscalertest"
+)
+
+func TestSplitEvenly(t *testing.T) {
+	tests := []struct {
+		length, size int
+		want         []int
+	}{
+		{800, 400, []int{0, 400, 800}},
+		{801, 400, []int{0, 267, 534, 801}},
+		{1000, 400, []int{0, 333, 666, 1000}},
+		{10, 400, []int{0, 10}},
+		{400, 400, []int{0, 400}},
+	}
+
+	for _, tt := range tests {
+		got := splitEvenly(tt.length, tt.size)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("splitEvenly(%d, %d) = %v, want %v", tt.length, tt.size, got, tt.want)
+		}
+		for i := 1; i < len(got); i++ {
+			if part := got[i] - got[i-1]; part > tt.size {
+				t.Errorf("splitEvenly(%d, %d) has a part of %d", tt.length, tt.size, part)
+			}
+		}
+	}
+}
+
+func TestTileGrid(t *testing.T) {
+	bounds := image.Rect(0, 0, 1000, 600)
+	grid := tileGrid(bounds, 400, 16)
+
+	// Three columns at 0, 333, 666 and two rows at 0, 300, each extended
+	// by the overlap towards its neighbours only
+	want := []image.Rectangle{
+		image.Rect(0, 0, 349, 316),
+		image.Rect(317, 0, 682, 316),
+		image.Rect(650, 0, 1000, 316),
+		image.Rect(0, 284, 349, 600),
+		image.Rect(317, 284, 682, 600),
+		image.Rect(650, 284, 1000, 600),
+	}
+	if len(grid) != len(want) {
+		t.Fatalf("got %d tiles, want %d", len(grid), len(want))
+	}
+	for i, tile := range grid {
+		if tile.index != i {
+			t.Errorf("tile %d has index %d", i, tile.index)
+		}
+		if tile.outer != want[i] {
+			t.Errorf("tile %d = %v, want %v", i, tile.outer, want[i])
+		}
+	}
+
+	// An image smaller than a tile is a single tile without overlap
+	small := image.Rect(0, 0, 300, 200)
+	if grid := tileGrid(small, 400, 16); len(grid) != 1 || grid[0].outer != small {
+		t.Errorf("tileGrid of a small image = %v, want the image as one tile", grid)
+	}
+}
+
+func TestTileDefaults(t *testing.T) {
+	tiles, err := tileDefaults(TileOptions{}, LimitsFor(UpscaleFast))
+	if err != nil {
+		t.Fatalf("tileDefaults: %v", err)
+	}
+	if tiles.TileSize+2*tiles.Overlap != maxTileSide || tiles.Overlap != DefaultTileOverlap {
+		t.Errorf("tiles = %d + 2x%d, want %d in all", tiles.TileSize, tiles.Overlap, maxTileSide)
+	}
+
+	for _, bad := range []TileOptions{
+		{TileSize: 1000, Overlap: 32},
+		{TileSize: 100, Overlap: 30},
+		{TileSize: 100, Overlap: -1},
+	} {
+		if _, err := tileDefaults(bad, LimitsFor(UpscaleFast)); err == nil {
+			t.Errorf("tileDefaults accepted %+v", bad)
+		}
+	}
+}
+
+func TestSeamWeightsSumToOne(t *testing.T) {
+	const overlap = 16
+	bounds := image.Rect(0, 0, 1000, 600)
+	grid := tileGrid(bounds, 200, overlap)
+
+	for _, scale := range []float64{1, 2.5, 4} {
+		to := func(v int) int {
+			return int(math.Round(float64(v) * scale))
+		}
+
+		// Along each axis, the weights of the tiles covering an output
+		// pixel add up to one
+		for _, axis := range []struct {
+			name     string
+			lo, hi   func(image.Rectangle) int
+			boundsLo int
+			boundsHi int
+		}{
+			{"x", func(r image.Rectangle) int { return r.Min.X }, func(r image.Rectangle) int { return r.Max.X }, bounds.Min.X, bounds.Max.X},
+			{"y", func(r image.Rectangle) int { return r.Min.Y }, func(r image.Rectangle) int { return r.Max.Y }, bounds.Min.Y, bounds.Max.Y},
+		} {
+			// Tiles in one row or column, without duplicates
+			var spans [][2]int
+			for _, tile := range grid {
+				span := [2]int{axis.lo(tile.outer), axis.hi(tile.outer)}
+				if !slices.Contains(spans, span) {
+					spans = append(spans, span)
+				}
+			}
+
+			for v := to(axis.boundsLo); v < to(axis.boundsHi); v++ {
+				sum := 0.0
+				for _, span := range spans {
+					if v >= to(span[0]) && v < to(span[1]) {
+						sum += seamRamp(span[0], span[1], axis.boundsLo, axis.boundsHi, overlap, to)(v)
+					}
+				}
+				if math.Abs(sum-1) > 1e-9 {
+					t.Fatalf("scale %v: weights at %s=%d sum to %v, want 1", scale, axis.name, v, sum)
+				}
+			}
+		}
+	}
+}
+
+// writeTile stores an upscaled tile of a single color in workDir
+func writeTile(t *testing.T, workDir string, tile tile, scale int, c color.RGBA) {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, tile.outer.Dx()*scale, tile.outer.Dy()*scale))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	f, err := os.Create(tilePath(workDir, tile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStitchTiles(t *testing.T) {
+	const overlap = 8
+	bounds := image.Rect(0, 0, 300, 200)
+	grid := tileGrid(bounds, 100, overlap)
+
+	// Tiles of one color stitch without visible seams
+	workDir := t.TempDir()
+	gray := color.RGBA{R: 200, G: 100, B: 50, A: 255}
+	for _, tile := range grid {
+		writeTile(t, workDir, tile, 2, gray)
+	}
+	out, err := stitchTiles(workDir, grid, bounds, overlap)
+	if err != nil {
+		t.Fatalf("stitchTiles: %v", err)
+	}
+	if out.Bounds() != image.Rect(0, 0, 600, 400) {
+		t.Fatalf("stitched bounds = %v, want 600x400", out.Bounds())
+	}
+	for y := 0; y < 400; y++ {
+		for x := 0; x < 600; x++ {
+			got := out.RGBAAt(x, y)
+			if absDiff(got.R, gray.R) > 1 || absDiff(got.G, gray.G) > 1 || absDiff(got.B, gray.B) > 1 || absDiff(got.A, gray.A) > 1 {
+				t.Fatalf("pixel %d,%d = %v, want %v", x, y, got, gray)
+			}
+		}
+	}
+
+	// Away from the seams each tile shows through unblended
+	workDir = t.TempDir()
+	colors := make([]color.RGBA, len(grid))
+	for i, tile := range grid {
+		colors[i] = color.RGBA{R: uint8(40 * i), G: 255 - uint8(40*i), B: 128, A: 255}
+		writeTile(t, workDir, tile, 2, colors[i])
+	}
+	out, err = stitchTiles(workDir, grid, bounds, overlap)
+	if err != nil {
+		t.Fatalf("stitchTiles: %v", err)
+	}
+	for i, tile := range grid {
+		center := tile.outer.Min.Add(tile.outer.Max)
+		if got := out.RGBAAt(center.X, center.Y); got != colors[i] {
+			t.Errorf("center of tile %d = %v, want %v", i, got, colors[i])
+		}
+	}
+}
+
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+func TestUpscaleTiledResumes(t *testing.T) {
+	// Cached tiles live under the user cache directory
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	server := upscalertest.NewServer()
+	defer server.Close()
+	server.Mode = upscalertest.ModeBinary
+
+	c := newTestClient(t, server, "")
+	input := writeTestImage(t, 400, 300)
+	opts := UpscaleOptions{Type: UpscaleFast, OutputFormat: "png"}
+
+	// uploaded records the tiles that were sent to the service
+	var (
+		mu       sync.Mutex
+		uploaded []int
+	)
+	tileOpts := func(then func(TileProgress)) TileOptions {
+		return TileOptions{TileSize: 200, Overlap: 16, Concurrency: 1, OnProgress: func(p TileProgress) {
+			mu.Lock()
+			if p.Progress.Phase == PhaseUploading && !slices.Contains(uploaded, p.Tile) {
+				uploaded = append(uploaded, p.Tile)
+			}
+			mu.Unlock()
+			if then != nil {
+				then(p)
+			}
+		}}
+	}
+
+	// Stop the first run once two of the four tiles are done
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := c.UpscaleTiled(ctx, input, opts, tileOpts(func(p TileProgress) {
+		if p.Done == 2 {
+			cancel()
+		}
+	}))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("first run err = %v, want context.Canceled", err)
+	}
+	if !slices.Equal(uploaded, []int{0, 1}) {
+		t.Fatalf("first run uploaded tiles %v, want [0 1]", uploaded)
+	}
+
+	// The second run only uploads the tiles that are missing
+	uploaded = nil
+	result, err := c.UpscaleTiled(context.Background(), input, opts, tileOpts(nil))
+	if err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if !slices.Equal(uploaded, []int{2, 3}) {
+		t.Errorf("second run uploaded tiles %v, want [2 3]", uploaded)
+	}
+	if width, height := imageSize(t, result.URL); width != 1600 || height != 1200 {
+		t.Errorf("stitched image is %dx%d, want 1600x1200", width, height)
+	}
+
+	// The tiles are dropped once stitched, so a third run starts over
+	uploaded = nil
+	if _, err := c.UpscaleTiled(context.Background(), input, opts, tileOpts(nil)); err != nil {
+		t.Fatalf("third run: %v", err)
+	}
+	if len(uploaded) != 4 {
+		t.Errorf("third run uploaded tiles %v, want all 4", uploaded)
+	}
+}
+
+func TestTileWorkDirPrunesStaleRuns(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	root, err := os.UserCacheDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root = filepath.Join(root, "fluxxxer", "tiles")
+
+	// A run abandoned long ago and one still being retried
+	stale, recent := filepath.Join(root, "stale"), filepath.Join(root, "recent")
+	for _, dir := range []string{stale, recent} {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "tile-0"), []byte("tile"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-staleTileAge - time.Hour)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := tileWorkDir("/photos/cat.png|1|2", UpscaleOptions{Type: UpscaleFast}, TileOptions{TileSize: 400, Overlap: 32})
+	if err != nil {
+		t.Fatalf("tileWorkDir: %v", err)
+	}
+	if filepath.Dir(dir) != root {
+		t.Fatalf("work dir = %s, want it under %s", dir, root)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale tiles are kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(recent, "tile-0")); err != nil {
+		t.Errorf("recent tiles are removed: %v", err)
+	}
+}
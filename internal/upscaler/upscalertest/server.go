@@ -0,0 +1,270 @@
+// Package upscalertest provides a fake upscaler endpoint for exercising the
+// upscaler client offline and for running the app without the real service.
+package upscalertest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+
+	"fluxxxer/internal/flux/fluxtest"
+)
+
+// Mode selects how the server answers an upscale request
+type Mode string
+
+const (
+	// ModeAuto answers fast upscales with binary data and conservative or
+	// creative ones with an async job, like the real service
+	ModeAuto Mode = "auto"
+	// ModeBinary returns the image bytes directly
+	ModeBinary Mode = "binary"
+	// ModeBase64 returns {"success": true, "data": {"image": "data:...;base64,..."}}
+	// where the base64 payload is itself JSON holding the base64 image
+	ModeBase64 Mode = "base64"
+	// ModeURL returns a JSON object with the URL of the upscaled image
+	ModeURL Mode = "url"
+	// ModeAsync returns a job that is polled at /result/{id}
+	ModeAsync Mode = "async"
+)
+
+// Scale is how much the placeholder output is enlarged
+const Scale = 4
+
+// maxOutputSide caps the placeholder output
+const maxOutputSide = 2048
+
+// Server is a fake upscaler. The upscale endpoint is at Endpoint(); results
+// of async jobs are polled at Endpoint()/result/{id} and images are served
+// from /images/.
+type Server struct {
+	*httptest.Server
+
+	// Mode selects the response format; the default is ModeAuto
+	Mode Mode
+	// APIKey, if set, must be sent as a bearer token
+	APIKey string
+	// PollsUntilDone is how many polls an async job stays in progress
+	PollsUntilDone int
+	// FailWith, if set, makes every async job fail with this message
+	FailWith string
+
+	mu     sync.Mutex
+	nextID int
+	jobs   map[string]*job
+}
+
+type job struct {
+	id     string
+	width  int
+	height int
+	polls  int
+}
+
+// NewServer starts a fake upscaler. Call Close when done.
+func NewServer() *Server {
+	s := &Server{
+		Mode:           ModeAuto,
+		PollsUntilDone: 2,
+		jobs:           make(map[string]*job),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/upscale", s.handleUpscale)
+	mux.HandleFunc("GET /v1/upscale/result/{id}", s.handleResult)
+	mux.HandleFunc("GET /images/{name}", s.handleImage)
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Endpoint returns the URL to configure as UPSCALER_API_URL
+func (s *Server) Endpoint() string {
+	return s.URL + "/v1/upscale"
+}
+
+func (s *Server) handleUpscale(w http.ResponseWriter, r *http.Request) {
+	if s.APIKey != "" && r.Header.Get("Authorization") != "Bearer "+s.APIKey {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid API key"})
+		return
+	}
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "image is required"})
+		return
+	}
+	defer file.Close()
+
+	cfg, _, err := image.DecodeConfig(file)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "image could not be decoded"})
+		return
+	}
+	width, height := outputSize(cfg.Width, cfg.Height)
+
+	upscaleType := r.FormValue("type")
+	if upscaleType == "" {
+		upscaleType = "fast"
+	}
+
+	mode := s.Mode
+	if mode == "" || mode == ModeAuto {
+		mode = ModeBinary
+		if upscaleType == "conservative" || upscaleType == "creative" {
+			mode = ModeAsync
+		}
+	}
+
+	switch mode {
+	case ModeBinary:
+		data, err := encodePlaceholder(width, height)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(data)
+
+	case ModeBase64:
+		data, err := encodePlaceholder(width, height)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		inner, _ := json.Marshal(map[string]string{"image": base64.StdEncoding.EncodeToString(data)})
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"success": true,
+			"data": map[string]string{
+				"image": "data:application/json;base64," + base64.StdEncoding.EncodeToString(inner),
+			},
+		})
+
+	case ModeURL:
+		// The job is already finished, so a client that polls anyway gets
+		// the result on the first poll
+		j := s.newJob(width, height, s.PollsUntilDone)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"id":           j.id,
+			"success":      true,
+			"is_completed": true,
+			"url":          s.imageURL(j.id, width, height),
+		})
+
+	case ModeAsync:
+		j := s.newJob(width, height, 0)
+
+		// The service reports where the image will be while the job runs
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{
+			"id":           j.id,
+			"status":       "in-progress",
+			"is_completed": false,
+			"url":          s.imageURL(j.id, width, height),
+		})
+
+	default:
+		http.Error(w, fmt.Sprintf("unknown mode %q", mode), http.StatusInternalServerError)
+	}
+}
+
+// newJob registers a job that completes after PollsUntilDone polls, counting
+// the given number as already made
+func (s *Server) newJob(width, height, polls int) *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	j := &job{id: "job-" + strconv.Itoa(s.nextID), width: width, height: height, polls: polls}
+	s.jobs[j.id] = j
+	return j
+}
+
+func (s *Server) handleResult(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	j, ok := s.jobs[r.PathValue("id")]
+	if !ok {
+		s.mu.Unlock()
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "job not found"})
+		return
+	}
+	j.polls++
+	done := j.polls > s.PollsUntilDone
+	s.mu.Unlock()
+
+	switch {
+	case !done:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"id":           j.id,
+			"status":       "in-progress",
+			"is_completed": false,
+		})
+	case s.FailWith != "":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"id":     j.id,
+			"status": "failed",
+			"error":  s.FailWith,
+		})
+	default:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"id":           j.id,
+			"status":       "completed",
+			"is_completed": true,
+			"url":          s.imageURL(j.id, j.width, j.height),
+		})
+	}
+}
+
+func (s *Server) handleImage(w http.ResponseWriter, r *http.Request) {
+	width, _ := strconv.Atoi(r.URL.Query().Get("w"))
+	height, _ := strconv.Atoi(r.URL.Query().Get("h"))
+	if width <= 0 || height <= 0 {
+		width, height = 256, 256
+	}
+
+	data, err := encodePlaceholder(min(width, maxOutputSide), min(height, maxOutputSide))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(data)
+}
+
+// imageURL returns the URL serving a placeholder of the given size
+func (s *Server) imageURL(name string, width, height int) string {
+	return fmt.Sprintf("%s/images/%s.png?w=%d&h=%d", s.URL, name, width, height)
+}
+
+// outputSize scales the input by Scale, keeping the long side within
+// maxOutputSide
+func outputSize(width, height int) (int, int) {
+	width, height = width*Scale, height*Scale
+	if longest := max(width, height); longest > maxOutputSide {
+		width = max(width*maxOutputSide/longest, 1)
+		height = max(height*maxOutputSide/longest, 1)
+	}
+	return width, height
+}
+
+// encodePlaceholder renders a placeholder PNG
+func encodePlaceholder(width, height int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, fluxtest.Placeholder(width, height)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}